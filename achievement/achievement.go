@@ -0,0 +1,136 @@
+package achievement
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"mj0lk.be/netwars/cache"
+	"mj0lk.be/netwars/event"
+	"mj0lk.be/netwars/player"
+	"time"
+)
+
+const KILLS = 100
+
+//returns the players earning the badge for event e
+type MatchFunc func(c appengine.Context, e *event.Event) ([]*datastore.Key, error)
+
+type Rule struct {
+	Name        string    `json:"name"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Match       MatchFunc `json:"-"`
+}
+
+var Rules = []Rule{
+	Rule{"first_ice", "Ice breaker", "First successful Ice attack", firstIce},
+	Rule{"hundred_kills", "Exterminator", "Killed 100 programs", hundredKills},
+	Rule{"war_survivor", "Survivor", "Clan survived a war", warSurvivor},
+	Rule{"clan_founder", "Founder", "Founded a clan", clanFounder},
+}
+
+func init() {
+	event.Handle(evaluate)
+}
+
+func owner(e *event.Event) []*datastore.Key {
+	if e.Player == nil {
+		return nil
+	}
+	return []*datastore.Key{e.Player}
+}
+
+func firstIce(c appengine.Context, e *event.Event) ([]*datastore.Key, error) {
+	if e.EventType == "Attack" && e.Action == "Ice" && e.Direction == event.OUT && e.Result {
+		return owner(e), nil
+	}
+	return nil, nil
+}
+
+//runs after the player statistics handler
+func hundredKills(c appengine.Context, e *event.Event) ([]*datastore.Key, error) {
+	if e.EventType != "Attack" || e.Player == nil || e.ProgramsKilled == 0 {
+		return nil, nil
+	}
+	stats, err := player.Stats(c, e.Player)
+	if err != nil {
+		return nil, err
+	}
+	if stats.ProgramsKilled >= KILLS {
+		return owner(e), nil
+	}
+	return nil, nil
+}
+
+//war closed, all members of both clans. allies (AllyDisConnect) and disbands don't count
+func warSurvivor(c appengine.Context, e *event.Event) ([]*datastore.Key, error) {
+	if e.EventType != "Clan" || e.Clan == nil || e.Action != "DisConnect" {
+		return nil, nil
+	}
+	return datastore.NewQuery("Player").Filter("ClanKey =", e.Clan).KeysOnly().GetAll(c, nil)
+}
+
+func clanFounder(c appengine.Context, e *event.Event) ([]*datastore.Key, error) {
+	if e.EventType == "Clan" && e.Action == "Create" {
+		return owner(e), nil
+	}
+	return nil, nil
+}
+
+func evaluate(c appengine.Context, e *event.Event) error {
+	if e.EventType == "Achievement" {
+		return nil
+	}
+	for _, rule := range Rules {
+		keys, err := rule.Match(c, e)
+		if err != nil {
+			return err
+		}
+		for _, playerKey := range keys {
+			if err := grant(c, playerKey, rule); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//badges are granted once
+func grant(c appengine.Context, playerKey *datastore.Key, rule Rule) error {
+	granted := false
+	if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		iplayer := new(player.Player)
+		if err := datastore.Get(c, playerKey, iplayer); err != nil {
+			return err
+		}
+		if iplayer.HasBadge(rule.Name) {
+			return nil
+		}
+		now := time.Now()
+		iplayer.Badges = append(iplayer.Badges, player.Badge{Name: rule.Name, Title: rule.Title, Earned: now})
+		if _, err := datastore.Put(c, playerKey, iplayer); err != nil {
+			return err
+		}
+		e := &event.Event{
+			Created:    now,
+			Player:     playerKey,
+			PlayerName: iplayer.Nick,
+			PlayerID:   iplayer.ID,
+			EventType:  "Achievement",
+			Direction:  event.IN,
+			Action:     rule.Title,
+			Result:     true,
+		}
+		if err := event.Send(c, []*event.Event{e}, event.Func); err != nil {
+			return err
+		}
+		granted = true
+		return nil
+	}, nil); err != nil {
+		return err
+	}
+	if granted {
+		cache.Delete(c, playerKey.StringID()+"Player")
+		cache.Delete(c, playerKey.StringID())
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package achievement
+
+import (
+	"appengine"
+	"appengine/aetest"
+	"appengine/datastore"
+	"errors"
+	"mj0lk.be/netwars/event"
+	"mj0lk.be/netwars/player"
+	"mj0lk.be/netwars/secure"
+	"testing"
+)
+
+const (
+	TESTNICK  = "testnick"
+	TESTEMAIL = "testemail@mail.com"
+)
+
+func setupPlayer(c appengine.Context, nick string, email string) (string, error) {
+	cr := player.Creation{email, nick, "testpassword", ""}
+	tokenStr, usererr, err := player.Create(c, cr)
+	if err != nil {
+		return "", err
+	}
+	if usererr != nil {
+		return "", errors.New("unexpected user error")
+	}
+	playerKeyStr, _ := secure.ValidateToken(tokenStr, c)
+	return playerKeyStr, nil
+}
+
+func TestEvaluate(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	playerStr, err := setupPlayer(c, TESTNICK, TESTEMAIL)
+	if err != nil {
+		t.Fatalf("Error setting up player %s", err)
+	}
+	playerKey, _ := datastore.DecodeKey(playerStr)
+	e := &event.Event{Player: playerKey, EventType: "Attack", Action: "Ice", Direction: event.OUT, Result: true}
+	for i := 0; i < 2; i++ {
+		if err := evaluate(c, e); err != nil {
+			t.Fatalf("\n error evaluating event %s", err)
+		}
+	}
+	iplayer := new(player.Player)
+	if err := datastore.Get(c, playerKey, iplayer); err != nil {
+		t.Fatalf("\n error getting player %s", err)
+	}
+	if len(iplayer.Badges) != 1 || !iplayer.HasBadge("first_ice") {
+		t.Fatalf("\n expected one ice badge, got %+v", iplayer.Badges)
+	}
+}
+
+func TestWarSurvivor(t *testing.T) {
+	clanKey := new(datastore.Key)
+	for _, action := range []string{"AllyDisConnect", "Disband", "Connect"} {
+		e := &event.Event{Clan: clanKey, EventType: "Clan", Action: action, Direction: event.IN}
+		if keys, err := warSurvivor(nil, e); err != nil || keys != nil {
+			t.Fatalf("\n %s awarded survivors %v, %v", action, keys, err)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package achievement
+
+import (
+	"mj0lk.be/netwars/app"
+	"net/http"
+)
+
+func ListRules(w http.ResponseWriter, r *http.Request, c app.Context) {
+	res := app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: Rules}
+	res.JSONf(w)
+}
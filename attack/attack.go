@@ -8,6 +8,7 @@ import (
 	"math"
 	"math/rand"
 	"mj0lk.be/netwars/clan"
+	"mj0lk.be/netwars/config"
 	"mj0lk.be/netwars/event"
 	"mj0lk.be/netwars/player"
 	"mj0lk.be/netwars/program"
@@ -26,9 +27,8 @@ const (
 )
 
 var (
-	TypeBonus      float64 = 0.2
-	OffensiveTypes         = []int64{program.MUT, program.HUK, program.D0S, program.SW}
-	AttackType             = map[string]int64{
+	OffensiveTypes = []int64{program.MUT, program.HUK, program.D0S, program.SW}
+	AttackType     = map[string]int64{
 		"Balanced":     BAL,
 		"Memory":       MEM,
 		"Bandwidth":    BW,
@@ -45,6 +45,13 @@ var (
 	}
 )
 
+func init() {
+	//spy reports, scheduled attacks and deceptions are gone with the season
+	player.RegisterSeasonKind("SpyReport")
+	player.RegisterSeasonKind("ScheduledAttack")
+	player.RegisterSeasonKind("Deception")
+}
+
 type ActiveProgram struct {
 	Key    string `json:"key"`
 	Amount int64  `json:"amount"`
@@ -67,8 +74,10 @@ type AttackWindow struct {
 	DefenseEvent *AttackEvent
 	BattleMap    map[int64]*AttackFrame
 	Updated      []*AttackEventProgram
+	Dealers      []*AttackEventProgram
 	UpdatedKeys  []*datastore.Key
 	ToUpdate     []interface{}
+	Shared       bool //strike battle, several attackers meet the same defending programs
 }
 
 type AttackEvent struct {
@@ -87,8 +96,17 @@ func (eprog *AttackEventProgram) AttackDamage() float64 {
 	fmt.Printf(" << Amount used : %d >>\n", eprog.AmountUsed)
 	fmt.Printf(" << Program's attack: %d >>\n", eprog.PlayerProgram.Attack)
 	fmt.Printf(" << Efficiency %f >>\n", eprog.AttackEfficiency)
-	fmt.Printf(" << Damage dealt %f >>\n", float64(eprog.AmountUsed)*float64(eprog.PlayerProgram.Attack)*eprog.AttackEfficiency)
-	return float64(eprog.AmountUsed) * float64(eprog.PlayerProgram.Attack) * eprog.AttackEfficiency
+	return float64(eprog.AmountUsed) * float64(eprog.PlayerProgram.Attack) * eprog.AttackEfficiency *
+		eprog.PlayerProgram.AttackBonus(eprog.Level)
+}
+
+func (eprog *AttackEventProgram) GainExperience(damage float64) {
+	exp := int64(damage / player.EXPDAMAGE)
+	if exp <= 0 {
+		return
+	}
+	eprog.PlayerProgram.GainExperience(exp)
+	eprog.ExpGained += exp
 }
 
 func (eprog *AttackEventProgram) ReceiveDamage(window *AttackWindow, attackDamage float64) {
@@ -100,7 +118,8 @@ func (eprog *AttackEventProgram) ReceiveDamage(window *AttackWindow, attackDamag
 	}
 	attackDamage = attackDamage * attackFactor
 	intDamage := int64(attackDamage)
-	killedPrograms := (intDamage - (intDamage % eprog.PlayerProgram.Life)) / eprog.PlayerProgram.Life
+	life := eprog.PlayerProgram.EffectiveLife(eprog.Level)
+	killedPrograms := (intDamage - (intDamage % life)) / life
 	programsLeft := eprog.AmountBefore
 	for _, amk := range eprog.AmountLost {
 		programsLeft -= amk
@@ -124,8 +143,10 @@ func (eprog *AttackEventProgram) ReceiveDamage(window *AttackWindow, attackDamag
 		window.DefenseEvent.YieldLost += eprog.YieldLost
 	}
 	eprog.PlayerProgram.Amount -= killedPrograms
-	//TODO  calculate experience here?
-
+	//survivors learn from the damage taken
+	if programsLeft > killedPrograms {
+		eprog.GainExperience(attackDamage)
+	}
 }
 
 func (window *AttackWindow) AddReceiver(atype int64, a *AttackEventProgram) {
@@ -152,10 +173,16 @@ func (window *AttackWindow) AddDealer(atype int64, a *AttackEventProgram) {
 		window.BattleMap[atype].AddDealer(a)
 	} else {
 		frame := new(AttackFrame)
-		frame.AddDealer(a)
 		frame.Window = window
+		frame.AddDealer(a)
 		window.BattleMap[atype] = frame
 	}
+	for _, dealer := range window.Dealers {
+		if dealer == a {
+			return
+		}
+	}
+	window.Dealers = append(window.Dealers, a)
 }
 
 func (window *AttackWindow) Render() {
@@ -175,9 +202,24 @@ func (window *AttackWindow) Render() {
 			}
 		}
 	}
+	//programs without losses still store their experience
+	for _, veteran := range append(window.Dealers, window.Updated...) {
+		if veteran.ExpGained > 0 && veteran.Amount == 0 {
+			window.ToUpdate = append(window.ToUpdate, veteran.PlayerProgram)
+			window.UpdatedKeys = append(window.UpdatedKeys, veteran.PlayerProgram.DbKey)
+		}
+	}
 }
 
+//in a strike a program deals once per frame, however many strikers it faces
 func (frame *AttackFrame) AddDealer(a *AttackEventProgram) {
+	if frame.Window.Shared {
+		for _, dealer := range frame.Dealing {
+			if dealer.PlayerProgram.DbKey.Equal(a.PlayerProgram.DbKey) {
+				return
+			}
+		}
+	}
 	frame.Dealing = append(frame.Dealing, a)
 }
 
@@ -190,11 +232,29 @@ func (frame *AttackFrame) AddReceiver(a *AttackEventProgram) {
 	frame.Receiving = append(frame.Receiving, a)
 }
 
+//a program can deal in one window and receive in the other, store it once
+func updates(keys []*datastore.Key, models []interface{}, windows ...*AttackWindow) ([]*datastore.Key, []interface{}) {
+	seen := make(map[string]bool)
+	for _, window := range windows {
+		for i, key := range window.UpdatedKeys {
+			if seen[key.Encode()] {
+				continue
+			}
+			seen[key.Encode()] = true
+			keys = append(keys, key)
+			models = append(models, window.ToUpdate[i])
+		}
+	}
+	return keys, models
+}
+
 func (frame *AttackFrame) Render() {
 	receiverCount := len(frame.Receiving)
 	var attackDamage float64
 	for _, dealer := range frame.Dealing {
-		attackDamage += dealer.AttackDamage()
+		damage := dealer.AttackDamage()
+		dealer.GainExperience(damage)
+		attackDamage += damage
 	}
 	attackDamage = attackDamage / float64(receiverCount)
 	for _, receiver := range frame.Receiving {
@@ -202,11 +262,6 @@ func (frame *AttackFrame) Render() {
 	}
 }
 
-func isValidAttack(attacker, defender *player.Player) {
-	//	errors := make(map[string]int, 4)
-
-}
-
 func loadWar(c appengine.Context, doneCh chan<- int, attacker, defender *AttackEvent) {
 	var war int
 	aClanId := make(chan int64)
@@ -234,6 +289,16 @@ func loadWar(c appengine.Context, doneCh chan<- int, attacker, defender *AttackE
 }
 
 func render(cfg AttackCfg, attacker, defender *player.Player, attack, defense *AttackWindow) error {
+	if err := engage(cfg, attacker, defender, attack, defense); err != nil {
+		return err
+	}
+	defense.Render()
+	attack.Render()
+	return nil
+}
+
+//puts the attacker's programs and the defender's programs they meet in the battle frames
+func engage(cfg AttackCfg, attacker, defender *player.Player, attack, defense *AttackWindow) error {
 	for _, attackProgram := range cfg.ActivePrograms {
 		attackProgramKey, err := datastore.DecodeKey(attackProgram.Key)
 		if err != nil {
@@ -242,7 +307,8 @@ func render(cfg AttackCfg, attacker, defender *player.Player, attack, defense *A
 		for _, offensiveType := range OffensiveTypes {
 			if aGroupForType, ok := attacker.Programs[offensiveType]; ok {
 				for _, aProg := range aGroupForType.Programs {
-					if aProg.ProgramKey.Equal(attackProgramKey) {
+					//borrowed programs only defend
+					if aProg.ProgramKey.Equal(attackProgramKey) && aProg.Lender == nil {
 						if !aGroupForType.Power {
 							return errors.New("Can't use attack program without power")
 						}
@@ -257,6 +323,7 @@ func render(cfg AttackCfg, attacker, defender *player.Player, attack, defense *A
 							aProg,
 							&event.EventProgram{
 								Name:           aProg.Name,
+								Level:          aProg.Level,
 								AmountBefore:   aProg.Amount,
 								AmountUsed:     attackProgram.Amount,
 								ProgramActive:  aProg.Active,
@@ -271,15 +338,18 @@ func render(cfg AttackCfg, attacker, defender *player.Player, attack, defense *A
 									if dProg.EffectorTypes&cfg.AttackType == 0 {
 										activeDefender = false
 									}
+									//borrowed programs bring the lender's power
 									daeProgram := &AttackEventProgram{
 										dProg,
 										&event.EventProgram{
 											Name:           dProg.Name,
+											Source:         dProg.Source,
+											Level:          dProg.Level,
 											AmountBefore:   dProg.Amount,
 											AmountUsed:     dProg.Amount,
 											ProgramActive:  dProg.Active,
 											ActiveDefender: activeDefender,
-											Power:          dGroupForType.Power,
+											Power:          dGroupForType.Power || dProg.Lender != nil,
 											Owned:          true},
 									}
 									if defenseType == aProg.EffectorTypes&defenseType {
@@ -308,8 +378,6 @@ func render(cfg AttackCfg, attacker, defender *player.Player, attack, defense *A
 		}
 
 	}
-	defense.Render()
-	attack.Render()
 	return nil
 }
 
@@ -336,6 +404,32 @@ func NewAttackEvent(t int64, dir int64, player, target *player.Player) *AttackEv
 	return ievent
 }
 
+//what the attackers take from the battle, nothing when they lost
+type outcome struct {
+	won    bool
+	cycles int64 //taken from the defender
+	cps    int64
+	aps    int64
+}
+
+//the attackers win when the defender lost more than a tenth over their own losses,
+//war (a connection each way) brings clan points
+func battleOutcome(attackEvent, defenseEvent *AttackEvent, defender *player.Player, war int) outcome {
+	diffLoss := defenseEvent.BwLost - attackEvent.BwLost
+	if diffLoss <= 0 || diffLoss <= attackEvent.BwLost*0.1 {
+		return outcome{}
+	}
+	result := outcome{won: true, aps: 1}
+	if war > 0 {
+		pct := math.Min((attackEvent.BwKilled/defender.BandwidthUsage)*100, 10)
+		hardpts := math.Min((math.Sqrt(attackEvent.BwKilled)+200)/200, 10)
+		result.cps = int64(((pct + hardpts) * 0.5) * float64(war))
+		result.aps = int64(war)
+	}
+	result.cycles = int64(float64(defender.Cycles) * config.Get().Attack.CycleTransfer)
+	return result
+}
+
 func Attack(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent, error) {
 	c.Debugf("running attack  cfg: %+v<<<\n", cfg)
 	attackerKey, err := datastore.DecodeKey(playerStr)
@@ -346,6 +440,9 @@ func Attack(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent,
 	if err != nil {
 		return AttackEvent{}, err
 	}
+	if err := cooldown(c, attackerKey, cfg.Target, cfg.AttackType); err != nil {
+		return AttackEvent{}, err
+	}
 	var response AttackEvent
 	options := new(datastore.TransactionOptions)
 	options.XG = true
@@ -363,23 +460,19 @@ func Attack(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent,
 			return err
 		}
 		<-playerStCh
+		if err := isValidAttack(attacker, defender); err != nil {
+			return err
+		}
 		attackEvent := NewAttackEvent(cfg.AttackType, event.OUT, attacker, defender)
 		defenseEvent := NewAttackEvent(cfg.AttackType, event.IN, defender, attacker)
-		if attacker.BandwidthUsage < defender.BandwidthUsage {
-			if attacker.ActiveMemory < 2 {
-				return errors.New("Not enough active memory")
-			}
-			attackEvent.Memory = 2
-		} else {
-			if attacker.ActiveMemory < 3 {
-				return errors.New("Not enough active activememory")
-			}
-			attackEvent.Memory = 3
+		attackEvent.Memory = attackMemory(cfg.AttackType, attacker, defender)
+		if attacker.ActiveMemory < attackEvent.Memory {
+			return errors.New("Not enough active memory")
 		}
 		warCh := make(chan int, 1)
 		if attacker.ClanKey != nil && defender.ClanKey != nil {
-			if attacker.ClanKey.Equal(defender.ClanKey) {
-				return errors.New("Can't attack your own team members")
+			if err := checkClans(c, attacker, defender); err != nil {
+				return err
 			}
 			go loadWar(c, warCh, attackEvent, defenseEvent)
 		} else {
@@ -396,37 +489,23 @@ func Attack(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent,
 			DefenseEvent: attackEvent,
 			BattleMap:    make(map[int64]*AttackFrame),
 		}
-		//TODO check attacker status
 		if err := render(cfg, attacker, defender, attack, defense); err != nil {
 			return err
 		}
-		diffLoss := defenseEvent.BwLost - attackEvent.BwLost
-		vicCon := attackEvent.BwLost * 0.1
-		war := <-warCh
-		if diffLoss <= 0 || diffLoss <= vicCon {
-			attackEvent.Result, defenseEvent.Result = false, true
-			defenseEvent.ApsGained = 1
+		result := battleOutcome(attackEvent, defenseEvent, defender, <-warCh)
+		attackEvent.Result, defenseEvent.Result = result.won, !result.won
+		if result.won {
+			attackEvent.ApsGained = result.aps
+			attackEvent.CpsGained = result.cps
+			attackEvent.CyclesGained = result.cycles
+			defenseEvent.Cycles = result.cycles
+			defender.LastAttacked = time.Now()
 		} else {
-			attackEvent.Result, defenseEvent.Result = true, false
-			attackEvent.ApsGained = 1
-			if war > 0 {
-				pct := (attackEvent.BwKilled / defender.BandwidthUsage) * 100
-				c.Debugf("pct killed : %.2f \n", pct)
-				if pct > 10.0 {
-					pct = 10
-				}
-				hardpts := (math.Sqrt(attackEvent.BwKilled) + 200) / 200
-				c.Debugf("hardpts: %.2f \n", hardpts)
-				if hardpts > 10.0 {
-					hardpts = 10
-				}
-				cps := ((pct + hardpts) * 0.5) * float64(war)
-				attackEvent.CpsGained = int64(cps)
-				attackEvent.ApsGained = int64(war)
-			}
-			transferCycles := int64(float64(defender.Cycles) * 0.1)
-			attackEvent.CyclesGained = transferCycles
-			defenseEvent.Cycles = transferCycles
+			defenseEvent.ApsGained = 1
+		}
+		evs := []*event.Event{attackEvent.Event, defenseEvent.Event}
+		if attackEvent.Result && defender.Killed(defenseEvent.BwLost) {
+			evs = append(evs, defender.Kill(attacker))
 		}
 		attacker.Cycles += attackEvent.CyclesGained
 		defender.Cycles -= defenseEvent.Cycles
@@ -437,14 +516,13 @@ func Attack(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent,
 		attacker.ActiveMemory -= attackEvent.Memory
 		keys := []*datastore.Key{attackerKey, defenderKey}
 		models := []interface{}{attacker, defender}
-		keys = append(keys, append(attack.UpdatedKeys, defense.UpdatedKeys...)...)
-		models = append(models, append(attack.ToUpdate, defense.ToUpdate...)...)
+		keys, models = updates(keys, models, attack, defense)
 		if _, err := datastore.PutMulti(c, keys, models); err != nil {
 			return err
 		}
 		attackEvent.NewBandwidthUsage = attacker.BandwidthUsage - attackEvent.BwLost
 		defenseEvent.NewBandwidthUsage = defender.BandwidthUsage - defenseEvent.BwLost
-		if err := event.Send(c, []*event.Event{attackEvent.Event, defenseEvent.Event}, event.Func); err != nil {
+		if err := event.Send(c, evs, event.Func); err != nil {
 			return err
 		}
 		response = *attackEvent
@@ -484,7 +562,7 @@ func buildProbability(actPct, actVpct float64) []ProbResult {
 	return rv
 }
 
-func renderProb(attackProgram *AttackEventProgram, defender *player.Player) (ProbResult, error) {
+func renderProb(attackProgram *AttackEventProgram, defender *player.Player, chance config.Chance) (ProbResult, error) {
 	pDef := []int64{program.FW, program.INF}
 	var pctDefense float64
 	for _, def := range pDef {
@@ -503,18 +581,19 @@ func renderProb(attackProgram *AttackEventProgram, defender *player.Player) (Pro
 			continue
 		}
 	}
+	detection := counterIntelligence(defender, attackProgram.PlayerProgram.Type)
 	result := ProbResult{false, false, false}
 	pctDefense -= pctDefense * 0.1 // no negative effect due to numbers on first iteration
 	cnt := 1.0
 	for attackProgram.PlayerProgram.Amount > 0 {
 		pctDefense += pctDefense * (cnt / 10)
-		actualPct := MAXCH - pctDefense
-		actualVpct := MINVCH + pctDefense
-		if actualPct < MINCH {
-			actualPct = MINCH
+		actualPct := chance.Max - pctDefense
+		actualVpct := chance.VisualMin + pctDefense + detection
+		if actualPct < chance.Min {
+			actualPct = chance.Min
 		}
-		if actualVpct > MAXVCH {
-			actualVpct = MAXVCH
+		if actualVpct > chance.VisualMax {
+			actualVpct = chance.VisualMax
 		}
 		probs := buildProbability(actualPct, actualVpct)
 		rand.Seed(time.Now().UnixNano())
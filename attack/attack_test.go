@@ -6,6 +6,8 @@ import (
 	"appengine/datastore"
 	"errors"
 	"mj0lk.be/netwars/clan"
+	"mj0lk.be/netwars/config"
+	"mj0lk.be/netwars/event"
 	"mj0lk.be/netwars/player"
 	"mj0lk.be/netwars/program"
 	"mj0lk.be/netwars/secure"
@@ -25,6 +27,7 @@ const (
 	MUTCONN       = "Mutator Connection"
 	INTCONN       = "Spy Connection"
 	ICECONN       = "Ice connection"
+	CINTCONN      = "Counter-intelligence connection"
 	SWARM         = "Swarm mark IV"
 	MUTATOR       = "Mutator IV"
 	HUNTERKILLER  = "Hunter/Killer program"
@@ -33,6 +36,7 @@ const (
 	INTP          = "spy program"
 	ICEP          = "ice program"
 	INFECTP       = "infect program"
+	CINTP         = "counter-intelligence program"
 	CLAN1         = "Clan1"
 	CLAN2         = "Clan2"
 )
@@ -104,6 +108,17 @@ func setupPrograms(c appengine.Context) error {
 		Description: "Connector for Intelligence type programs",
 		Effectors:   []string{"Ice"},
 	}
+	CINTConnect := &program.Program{
+		Name:        CINTCONN,
+		TypeName:    "Connection",
+		Attack:      0,
+		Life:        80,
+		Cycles:      200,
+		Memory:      1,
+		Bandwidth:   3000,
+		Description: "Connector for Counter-intelligence type programs",
+		Effectors:   []string{"Counter-intelligence"},
+	}
 	swarmProg := &program.Program{
 		Name:        SWARM,
 		Attack:      40,
@@ -174,6 +189,16 @@ func setupPrograms(c appengine.Context) error {
 		Description: "ice prog",
 		InfectName:  INFECTP,
 	}
+	cintProg := &program.Program{
+		Name:        CINTP,
+		Attack:      0,
+		Life:        0,
+		TypeName:    "Counter-intelligence",
+		Cycles:      200,
+		Memory:      1,
+		Description: "counter-intelligence prog",
+		Effectors:   []string{"Intelligence"},
+	}
 	dur := time.Duration(3) * time.Hour
 	infProg := &program.Program{
 		Name:        INFECTP,
@@ -185,7 +210,7 @@ func setupPrograms(c appengine.Context) error {
 		Description: "infect prog",
 		Ettl:        int64(dur.Seconds()),
 	}
-	programs := []*program.Program{SWConnect, HKConnect, D0SConnect, MUTConnect, INTConnect, ICEConnect, swarmProg, mutProg, hkProg, hkProg2, d0sProg, intProg, iceProg, infProg}
+	programs := []*program.Program{SWConnect, HKConnect, D0SConnect, MUTConnect, INTConnect, ICEConnect, CINTConnect, swarmProg, mutProg, hkProg, hkProg2, d0sProg, intProg, infProg, iceProg, cintProg}
 	for _, prog := range programs {
 		if err := program.CreateOrUpdate(c, prog); err != nil {
 			return err
@@ -195,7 +220,7 @@ func setupPrograms(c appengine.Context) error {
 }
 
 func setupPlayer(c appengine.Context, nick string, email string) (string, error) {
-	cr := player.Creation{email, nick, "testpassword"}
+	cr := player.Creation{email, nick, "testpassword", ""}
 	tokenStr, usererr, err := player.Create(c, cr)
 	if err != nil {
 		return "", err
@@ -204,11 +229,22 @@ func setupPlayer(c appengine.Context, nick string, email string) (string, error)
 	if usererr != nil {
 		return "", errors.New("unexpected user error")
 	}
-	playerKeyStr, _ := secure.ValidateToken(tokenStr)
+	playerKeyStr, _ := secure.ValidateToken(tokenStr, c)
 	return playerKeyStr, nil
 }
 
 //create attacklist with all available offensive programs
+//test players are new, no protection or cooldown
+func openWorld(t *testing.T) {
+	world := config.Default
+	world.Attack.NewbieProtection = 0
+	world.Attack.HitProtection = 0
+	world.Attack.Cooldown = 0
+	if err := config.Use(world); err != nil {
+		t.Fatalf("rule set error %s \n", err)
+	}
+}
+
 func getAttackPrograms(c appengine.Context, playerKey *datastore.Key) ([]ActiveProgram, error) {
 	state := new(player.Player)
 	if err := player.Status(c, playerKey.Encode(), state); err != nil {
@@ -244,6 +280,8 @@ func TestSpy(t *testing.T) {
 		t.Fatalf("NewContext: %v", err)
 	}
 	defer c.Close()
+	openWorld(t)
+	defer config.Use(config.Default)
 	attackerStr, err := setupPlayer(c, ANICK, AEMAIL)
 	if err != nil {
 		t.Fatalf("setup players error %s \n", err)
@@ -327,6 +365,8 @@ func TestIce(t *testing.T) {
 		t.Fatalf("NewContext: %v", err)
 	}
 	defer c.Close()
+	openWorld(t)
+	defer config.Use(config.Default)
 	attackerStr, err := setupPlayer(c, ANICK, AEMAIL)
 	if err != nil {
 		t.Fatalf("setup players error %s \n", err)
@@ -390,6 +430,8 @@ func TestAttack(t *testing.T) {
 		t.Fatalf("NewContext: %v", err)
 	}
 	defer c.Close()
+	openWorld(t)
+	defer config.Use(config.Default)
 	attackerStr, err := setupPlayer(c, ANICK, AEMAIL)
 	if err != nil {
 		t.Fatalf("setup players error %s \n", err)
@@ -473,6 +515,8 @@ func TestAttackWithClan(t *testing.T) {
 		t.Fatalf("NewContext: %v", err)
 	}
 	defer c.Close()
+	openWorld(t)
+	defer config.Use(config.Default)
 	attackerStr, err := setupPlayer(c, ANICK, AEMAIL)
 	if err != nil {
 		t.Fatalf("setup players error %s \n", err)
@@ -579,3 +623,415 @@ func TestAttackWithClan(t *testing.T) {
 	t.Logf("\n <<< ATTACKEVENT >>> \n%+v\n", attackEvent)
 	testutils.CheckQueue(c, t, 1)
 }
+
+func TestAttackRules(t *testing.T) {
+	attacker := &player.Player{Status: player.LIVE, BandwidthUsage: 100}
+	defender := &player.Player{Status: player.LIVE, BandwidthUsage: 110, Created: time.Now()}
+	if err := isValidAttack(attacker, defender); err != NewbieProtectedError {
+		t.Fatalf("expected newbie protection, got %v", err)
+	}
+	defender.Created = time.Now().Add(-100 * time.Hour)
+	defender.LastAttacked = time.Now()
+	if err := isValidAttack(attacker, defender); err != HitProtectedError {
+		t.Fatalf("expected hit protection, got %v", err)
+	}
+	defender.LastAttacked = time.Time{}
+	if err := isValidAttack(attacker, defender); err != nil {
+		t.Fatalf("valid attack error %s", err)
+	}
+	defender.BandwidthUsage = 200
+	if err := isValidAttack(attacker, defender); err != OutOfRangeError {
+		t.Fatalf("expected out of range, got %v", err)
+	}
+	defender.BandwidthUsage = 110
+	defender.Status = player.DEAD
+	if err := isValidAttack(attacker, defender); err != TargetDeadError {
+		t.Fatalf("expected dead target, got %v", err)
+	}
+	defender.Status = player.LIVE
+	attacker.Status = player.SUSPENDED
+	if err := isValidAttack(attacker, defender); err != AttackerInactiveError {
+		t.Fatalf("expected inactive attacker, got %v", err)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	openWorld(t)
+	defer config.Use(config.Default)
+	attackerStr, err := setupPlayer(c, ANICK, AEMAIL)
+	if err != nil {
+		t.Fatalf("setup players error %s \n", err)
+	}
+	defenderStr, err := setupPlayer(c, BNICK, BEMAIL)
+	if err != nil {
+		t.Fatalf("setup players error %s \n", err)
+	}
+	defenderKey, err := datastore.DecodeKey(defenderStr)
+	if err != nil {
+		t.Fatalf("error decoding key %s \n", err)
+	}
+	defender := new(player.Player)
+	if err := datastore.Get(c, defenderKey, defender); err != nil {
+		t.Fatalf("errror loading defender %s \n", err)
+	}
+	cfg := ScheduleCfg{AttackCfg: AttackCfg{AttackType: BW, Target: defender.ID}}
+	if _, err := Schedule(c, attackerStr, cfg); err != InvalidLaunchError {
+		t.Fatalf("expected invalid launch error, got %v", err)
+	}
+	cfg.Delay = 3600
+	//programs the attacker doesn't own are refused before anything is queued
+	testutils.PurgeQueue(c, t)
+	cfg.ActivePrograms = []ActiveProgram{ActiveProgram{datastore.NewKey(c, "Program", SWARM, 0, nil).Encode(), 1}}
+	if _, err := Schedule(c, attackerStr, cfg); err == nil {
+		t.Fatalf("scheduled an attack with programs the attacker doesn't own")
+	}
+	testutils.CheckQueue(c, t, 0)
+	cfg.ActivePrograms = nil
+	scheduled, err := Schedule(c, attackerStr, cfg)
+	if err != nil {
+		t.Fatalf("schedule error %s \n", err)
+	}
+	//launch task and event task
+	testutils.CheckQueue(c, t, 2)
+	list, err := Scheduled(c, attackerStr)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("expected 1 scheduled attack, got %d, %v", len(list), err)
+	}
+	if err := Cancel(c, defenderStr, scheduled.EncodedKey); err == nil {
+		t.Fatalf("defender canceled the attack")
+	}
+	if err := Cancel(c, attackerStr, scheduled.EncodedKey); err != nil {
+		t.Fatalf("cancel error %s \n", err)
+	}
+	if err := Cancel(c, attackerStr, scheduled.EncodedKey); err != LaunchedError {
+		t.Fatalf("expected launched error, got %v", err)
+	}
+	//canceled, nothing to launch
+	if err := launchScheduled(c, scheduled.EncodedKey); err != nil {
+		t.Fatalf("launch error %s \n", err)
+	}
+}
+
+func TestStrike(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	openWorld(t)
+	defer config.Use(config.Default)
+	attackerStr, err := setupPlayer(c, ANICK, AEMAIL)
+	if err != nil {
+		t.Fatalf("setup players error %s \n", err)
+	}
+	if _, _, err := clan.Create(c, attackerStr, CLAN1, "lol"); err != nil {
+		t.Fatalf("\n create clan error %s", err)
+	}
+	defenderStr, err := setupPlayer(c, BNICK, BEMAIL)
+	if err != nil {
+		t.Fatalf("setup players error %s \n", err)
+	}
+	if err := setupPrograms(c); err != nil {
+		t.Fatalf("error setup programs: %s \n", err)
+	}
+	attackerKey, err := datastore.DecodeKey(attackerStr)
+	defenderKey, err := datastore.DecodeKey(defenderStr)
+	if err != nil {
+		t.Fatalf("error decoding key %s \n", err)
+	}
+	swarmConnKey := datastore.NewKey(c, "Program", SWCONN, 0, nil)
+	swarmKey := datastore.NewKey(c, "Program", SWARM, 0, nil)
+	hkConnKey := datastore.NewKey(c, "Program", HKCONN, 0, nil)
+	hkKey := datastore.NewKey(c, "Program", HUNTERKILLER, 0, nil)
+	all := player.Allocation{swarmConnKey.Encode(), 1}
+	if err := player.Allocate(c, attackerStr, all); err != nil {
+		t.Fatalf("allocate attacker connection error %s \n", err)
+	}
+	all.PrgKey = swarmKey.Encode()
+	all.Amount = 4
+	if err := player.Allocate(c, attackerStr, all); err != nil {
+		t.Fatalf("allocate attacker offensive program error %s \n", err)
+	}
+	all.PrgKey = hkConnKey.Encode()
+	all.Amount = 1
+	if err := player.Allocate(c, defenderStr, all); err != nil {
+		t.Fatalf("allocate defending program connection error %s \n", err)
+	}
+	all.PrgKey = hkKey.Encode()
+	all.Amount = 5
+	if err := player.Allocate(c, defenderStr, all); err != nil {
+		t.Fatalf("allocate defending program error %s \n", err)
+	}
+	attackPrograms, err := getAttackPrograms(c, attackerKey)
+	if err != nil {
+		t.Fatalf("error loading attackprograms %s\n", err)
+	}
+	defender := new(player.Player)
+	if err := datastore.Get(c, defenderKey, defender); err != nil {
+		t.Fatalf("errror loading defender %s \n", err)
+	}
+	cfg := StrikeCfg{AttackType: BW, Target: defender.ID, Window: 60}
+	if _, err := OpenStrike(c, attackerStr, cfg); err != StrikeWindowError {
+		t.Fatalf("expected window error, got %v", err)
+	}
+	cfg.Window = 600
+	if _, err := OpenStrike(c, defenderStr, cfg); err != clan.ClanMemberError {
+		t.Fatalf("expected clan member error, got %v", err)
+	}
+	strike, err := OpenStrike(c, attackerStr, cfg)
+	if err != nil {
+		t.Fatalf("open strike error %s \n", err)
+	}
+	order := StrikeOrder{strike.EncodedKey, attackPrograms}
+	if err := Commit(c, defenderStr, order); err != clan.ClanMemberError {
+		t.Fatalf("expected clan member error, got %v", err)
+	}
+	//a second commitment replaces the first
+	for i := 0; i < 2; i++ {
+		if err := Commit(c, attackerStr, order); err != nil {
+			t.Fatalf("commit error %s \n", err)
+		}
+	}
+	testutils.PurgeQueue(c, t)
+	if err := resolveStrike(c, strike.EncodedKey); err != nil {
+		t.Fatalf("resolve error %s \n", err)
+	}
+	strikes, err := Strikes(c, attackerStr)
+	if err != nil || len(strikes) != 1 {
+		t.Fatalf("expected 1 strike, got %d, %v", len(strikes), err)
+	}
+	if !strikes[0].Resolved || len(strikes[0].Results) != 1 || len(strikes[0].Results[0].Error) > 0 {
+		t.Fatalf("expected resolved strike with 1 participant, got %+v", strikes[0])
+	}
+	if strikes[0].Results[0].Share != 1 {
+		t.Fatalf("expected full share, got %.2f", strikes[0].Results[0].Share)
+	}
+	if err := Commit(c, attackerStr, order); err != StrikeClosedError {
+		t.Fatalf("expected closed strike error, got %v", err)
+	}
+}
+
+func TestInfection(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	hostStr, err := setupPlayer(c, BNICK, BEMAIL)
+	if err != nil {
+		t.Fatalf("setup players error %s \n", err)
+	}
+	if err := setupPrograms(c); err != nil {
+		t.Fatalf("error setup programs: %s \n", err)
+	}
+	hostKey, err := datastore.DecodeKey(hostStr)
+	if err != nil {
+		t.Fatalf("error decoding key %s \n", err)
+	}
+	infectKey := datastore.NewKey(c, "Program", INFECTP, 0, nil)
+	version, err := program.Version(c)
+	if err != nil {
+		t.Fatalf("error loading catalogue version %s \n", err)
+	}
+	infectProg, err := program.KeyGet(c, infectKey, version)
+	if err != nil {
+		t.Fatalf("error loading infect program %s \n", err)
+	}
+	key := player.PlayerProgramKey(c, hostKey, infectKey)
+	infection := &player.PlayerProgram{
+		Program:    *infectProg,
+		ProgramKey: infectKey,
+		Source:     ANICK,
+		Amount:     10,
+		Expires:    time.Now().Add(time.Hour),
+		Active:     true,
+	}
+	if _, err := datastore.Put(c, key, infection); err != nil {
+		t.Fatalf("error planting infection %s \n", err)
+	}
+	host := new(player.Player)
+	if err := datastore.Get(c, hostKey, host); err != nil {
+		t.Fatalf("error loading host %s \n", err)
+	}
+	before := host.Cycles
+	testutils.PurgeQueue(c, t)
+	if err := tickInfection(c, key.Encode()); err != nil {
+		t.Fatalf("tick error %s \n", err)
+	}
+	testutils.CheckQueue(c, t, 1)
+	if err := datastore.Get(c, hostKey, host); err != nil {
+		t.Fatalf("error loading host %s \n", err)
+	}
+	if host.Cycles >= before {
+		t.Fatalf("expected drained cycles, before %d after %d", before, host.Cycles)
+	}
+	if err := datastore.Get(c, key, infection); err != nil {
+		t.Fatalf("error loading infection %s \n", err)
+	}
+	if infection.Amount != 11 {
+		t.Fatalf("expected the infection to grow to 11, got %d", infection.Amount)
+	}
+	//a second infection with the same program joins the running one
+	mergedKey, merged, err := infect(c, hostKey, &player.PlayerProgram{ProgramKey: infectKey, Amount: 3,
+		Expires: time.Now().Add(2 * time.Hour)})
+	if err != nil {
+		t.Fatalf("infect error %s \n", err)
+	}
+	if !mergedKey.Equal(key) || merged.Amount != 14 || merged.Source != ANICK {
+		t.Fatalf("expected the running infection with 14 units, got %v %+v", mergedKey, merged)
+	}
+	fw := &player.PlayerProgram{Amount: 2, Active: true}
+	fw.Attack = 10
+	fw.EffectorTypes = program.INF
+	host.Programs = map[int64]*player.PlayerProgramGroup{
+		program.FW: &player.PlayerProgramGroup{Power: true, Programs: []*player.PlayerProgram{fw}},
+	}
+	infection.Life = 4
+	if killed := cured(host, infection); killed != 5 {
+		t.Fatalf("expected 5 cured units, got %d", killed)
+	}
+	fw.Amount = 10
+	if killed := cured(host, infection); killed != infection.Amount {
+		t.Fatalf("expected a full cure, got %d", killed)
+	}
+	host.Programs[program.FW].Power = false
+	if killed := cured(host, infection); killed != 0 {
+		t.Fatalf("unpowered firewalls cured %d units", killed)
+	}
+}
+
+func TestCounterIntelligence(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	defenderStr, err := setupPlayer(c, BNICK, BEMAIL)
+	if err != nil {
+		t.Fatalf("setup players error %s \n", err)
+	}
+	if err := setupPrograms(c); err != nil {
+		t.Fatalf("error setup programs: %s \n", err)
+	}
+	cintKey := datastore.NewKey(c, "Program", CINTP, 0, nil)
+	all := player.Allocation{cintKey.Encode(), 1}
+	if err := player.Allocate(c, defenderStr, all); err != player.NotEnoughBandwidthError {
+		t.Fatalf("expected counter-intelligence to need a connection, got %v", err)
+	}
+	all.PrgKey = datastore.NewKey(c, "Program", CINTCONN, 0, nil).Encode()
+	if err := player.Allocate(c, defenderStr, all); err != nil {
+		t.Fatalf("allocate counter-intelligence connection error %s \n", err)
+	}
+	all.PrgKey = cintKey.Encode()
+	if err := player.Allocate(c, defenderStr, all); err != nil {
+		t.Fatalf("allocate counter-intelligence program error %s \n", err)
+	}
+	defender := new(player.Player)
+	if err := player.Status(c, defenderStr, defender); err != nil {
+		t.Fatalf("status error %s \n", err)
+	}
+	if pct := counterIntelligence(defender, program.INT); pct <= 0 {
+		t.Fatalf("expected counter-intelligence against spies, got %f pct", pct)
+	}
+	if pct := counterIntelligence(defender, program.ICE); pct != 0 {
+		t.Fatalf("counter-intelligence without ice effector detected %f pct", pct)
+	}
+	report := make([]event.EventProgram, MAXDECEPTION+1)
+	if _, err := Deceive(c, defenderStr, Deception{Report: report}); err != DeceptionError {
+		t.Fatalf("expected deception error, got %v", err)
+	}
+	fake := Deception{Report: []event.EventProgram{event.EventProgram{Name: SWARM, Amount: 100, Owned: true}}}
+	if _, err := Deceive(c, defenderStr, fake); err != nil {
+		t.Fatalf("deceive error %s \n", err)
+	}
+	deception, err := CurrentDeception(c, defenderStr)
+	if err != nil || len(deception.Report) != 1 || deception.Report[0].Owned {
+		t.Fatalf("expected a false report of 1 program, got %+v, %v", deception, err)
+	}
+	if _, err := Deceive(c, defenderStr, Deception{}); err != nil {
+		t.Fatalf("stop deception error %s \n", err)
+	}
+	if deception, err = CurrentDeception(c, defenderStr); err != nil || len(deception.Report) != 0 {
+		t.Fatalf("expected no false report, got %+v, %v", deception, err)
+	}
+}
+
+func TestSpyReports(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	spyStr, err := setupPlayer(c, ANICK, AEMAIL)
+	if err != nil {
+		t.Fatalf("setup players error %s \n", err)
+	}
+	spyKey, err := datastore.DecodeKey(spyStr)
+	if err != nil {
+		t.Fatalf("error decoding key %s \n", err)
+	}
+	spy := new(player.Player)
+	if err := datastore.Get(c, spyKey, spy); err != nil {
+		t.Fatalf("error loading spy %s \n", err)
+	}
+	target := &player.Player{ID: 42, Nick: BNICK}
+	old := newReport(spy, target, INTP, []event.EventProgram{event.EventProgram{Name: SWARM, Amount: 100}})
+	old.Created = time.Now().Add(-2 * time.Hour)
+	fresh := newReport(spy, target, INTP, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "SpyReport", "old", 0, spyKey),
+		datastore.NewKey(c, "SpyReport", "fresh", 0, spyKey),
+	}
+	if _, err := datastore.PutMulti(c, keys, []interface{}{old, fresh}); err != nil {
+		t.Fatalf("error storing reports %s \n", err)
+	}
+	reports, err := Reports(c, spyStr, "42")
+	if err != nil {
+		t.Fatalf("reports error %s \n", err)
+	}
+	if len(reports) != 2 || reports[0].Freshness != "fresh" || reports[1].Freshness != "aging" {
+		t.Fatalf("expected a fresh and an aging report, got %+v", reports)
+	}
+	if len(reports[1].Programs) != 1 {
+		t.Fatalf("expected 1 reported program, got %d", len(reports[1].Programs))
+	}
+	if err := Share(c, spyStr, ShareOrder{ReportKey: reports[0].EncodedKey, Shared: true}); err != ShareClanError {
+		t.Fatalf("expected share clan error, got %v", err)
+	}
+	//a clanmate reads the shared report until the spy leaves the clan
+	readerStr, err := setupPlayer(c, BNICK, BEMAIL)
+	if err != nil {
+		t.Fatalf("setup players error %s \n", err)
+	}
+	readerKey, err := datastore.DecodeKey(readerStr)
+	if err != nil {
+		t.Fatalf("error decoding key %s \n", err)
+	}
+	reader := new(player.Player)
+	if err := datastore.Get(c, readerKey, reader); err != nil {
+		t.Fatalf("error loading reader %s \n", err)
+	}
+	clanKey := datastore.NewKey(c, "Clan", "spies", 0, nil)
+	spy.ClanKey, reader.ClanKey = clanKey, clanKey
+	if _, err := datastore.PutMulti(c, []*datastore.Key{spyKey, readerKey}, []interface{}{spy, reader}); err != nil {
+		t.Fatalf("error joining clan %s \n", err)
+	}
+	if err := Share(c, spyStr, ShareOrder{ReportKey: reports[0].EncodedKey, Shared: true}); err != nil {
+		t.Fatalf("share error %s \n", err)
+	}
+	if shared, err := Reports(c, readerStr, "42"); err != nil || len(shared) != 1 {
+		t.Fatalf("expected 1 shared report, got %d, %v", len(shared), err)
+	}
+	spy.ClanKey = nil
+	if _, err := datastore.Put(c, spyKey, spy); err != nil {
+		t.Fatalf("error leaving clan %s \n", err)
+	}
+	if shared, err := Reports(c, readerStr, "42"); err != nil || len(shared) != 0 {
+		t.Fatalf("expected no shared report after the spy left, got %d, %v", len(shared), err)
+	}
+}
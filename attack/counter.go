@@ -0,0 +1,96 @@
+package attack
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/json"
+	"errors"
+	"mj0lk.be/netwars/event"
+	"mj0lk.be/netwars/player"
+	"mj0lk.be/netwars/program"
+	"time"
+)
+
+const MAXDECEPTION = 20
+
+var DeceptionError = errors.New("A false report lists at most 20 programs")
+
+//parent defender, keyname: deception. fed to spies when counter-intelligence catches them
+type Deception struct {
+	Report  []event.EventProgram `datastore:"-" json:"report"`
+	Data    []byte               `datastore:",noindex" json:"-"`
+	Updated time.Time            `datastore:",noindex" json:"updated"`
+}
+
+func (d *Deception) Load(c <-chan datastore.Property) error {
+	if err := datastore.LoadStruct(d, c); err != nil {
+		return err
+	}
+	return json.Unmarshal(d.Data, &d.Report)
+}
+
+func (d *Deception) Save(c chan<- datastore.Property) error {
+	data, err := json.Marshal(d.Report)
+	if err != nil {
+		return err
+	}
+	d.Data = data
+	return datastore.SaveStruct(d, c)
+}
+
+func deceptionKey(c appengine.Context, playerKey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, "Deception", "deception", 0, playerKey)
+}
+
+//pct of the defender's bandwidth running counter-intelligence against the program type
+func counterIntelligence(defender *player.Player, tpe int64) float64 {
+	group, ok := defender.Programs[program.CINT]
+	if !ok || !group.Power || defender.BandwidthUsage <= 0 {
+		return 0
+	}
+	var pct float64
+	for _, prog := range group.Programs {
+		if prog.Active && tpe&prog.EffectorTypes != 0 {
+			pct += prog.Usage / defender.BandwidthUsage * 100
+		}
+	}
+	return pct
+}
+
+//an empty report stops the deception
+func Deceive(c appengine.Context, playerStr string, deception Deception) (Deception, error) {
+	if len(deception.Report) > MAXDECEPTION {
+		return Deception{}, DeceptionError
+	}
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return Deception{}, err
+	}
+	key := deceptionKey(c, playerKey)
+	if len(deception.Report) == 0 {
+		return Deception{Report: make([]event.EventProgram, 0)}, datastore.Delete(c, key)
+	}
+	for i := range deception.Report {
+		deception.Report[i].Owned = false
+		deception.Report[i].Source = ""
+	}
+	deception.Updated = time.Now()
+	if _, err := datastore.Put(c, key, &deception); err != nil {
+		return Deception{}, err
+	}
+	return deception, nil
+}
+
+func CurrentDeception(c appengine.Context, playerStr string) (Deception, error) {
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return Deception{}, err
+	}
+	deception := Deception{}
+	if err := datastore.Get(c, deceptionKey(c, playerKey), &deception); err == datastore.ErrNoSuchEntity {
+		return Deception{Report: make([]event.EventProgram, 0)}, nil
+	} else if err != nil {
+		return Deception{}, err
+	}
+	return deception, nil
+}
@@ -12,17 +12,10 @@ func AttackPlayer(w http.ResponseWriter, r *http.Request, c app.Context) {
 		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
 	} else {
 		c.Debugf("attack cfg %+v possible types %d, %d, %d", cfg, BAL, ICE, INT)
-		var response AttackEvent
-		var err error
-		switch cfg.AttackType {
-		case BAL, MEM, BW:
-			response, err = Attack(c, c.User, cfg)
-		case ICE:
-			response, err = Ice(c, c.User, cfg)
-		case INT:
-			response, err = Spy(c, c.User, cfg)
-		}
-		if err != nil {
+		response, err := resolve(c, c.User, cfg)
+		if e, ok := err.(AttackError); ok {
+			res = app.JSONResult{Success: false, StatusCode: http.StatusForbidden, Error: e.Message, Result: e}
+		} else if err != nil {
 			res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
 			c.Debugf("result switch %+v\n", res)
 		} else {
@@ -31,3 +24,144 @@ func AttackPlayer(w http.ResponseWriter, r *http.Request, c app.Context) {
 	}
 	res.JSONf(w)
 }
+
+func ScheduleAttack(w http.ResponseWriter, r *http.Request, c app.Context) {
+	cfg := ScheduleCfg{}
+	var res app.JSONResult
+	if err := app.DecodeJsonBody(r, &cfg); err != nil {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+	} else if scheduled, err := Schedule(c, c.User, cfg); err == InvalidLaunchError || err == UnknownAttackError {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+	} else if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: scheduled}
+	}
+	res.JSONf(w)
+}
+
+func ScheduledAttacks(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	if scheduled, err := Scheduled(c, c.User); err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: scheduled}
+	}
+	res.JSONf(w)
+}
+
+func CancelScheduledAttack(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	if err := Cancel(c, c.User, c.Param("schedule_key")); err == LaunchedError {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+	} else if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK}
+	}
+	res.JSONf(w)
+}
+
+func OpenClanStrike(w http.ResponseWriter, r *http.Request, c app.Context) {
+	cfg := StrikeCfg{}
+	var res app.JSONResult
+	if err := app.DecodeJsonBody(r, &cfg); err != nil {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+	} else if strike, err := OpenStrike(c, c.User, cfg); err == StrikeTypeError || err == StrikeWindowError {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+	} else if err == StrikeRankError {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusForbidden, Error: err.Error()}
+	} else if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: strike}
+	}
+	res.JSONf(w)
+}
+
+func CommitToStrike(w http.ResponseWriter, r *http.Request, c app.Context) {
+	order := StrikeOrder{}
+	var res app.JSONResult
+	if err := app.DecodeJsonBody(r, &order); err != nil {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+	} else if err := Commit(c, c.User, order); err == StrikeClosedError || err == StrikeFullError {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+	} else if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK}
+	}
+	res.JSONf(w)
+}
+
+func ClanStrikes(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	if strikes, err := Strikes(c, c.User); err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: strikes}
+	}
+	res.JSONf(w)
+}
+
+func TickInfections(w http.ResponseWriter, r *http.Request, c app.Context) {
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusForbidden, Error: "cron only"}
+		res.JSONf(w)
+		return
+	}
+	if err := Infections(c); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
+func FeedDeception(w http.ResponseWriter, r *http.Request, c app.Context) {
+	deception := Deception{}
+	var res app.JSONResult
+	if err := app.DecodeJsonBody(r, &deception); err != nil {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+	} else if deception, err := Deceive(c, c.User, deception); err == DeceptionError {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+	} else if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: deception}
+	}
+	res.JSONf(w)
+}
+
+func PlayerDeception(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	if deception, err := CurrentDeception(c, c.User); err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: deception}
+	}
+	res.JSONf(w)
+}
+
+func TargetReports(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	if reports, err := Reports(c, c.User, c.Param("target_id")); err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: reports}
+	}
+	res.JSONf(w)
+}
+
+func ShareReport(w http.ResponseWriter, r *http.Request, c app.Context) {
+	order := ShareOrder{}
+	var res app.JSONResult
+	if err := app.DecodeJsonBody(r, &order); err != nil {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+	} else if err := Share(c, c.User, order); err == ShareClanError {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+	} else if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK}
+	}
+	res.JSONf(w)
+}
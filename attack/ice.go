@@ -4,6 +4,7 @@ import (
 	"appengine"
 	"appengine/datastore"
 	"errors"
+	"mj0lk.be/netwars/config"
 	"mj0lk.be/netwars/event"
 	"mj0lk.be/netwars/guid"
 	"mj0lk.be/netwars/player"
@@ -11,12 +12,6 @@ import (
 	"time"
 )
 
-const (
-	ICEMAXCH     float64 = 90.0
-	ICEMINCH     float64 = 50.0
-	ICEKILLMINCH float64 = 20.0
-)
-
 func Ice(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent, error) {
 	c.Infof("running spy attack <<<\n")
 	ln := len(cfg.ActivePrograms)
@@ -31,6 +26,13 @@ func Ice(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent, err
 	if err != nil {
 		return AttackEvent{}, err
 	}
+	if err := cooldown(c, attackerKey, cfg.Target, cfg.AttackType); err != nil {
+		return AttackEvent{}, err
+	}
+	version, err := program.Version(c)
+	if err != nil {
+		return AttackEvent{}, err
+	}
 	var response AttackEvent
 	options := new(datastore.TransactionOptions)
 	options.XG = true
@@ -48,17 +50,19 @@ func Ice(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent, err
 			return err
 		}
 		<-playerStCh
+		if err := isValidAttack(attacker, defender); err != nil {
+			return err
+		}
 		attackEvent := NewAttackEvent(cfg.AttackType, event.OUT, attacker, defender)
 		defenseEvent := NewAttackEvent(cfg.AttackType, event.IN, defender, attacker)
-		if attacker.ActiveMemory < 4 {
-			return errors.New("not enough active memory")
+		attackEvent.Memory = attackMemory(cfg.AttackType, attacker, defender)
+		if attacker.ActiveMemory < attackEvent.Memory {
+			return errors.New("Not enough active memory")
 		}
-		attackEvent.Memory = 4
-		//TODO check attacker status
 		warCh := make(chan int, 1)
 		if attacker.ClanKey != nil && defender.ClanKey != nil {
-			if attacker.ClanKey.Equal(defender.ClanKey) {
-				return errors.New("Can't attack your own team members")
+			if err := checkClans(c, attacker, defender); err != nil {
+				return err
 			}
 			go loadWar(c, warCh, attackEvent, defenseEvent)
 		} else {
@@ -83,7 +87,7 @@ func Ice(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent, err
 				attackProgram.Owned = true
 			}
 		}
-		result, err := renderProb(attackProgram, defender)
+		result, err := renderProb(attackProgram, defender, config.Get().Attack.Ice)
 		if err != nil {
 			return err
 		}
@@ -99,26 +103,27 @@ func Ice(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent, err
 		keys := []*datastore.Key{attackerKey, defenderKey}
 		models := []interface{}{attacker, defender}
 		if result.Success {
-			infectProg, err := program.KeyGet(c, attackProgram.PlayerProgram.Infect)
+			infectProg, err := program.KeyGet(c, attackProgram.PlayerProgram.Infect, version)
 			if err != nil {
 				return err
 			}
-			defKeyName, err := guid.GenUUID()
 			attKeyName, err := guid.GenUUID()
 			if err != nil {
 				return err
 			}
 			exp := time.Now().Add(time.Duration(infectProg.Ettl) * time.Second)
-			defInfectKey = datastore.NewKey(c, "PlayerProgram", defKeyName, 0, defenderKey)
-			defInfectProg = &player.PlayerProgram{
+			defInfectKey, defInfectProg, err = infect(c, defenderKey, &player.PlayerProgram{
 				Program:    *infectProg,
 				Source:     attacker.Nick,
-				Key:        defInfectKey,
 				Amount:     infectProg.InfectAmount,
 				ProgramKey: attackProgram.PlayerProgram.Infect,
 				Expires:    exp,
 				Active:     true,
+			})
+			if err != nil {
+				return err
 			}
+			defInfectProg.Key = defInfectKey
 			attInfectKey = datastore.NewKey(c, "PlayerProgram", attKeyName, 0, attackerKey)
 			attInfectProg = &player.PlayerProgram{
 				Program:    *infectProg,
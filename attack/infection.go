@@ -0,0 +1,205 @@
+package attack
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"math"
+	"math/rand"
+	"mj0lk.be/netwars/config"
+	"mj0lk.be/netwars/event"
+	"mj0lk.be/netwars/player"
+	"mj0lk.be/netwars/program"
+	"time"
+)
+
+var tickFunc = delay.Func("tickInfection", tickInfection)
+
+func infectionEvent(hostKey *datastore.Key, host *player.Player, infection *player.PlayerProgram,
+	action string) *event.Event {
+	return &event.Event{
+		Created:           time.Now(),
+		Expires:           infection.Expires,
+		Player:            hostKey,
+		PlayerName:        host.Nick,
+		PlayerID:          host.ID,
+		Clan:              host.ClanKey,
+		TargetName:        infection.Source,
+		EventType:         "Infection",
+		Action:            action,
+		Direction:         event.IN,
+		NewBandwidthUsage: host.BandwidthUsage,
+		EventPrograms:     []event.EventProgram{event.EventProgram{Name: infection.Name, Amount: infection.Amount}},
+	}
+}
+
+//infect units killed by the host's powered firewalls effective against infections
+func cured(host *player.Player, infection *player.PlayerProgram) int64 {
+	group, ok := host.Programs[program.FW]
+	if !ok || !group.Power {
+		return 0
+	}
+	var damage int64
+	for _, fw := range group.Programs {
+		if fw.Active && program.INF&fw.EffectorTypes != 0 {
+			damage += fw.Attack * fw.Amount
+		}
+	}
+	if damage == 0 {
+		return 0
+	}
+	if infection.Life <= 0 || damage/infection.Life > infection.Amount {
+		return infection.Amount
+	}
+	return damage / infection.Life
+}
+
+//a player carries one infection per program, a new infection joins the running one
+func infect(c appengine.Context, hostKey *datastore.Key, infection *player.PlayerProgram) (*datastore.Key,
+	*player.PlayerProgram, error) {
+	key := player.PlayerProgramKey(c, hostKey, infection.ProgramKey)
+	running := new(player.PlayerProgram)
+	if err := datastore.Get(c, key, running); err == datastore.ErrNoSuchEntity {
+		return key, infection, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if running.Amount == 0 {
+		//expired
+		return key, infection, nil
+	}
+	running.Amount += infection.Amount
+	if infection.Expires.After(running.Expires) {
+		running.Expires = infection.Expires
+	}
+	return key, running, nil
+}
+
+//cron: every running infection ticks in its own task
+func Infections(c appengine.Context) error {
+	keys, err := datastore.NewQuery("PlayerProgram").Filter("Type =", program.INF).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		tickFunc.Call(c, key.Encode())
+	}
+	return nil
+}
+
+//firewalls cure, the rest drains host cycles, grows into host bandwidth and may jump to a clanmate
+func tickInfection(c appengine.Context, infectionStr string) error {
+	key, err := datastore.DecodeKey(infectionStr)
+	if err != nil {
+		return err
+	}
+	hostKey := key.Parent()
+	rules := config.Get().Attack.Infection
+	host := new(player.Player)
+	if err := datastore.Get(c, hostKey, host); err != nil {
+		return err
+	}
+	var mateKey *datastore.Key
+	if host.ClanKey != nil && rand.Float64()*100 < rules.Spread {
+		keys, err := datastore.NewQuery("Player").Filter("ClanKey =", host.ClanKey).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		mates := make([]*datastore.Key, 0, len(keys))
+		for _, k := range keys {
+			if !k.Equal(hostKey) {
+				mates = append(mates, k)
+			}
+		}
+		if len(mates) > 0 {
+			mateKey = mates[rand.Intn(len(mates))]
+		}
+	}
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		infection := new(player.PlayerProgram)
+		if err := datastore.Get(c, key, infection); err == datastore.ErrNoSuchEntity {
+			//cured or respawned
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if infection.Amount == 0 {
+			//expired
+			return datastore.Delete(c, key)
+		}
+		if infection.Source == "" {
+			//the attacker's copy only tracks the planted infection
+			return nil
+		}
+		if err := player.Status(c, hostKey.Encode(), host); err != nil {
+			return err
+		}
+		if host.Status == player.DEAD {
+			//nothing to drain, respawning clears the infection
+			return nil
+		}
+		killed := cured(host, infection)
+		if killed == infection.Amount {
+			host.BandwidthUsage -= infection.BandwidthUsage * float64(killed)
+			if err := datastore.Delete(c, key); err != nil {
+				return err
+			}
+			if _, err := datastore.Put(c, hostKey, host); err != nil {
+				return err
+			}
+			e := infectionEvent(hostKey, host, infection, "Cured")
+			e.Result = true
+			e.ProgramsKilled = killed
+			return event.Send(c, []*event.Event{e}, event.Func)
+		}
+		infection.Amount -= killed
+		cycles := rules.CycleDrain * infection.Amount
+		if cycles > host.Cycles {
+			cycles = host.Cycles
+		}
+		grown := int64(math.Ceil(float64(infection.Amount) * rules.Growth))
+		infection.Amount += grown
+		host.Cycles -= cycles
+		host.BandwidthUsage += infection.BandwidthUsage * float64(grown-killed)
+		keys := []*datastore.Key{hostKey, key}
+		models := []interface{}{host, infection}
+		e := infectionEvent(hostKey, host, infection, "Drain")
+		e.Cycles = cycles
+		e.ProgramsKilled = killed
+		evs := []*event.Event{e}
+		if mateKey != nil {
+			mate := new(player.Player)
+			if err := datastore.Get(c, mateKey, mate); err != nil {
+				return err
+			}
+			if mate.Status == player.LIVE && mate.ClanKey != nil && mate.ClanKey.Equal(host.ClanKey) {
+				amount := infection.Amount / 2
+				if amount < 1 {
+					amount = 1
+				}
+				spreadKey, spread, err := infect(c, mateKey, &player.PlayerProgram{
+					Program:    infection.Program,
+					ProgramKey: infection.ProgramKey,
+					Source:     infection.Source,
+					Amount:     amount,
+					Expires:    infection.Expires,
+					Active:     true,
+				})
+				if err != nil {
+					return err
+				}
+				keys = append(keys, spreadKey)
+				models = append(models, spread)
+				se := infectionEvent(mateKey, mate, spread, "Spread")
+				se.Target, se.TargetName, se.TargetID = hostKey, host.Nick, host.ID
+				evs = append(evs, se)
+			}
+		}
+		if _, err := datastore.PutMulti(c, keys, models); err != nil {
+			return err
+		}
+		return event.Send(c, evs, event.Func)
+	}, options)
+}
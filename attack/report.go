@@ -0,0 +1,174 @@
+package attack
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/json"
+	"errors"
+	"mj0lk.be/netwars/event"
+	"mj0lk.be/netwars/player"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	MAXREPORTS  = 10
+	FRESHREPORT = time.Hour
+	STALEREPORT = 24 * time.Hour
+)
+
+var ShareClanError = errors.New("Join a clan to share spy reports")
+
+type ShareOrder struct {
+	ReportKey string `json:"report_key"`
+	Shared    bool   `json:"shared"`
+}
+
+//parent spy, keyname: guid. Clan is set when the report is shared
+type SpyReport struct {
+	EncodedKey  string               `datastore:"-" json:"report_key"`
+	SpyID       int64                `datastore:",noindex" json:"spy_id"`
+	SpyName     string               `datastore:",noindex" json:"spy_name"`
+	Target      int64                `json:"target_id"`
+	TargetName  string               `datastore:",noindex" json:"target_name"`
+	Clan        *datastore.Key       `json:"-"`
+	Shared      bool                 `json:"shared"`
+	ProgramName string               `datastore:",noindex" json:"program_name"`
+	Programs    []event.EventProgram `datastore:"-" json:"programs"`
+	Data        []byte               `datastore:",noindex" json:"-"`
+	Created     time.Time            `json:"created"`
+	Age         int64                `datastore:"-" json:"age"` //seconds
+	Freshness   string               `datastore:"-" json:"freshness"`
+}
+
+func (r *SpyReport) Load(c <-chan datastore.Property) error {
+	if err := datastore.LoadStruct(r, c); err != nil {
+		return err
+	}
+	age := time.Since(r.Created)
+	r.Age = int64(age.Seconds())
+	switch {
+	case age < FRESHREPORT:
+		r.Freshness = "fresh"
+	case age < STALEREPORT:
+		r.Freshness = "aging"
+	default:
+		r.Freshness = "stale"
+	}
+	return json.Unmarshal(r.Data, &r.Programs)
+}
+
+func (r *SpyReport) Save(c chan<- datastore.Property) error {
+	data, err := json.Marshal(r.Programs)
+	if err != nil {
+		return err
+	}
+	r.Data = data
+	return datastore.SaveStruct(r, c)
+}
+
+type byCreated []SpyReport
+
+func (r byCreated) Len() int           { return len(r) }
+func (r byCreated) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byCreated) Less(i, j int) bool { return r[i].Created.After(r[j].Created) }
+
+func newReport(spy, target *player.Player, programName string, programs []event.EventProgram) *SpyReport {
+	return &SpyReport{
+		SpyID:       spy.ID,
+		SpyName:     spy.Nick,
+		Target:      target.ID,
+		TargetName:  target.NickName(),
+		ProgramName: programName,
+		Programs:    append([]event.EventProgram{}, programs...),
+		Created:     time.Now(),
+	}
+}
+
+//own reports and the ones clanmates shared, newest first
+func Reports(c appengine.Context, playerStr, targetStr string) ([]SpyReport, error) {
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return nil, err
+	}
+	target, err := strconv.ParseInt(targetStr, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	iplayer := new(player.Player)
+	if err := datastore.Get(c, playerKey, iplayer); err != nil {
+		return nil, err
+	}
+	reports := make([]SpyReport, 0)
+	keys, err := datastore.NewQuery("SpyReport").Ancestor(playerKey).Filter("Target =", target).
+		Order("-Created").Limit(MAXREPORTS).GetAll(c, &reports)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		reports[i].EncodedKey = key.Encode()
+	}
+	if iplayer.ClanKey != nil {
+		var shared []SpyReport
+		keys, err := datastore.NewQuery("SpyReport").Filter("Clan =", iplayer.ClanKey).Filter("Shared =", true).
+			Filter("Target =", target).Order("-Created").Limit(MAXREPORTS).GetAll(c, &shared)
+		if err != nil {
+			return nil, err
+		}
+		//the report stays with the clan it was shared in, only spies still in the clan count
+		spyKeys := make([]*datastore.Key, len(keys))
+		for i, key := range keys {
+			spyKeys[i] = key.Parent()
+		}
+		spies := make([]player.Player, len(keys))
+		if err := datastore.GetMulti(c, spyKeys, spies); err != nil {
+			return nil, err
+		}
+		for i, key := range keys {
+			if spyKeys[i].Equal(playerKey) || !iplayer.ClanKey.Equal(spies[i].ClanKey) {
+				continue
+			}
+			shared[i].EncodedKey = key.Encode()
+			reports = append(reports, shared[i])
+		}
+	}
+	sort.Sort(byCreated(reports))
+	if len(reports) > MAXREPORTS {
+		reports = reports[:MAXREPORTS]
+	}
+	return reports, nil
+}
+
+//the spy's current clan reads the report while the spy stays, unsharing hides it again
+func Share(c appengine.Context, playerStr string, order ShareOrder) error {
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return err
+	}
+	key, err := datastore.DecodeKey(order.ReportKey)
+	if err != nil {
+		return err
+	}
+	if !playerKey.Equal(key.Parent()) {
+		return errors.New("Illegal operation")
+	}
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		iplayer := new(player.Player)
+		report := new(SpyReport)
+		if err := datastore.GetMulti(c, []*datastore.Key{playerKey, key},
+			[]interface{}{iplayer, report}); err != nil {
+			return err
+		}
+		if order.Shared && iplayer.ClanKey == nil {
+			return ShareClanError
+		}
+		report.Shared = order.Shared
+		report.Clan = nil
+		if order.Shared {
+			report.Clan = iplayer.ClanKey
+		}
+		_, err := datastore.Put(c, key, report)
+		return err
+	}, nil)
+}
@@ -0,0 +1,333 @@
+package attack
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/taskqueue"
+	"encoding/json"
+	"errors"
+	"mj0lk.be/netwars/event"
+	"mj0lk.be/netwars/guid"
+	"mj0lk.be/netwars/player"
+	"time"
+)
+
+const MAXSCHEDULE = 24 * time.Hour
+
+var (
+	InvalidLaunchError = errors.New("Launch must be in the future and within 24 hours")
+	LaunchedError      = errors.New("Attack already launched")
+	UnknownAttackError = errors.New("Unknown attack type")
+)
+
+var launchFunc = delay.Func("launchScheduled", launchScheduled)
+
+//launch or delay (seconds from now)
+type ScheduleCfg struct {
+	AttackCfg
+	Launch time.Time `json:"launch"`
+	Delay  int64     `json:"delay"`
+}
+
+//parent attacker, keyname: guid
+type ScheduledAttack struct {
+	EncodedKey     string          `datastore:"-" json:"schedule_key"`
+	AttackType     int64           `json:"attack_type"`
+	Target         int64           `json:"target"`
+	TargetName     string          `datastore:",noindex" json:"target_name"`
+	ActivePrograms []ActiveProgram `datastore:"-" json:"attack_programs"`
+	Programs       []byte          `datastore:",noindex" json:"-"`
+	Launch         time.Time       `json:"launch"`
+	Created        time.Time       `datastore:",noindex" json:"created"`
+}
+
+func (s *ScheduledAttack) Load(c <-chan datastore.Property) error {
+	if err := datastore.LoadStruct(s, c); err != nil {
+		return err
+	}
+	return json.Unmarshal(s.Programs, &s.ActivePrograms)
+}
+
+func (s *ScheduledAttack) Save(c chan<- datastore.Property) error {
+	programs, err := json.Marshal(s.ActivePrograms)
+	if err != nil {
+		return err
+	}
+	s.Programs = programs
+	return datastore.SaveStruct(s, c)
+}
+
+func (s *ScheduledAttack) cfg() AttackCfg {
+	return AttackCfg{s.AttackType, s.Target, s.ActivePrograms}
+}
+
+//runs the attack for its type against the current state of both players
+func resolve(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent, error) {
+	switch cfg.AttackType {
+	case BAL, MEM, BW:
+		return Attack(c, playerStr, cfg)
+	case ICE:
+		return Ice(c, playerStr, cfg)
+	case INT:
+		return Spy(c, playerStr, cfg)
+	}
+	return AttackEvent{}, UnknownAttackError
+}
+
+func scheduleEvent(attackerKey *datastore.Key, attacker *player.Player, defenderKey *datastore.Key,
+	defender *player.Player, scheduled *ScheduledAttack, dir int64, action string) *event.Event {
+	e := &event.Event{
+		Created:   time.Now(),
+		Expires:   scheduled.Launch,
+		EventType: "Schedule",
+		Action:    action,
+		Direction: dir,
+	}
+	owner, ownerKey, target, targetKey := attacker, attackerKey, defender, defenderKey
+	if dir == event.IN {
+		owner, ownerKey, target, targetKey = defender, defenderKey, attacker, attackerKey
+	}
+	e.Player, e.PlayerName, e.PlayerID, e.Clan = ownerKey, owner.Nick, owner.ID, owner.ClanKey
+	e.Target, e.TargetName, e.TargetID = targetKey, target.NickName(), target.ID
+	return e
+}
+
+//queues the attack, the defender gets an incoming event
+func Schedule(c appengine.Context, playerStr string, cfg ScheduleCfg) (ScheduledAttack, error) {
+	if _, ok := AttackName[cfg.AttackType]; !ok {
+		return ScheduledAttack{}, UnknownAttackError
+	}
+	attackerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return ScheduledAttack{}, err
+	}
+	defenderKey, err := player.KeyByID(c, cfg.Target)
+	if err != nil {
+		return ScheduledAttack{}, err
+	}
+	if attackerKey.Equal(defenderKey) {
+		return ScheduledAttack{}, errors.New("Illegal operation")
+	}
+	now := time.Now()
+	launch := cfg.Launch
+	if launch.IsZero() {
+		launch = now.Add(time.Duration(cfg.Delay) * time.Second)
+	}
+	if !launch.After(now) || launch.After(now.Add(MAXSCHEDULE)) {
+		return ScheduledAttack{}, InvalidLaunchError
+	}
+	keyName, err := guid.GenUUID()
+	if err != nil {
+		return ScheduledAttack{}, err
+	}
+	//the attack checks again at launch, a target that can't be attacked now gets no incoming event
+	attacker := new(player.Player)
+	defender := new(player.Player)
+	if err := player.Status(c, playerStr, attacker); err != nil {
+		return ScheduledAttack{}, err
+	}
+	if err := player.Status(c, defenderKey.Encode(), defender); err != nil {
+		return ScheduledAttack{}, err
+	}
+	if err := checkAttack(c, cfg.AttackCfg, attacker, defender); err != nil {
+		return ScheduledAttack{}, err
+	}
+	key := datastore.NewKey(c, "ScheduledAttack", keyName, 0, attackerKey)
+	scheduled := ScheduledAttack{
+		EncodedKey:     key.Encode(),
+		AttackType:     cfg.AttackType,
+		Target:         cfg.Target,
+		ActivePrograms: cfg.ActivePrograms,
+		Launch:         launch,
+		Created:        now,
+	}
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		attacker := new(player.Player)
+		defender := new(player.Player)
+		if err := datastore.GetMulti(c, []*datastore.Key{attackerKey, defenderKey},
+			[]interface{}{attacker, defender}); err != nil {
+			return err
+		}
+		scheduled.TargetName = defender.NickName()
+		if _, err := datastore.Put(c, key, &scheduled); err != nil {
+			return err
+		}
+		t, err := launchFunc.Task(key.Encode())
+		if err != nil {
+			return err
+		}
+		t.ETA = launch
+		if _, err := taskqueue.Add(c, t, ""); err != nil {
+			return err
+		}
+		evs := []*event.Event{
+			scheduleEvent(attackerKey, attacker, defenderKey, defender, &scheduled, event.OUT, "Scheduled"),
+			scheduleEvent(attackerKey, attacker, defenderKey, defender, &scheduled, event.IN, "Incoming"),
+		}
+		return event.Send(c, evs, event.Func)
+	}, options)
+	if err != nil {
+		return ScheduledAttack{}, err
+	}
+	return scheduled, nil
+}
+
+//attacks waiting for launch, first launch first
+func Scheduled(c appengine.Context, playerStr string) ([]ScheduledAttack, error) {
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return nil, err
+	}
+	scheduled := make([]ScheduledAttack, 0)
+	keys, err := datastore.NewQuery("ScheduledAttack").Ancestor(playerKey).Order("Launch").GetAll(c, &scheduled)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		scheduled[i].EncodedKey = key.Encode()
+	}
+	return scheduled, nil
+}
+
+//attacker only, the queued task finds nothing to launch
+func Cancel(c appengine.Context, playerStr, scheduleStr string) error {
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return err
+	}
+	key, err := datastore.DecodeKey(scheduleStr)
+	if err != nil {
+		return err
+	}
+	if !playerKey.Equal(key.Parent()) {
+		return errors.New("Illegal operation")
+	}
+	scheduled := new(ScheduledAttack)
+	if err := datastore.Get(c, key, scheduled); err == datastore.ErrNoSuchEntity {
+		return LaunchedError
+	} else if err != nil {
+		return err
+	}
+	defenderKey, err := player.KeyByID(c, scheduled.Target)
+	if err != nil {
+		return err
+	}
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Get(c, key, scheduled); err == datastore.ErrNoSuchEntity {
+			return LaunchedError
+		} else if err != nil {
+			return err
+		}
+		if !scheduled.Launch.After(time.Now()) {
+			return LaunchedError
+		}
+		attacker := new(player.Player)
+		defender := new(player.Player)
+		if err := datastore.GetMulti(c, []*datastore.Key{playerKey, defenderKey},
+			[]interface{}{attacker, defender}); err != nil {
+			return err
+		}
+		if err := datastore.Delete(c, key); err != nil {
+			return err
+		}
+		evs := []*event.Event{
+			scheduleEvent(playerKey, attacker, defenderKey, defender, scheduled, event.OUT, "Cancel"),
+			scheduleEvent(playerKey, attacker, defenderKey, defender, scheduled, event.IN, "Cancel"),
+		}
+		return event.Send(c, evs, event.Func)
+	}, options)
+}
+
+//task at launch time. an attack the rules refuse is dropped, other errors retry the task.
+//a launched attack starts the cooldown, a retry after it is refused
+func launchScheduled(c appengine.Context, scheduleStr string) error {
+	key, err := datastore.DecodeKey(scheduleStr)
+	if err != nil {
+		return err
+	}
+	scheduled := new(ScheduledAttack)
+	if err := datastore.Get(c, key, scheduled); err == datastore.ErrNoSuchEntity {
+		//canceled or season reset
+		return nil
+	} else if err != nil {
+		return err
+	}
+	attackerKey := key.Parent()
+	cfg := scheduled.cfg()
+	if err := launchable(c, attackerKey, cfg); err != nil {
+		if _, ok := err.(validationError); !ok {
+			return err
+		}
+		c.Infof("scheduled attack %s failed: %s", scheduleStr, err)
+		if err := datastore.Delete(c, key); err != nil {
+			return err
+		}
+		return failed(c, attackerKey, scheduled, err)
+	}
+	if _, err := resolve(c, attackerKey.Encode(), cfg); err != nil {
+		return err
+	}
+	return datastore.Delete(c, key)
+}
+
+//a rule refused the attack, retrying won't help
+type validationError struct {
+	error
+}
+
+//the checks the attack runs, a failed check comes back as a validationError
+func launchable(c appengine.Context, attackerKey *datastore.Key, cfg AttackCfg) error {
+	defenderKey, err := player.KeyByID(c, cfg.Target)
+	if err != nil {
+		return err
+	}
+	if defenderKey.Incomplete() {
+		return validationError{errors.New("Target not found")}
+	}
+	if err := cooldown(c, attackerKey, cfg.Target, cfg.AttackType); err != nil {
+		if err == CooldownError {
+			return validationError{err}
+		}
+		return err
+	}
+	attacker := new(player.Player)
+	defender := new(player.Player)
+	if err := player.Status(c, attackerKey.Encode(), attacker); err != nil {
+		return err
+	}
+	if err := player.Status(c, defenderKey.Encode(), defender); err != nil {
+		return err
+	}
+	if err := checkAttack(c, cfg, attacker, defender); err != nil {
+		return validationError{err}
+	}
+	return nil
+}
+
+//the attacker learns why the launch failed, the attack is not retried
+func failed(c appengine.Context, attackerKey *datastore.Key, scheduled *ScheduledAttack, reason error) error {
+	attacker := new(player.Player)
+	if err := datastore.Get(c, attackerKey, attacker); err != nil {
+		return err
+	}
+	e := &event.Event{
+		Created:    time.Now(),
+		Player:     attackerKey,
+		PlayerName: attacker.Nick,
+		PlayerID:   attacker.ID,
+		Clan:       attacker.ClanKey,
+		EventType:  "Schedule",
+		Action:     "Failed",
+		Direction:  event.OUT,
+		TargetName: scheduled.TargetName,
+		TargetID:   scheduled.Target,
+		Expires:    scheduled.Launch,
+		Reason:     reason.Error(),
+	}
+	return event.Send(c, []*event.Event{e}, event.Func)
+}
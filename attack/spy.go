@@ -4,18 +4,14 @@ import (
 	"appengine"
 	"appengine/datastore"
 	"errors"
+	"math/rand"
+	"mj0lk.be/netwars/config"
 	"mj0lk.be/netwars/event"
+	"mj0lk.be/netwars/guid"
 	"mj0lk.be/netwars/player"
 	"mj0lk.be/netwars/program"
 )
 
-const (
-	MAXCH  float64 = 80.0
-	MINCH  float64 = 40.0
-	MAXVCH float64 = 90.0
-	MINVCH float64 = 50.0
-)
-
 func Spy(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent, error) {
 	c.Infof("running spy attack <<<\n")
 	ln := len(cfg.ActivePrograms)
@@ -30,6 +26,9 @@ func Spy(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent, err
 	if err != nil {
 		return AttackEvent{}, err
 	}
+	if err := cooldown(c, attackerKey, cfg.Target, cfg.AttackType); err != nil {
+		return AttackEvent{}, err
+	}
 	var response AttackEvent
 	options := new(datastore.TransactionOptions)
 	options.XG = true
@@ -47,9 +46,12 @@ func Spy(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent, err
 			return err
 		}
 		<-playerStCh
+		if err := isValidAttack(attacker, defender); err != nil {
+			return err
+		}
 		attackEvent := NewAttackEvent(cfg.AttackType, event.OUT, attacker, defender)
-		attackEvent.Memory = 2
-		if attacker.ActiveMemory < 2 {
+		attackEvent.Memory = attackMemory(cfg.AttackType, attacker, defender)
+		if attacker.ActiveMemory < attackEvent.Memory {
 			return errors.New("Not enough active memory")
 		}
 		attackProgram := &AttackEventProgram{nil, new(event.EventProgram)}
@@ -71,12 +73,15 @@ func Spy(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent, err
 				attackProgram.Owned = true
 			}
 		}
-		result, err := renderProb(attackProgram, defender)
+		result, err := renderProb(attackProgram, defender, config.Get().Attack.Intelligence)
 		if err != nil {
 			return err
 		}
 		c.Debugf("result : %+v \n", result)
 		attackEvent.Result = result.Success
+		//counter-intelligence also catches spies that got through unseen
+		counter := counterIntelligence(defender, attackProgram.PlayerProgram.Type)
+		caught := attackEvent.Result && counter > 0 && rand.Float64()*100 < counter
 		var offTotal float64
 		var yieldTotal float64
 		if attackEvent.Result { // build spy report
@@ -173,6 +178,28 @@ func Spy(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent, err
 				}
 			}
 		}
+		var deception *Deception
+		if caught {
+			deception = new(Deception)
+			if err := datastore.Get(c, deceptionKey(c, defenderKey), deception); err == datastore.ErrNoSuchEntity {
+				deception = nil
+			} else if err != nil {
+				return err
+			} else {
+				//the spy can't tell the false report from a real one
+				attackEvent.EventPrograms = append([]event.EventProgram{}, deception.Report...)
+			}
+		}
+		if attackEvent.Result {
+			reportName, err := guid.GenUUID()
+			if err != nil {
+				return err
+			}
+			report := newReport(attacker, defender, attackProgram.Name, attackEvent.EventPrograms)
+			if _, err := datastore.Put(c, datastore.NewKey(c, "SpyReport", reportName, 0, attackerKey), report); err != nil {
+				return err
+			}
+		}
 		attacker.Memory -= attackEvent.Memory
 		attacker.ActiveMemory -= attackEvent.Memory
 		c.Debugf("attackEvent &+v \n", attackEvent.Event.EventPrograms)
@@ -191,7 +218,7 @@ func Spy(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent, err
 			}
 		}
 		evs := []*event.Event{attackEvent.Event}
-		if result.Visual || result.Killed || !result.Success {
+		if result.Visual || result.Killed || !result.Success || caught {
 			defenseEvent := NewAttackEvent(cfg.AttackType, event.IN, defender, attacker)
 			var defPr event.EventProgram
 			defPr = *attackProgram.EventProgram
@@ -199,6 +226,14 @@ func Spy(c appengine.Context, playerStr string, cfg AttackCfg) (AttackEvent, err
 			defenseEvent.EventPrograms = append(defenseEvent.EventPrograms, defPr)
 			evs = append(evs, defenseEvent.Event)
 		}
+		if deception != nil {
+			deceptionEvent := NewAttackEvent(cfg.AttackType, event.IN, defender, attacker)
+			deceptionEvent.EventType = "Counterintelligence"
+			deceptionEvent.Action = "Deception"
+			deceptionEvent.Result = true
+			deceptionEvent.EventPrograms = deception.Report
+			evs = append(evs, deceptionEvent.Event)
+		}
 		if err := event.Send(c, evs, event.Func); err != nil {
 			return err
 		}
@@ -0,0 +1,517 @@
+package attack
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/taskqueue"
+	"encoding/json"
+	"errors"
+	"mj0lk.be/netwars/clan"
+	"mj0lk.be/netwars/event"
+	"mj0lk.be/netwars/guid"
+	"mj0lk.be/netwars/player"
+	"time"
+)
+
+const (
+	STRIKEMIN = 5 * time.Minute
+	STRIKEMAX = time.Hour
+	//cross group transactions span at most 5 entity groups, the defender is one of them.
+	//pacts and wars are read before the battle transaction
+	MAXSTRIKERS = 4
+)
+
+var (
+	StrikeTypeError   = errors.New("Strikes are Balanced, Memory or Bandwidth attacks")
+	StrikeWindowError = errors.New("Strike window must be between 5 and 60 minutes")
+	StrikeClosedError = errors.New("Strike window closed")
+	StrikeFullError   = errors.New("Strike has the maximum number of participants")
+	StrikeRankError   = errors.New("Need to be Clan lieutenant or leader to open a strike")
+)
+
+var resolveStrikeFunc = delay.Func("resolveStrike", resolveStrike)
+
+type StrikeCfg struct {
+	AttackType int64 `json:"attack_type"`
+	Target     int64 `json:"target"`
+	Window     int64 `json:"window"` //seconds members can commit programs
+}
+
+type StrikeOrder struct {
+	StrikeKey      string          `json:"strike_key"`
+	ActivePrograms []ActiveProgram `json:"attack_programs"`
+}
+
+type Commitment struct {
+	PlayerID       int64           `json:"player_id"`
+	Nick           string          `json:"nick"`
+	ActivePrograms []ActiveProgram `json:"attack_programs"`
+	Committed      time.Time       `json:"committed"`
+}
+
+//outcome for one participant, gains are its share of the strike gains
+type StrikeResult struct {
+	PlayerID     int64   `json:"player_id"`
+	Nick         string  `json:"nick"`
+	Share        float64 `json:"share"` //part of the damage dealt by the strike
+	Result       bool    `json:"result"`
+	BwLost       float64 `json:"bw_lost"`
+	BwKilled     float64 `json:"bw_killed"`
+	CyclesGained int64   `json:"cycles_gained"`
+	CpsGained    int64   `json:"cps_gained"`
+	ApsGained    int64   `json:"aps_gained"`
+	Error        string  `json:"error,omitempty"` //reason the participant was left out
+}
+
+//parent clan, keyname: guid
+type Strike struct {
+	EncodedKey  string         `datastore:"-" json:"strike_key"`
+	AttackType  int64          `json:"attack_type"`
+	Target      int64          `json:"target"`
+	TargetName  string         `datastore:",noindex" json:"target_name"`
+	LeaderID    int64          `json:"leader_id"`
+	LeaderName  string         `datastore:",noindex" json:"leader_name"`
+	Opened      time.Time      `json:"opened"`
+	Closes      time.Time      `json:"closes"`
+	Resolved    bool           `json:"resolved"`
+	Result      bool           `json:"result"`
+	Commitments []Commitment   `datastore:"-" json:"commitments"`
+	Results     []StrikeResult `datastore:"-" json:"results"`
+	Data        []byte         `datastore:",noindex" json:"-"`
+}
+
+type strikeData struct {
+	Commitments []Commitment
+	Results     []StrikeResult
+}
+
+func (s *Strike) Load(c <-chan datastore.Property) error {
+	if err := datastore.LoadStruct(s, c); err != nil {
+		return err
+	}
+	data := strikeData{}
+	if err := json.Unmarshal(s.Data, &data); err != nil {
+		return err
+	}
+	s.Commitments, s.Results = data.Commitments, data.Results
+	return nil
+}
+
+func (s *Strike) Save(c chan<- datastore.Property) error {
+	data, err := json.Marshal(strikeData{s.Commitments, s.Results})
+	if err != nil {
+		return err
+	}
+	s.Data = data
+	return datastore.SaveStruct(s, c)
+}
+
+//participant during resolution
+type striker struct {
+	key        *datastore.Key
+	player     *player.Player
+	commitment Commitment
+	memory     int64
+	damage     float64
+}
+
+//lieutenant or leader opens a strike, resolved when the window closes
+func OpenStrike(c appengine.Context, playerStr string, cfg StrikeCfg) (Strike, error) {
+	switch cfg.AttackType {
+	case BAL, MEM, BW:
+	default:
+		return Strike{}, StrikeTypeError
+	}
+	window := time.Duration(cfg.Window) * time.Second
+	if window < STRIKEMIN || window > STRIKEMAX {
+		return Strike{}, StrikeWindowError
+	}
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return Strike{}, err
+	}
+	leader := new(player.Player)
+	if err := datastore.Get(c, playerKey, leader); err != nil {
+		return Strike{}, err
+	}
+	if leader.ClanKey == nil {
+		return Strike{}, clan.ClanMemberError
+	}
+	if leader.MemberType < player.LIEUTENANT {
+		return Strike{}, StrikeRankError
+	}
+	defenderKey, err := player.KeyByID(c, cfg.Target)
+	if err != nil {
+		return Strike{}, err
+	}
+	defender := new(player.Player)
+	if err := datastore.Get(c, defenderKey, defender); err != nil {
+		return Strike{}, err
+	}
+	if leader.ClanKey.Equal(defender.ClanKey) {
+		return Strike{}, errors.New("Can't attack your own team members")
+	}
+	keyName, err := guid.GenUUID()
+	if err != nil {
+		return Strike{}, err
+	}
+	key := datastore.NewKey(c, "Strike", keyName, 0, leader.ClanKey)
+	now := time.Now()
+	strike := Strike{
+		EncodedKey:  key.Encode(),
+		AttackType:  cfg.AttackType,
+		Target:      cfg.Target,
+		TargetName:  defender.NickName(),
+		LeaderID:    leader.ID,
+		LeaderName:  leader.Nick,
+		Opened:      now,
+		Closes:      now.Add(window),
+		Commitments: make([]Commitment, 0),
+		Results:     make([]StrikeResult, 0),
+	}
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if _, err := datastore.Put(c, key, &strike); err != nil {
+			return err
+		}
+		t, err := resolveStrikeFunc.Task(key.Encode())
+		if err != nil {
+			return err
+		}
+		t.ETA = strike.Closes
+		if _, err := taskqueue.Add(c, t, ""); err != nil {
+			return err
+		}
+		e := &event.Event{
+			Created:    now,
+			Expires:    strike.Closes,
+			Player:     playerKey,
+			PlayerName: leader.Nick,
+			PlayerID:   leader.ID,
+			Clan:       leader.ClanKey,
+			EventType:  "Strike",
+			Action:     "Open",
+			Direction:  event.OUT,
+			Target:     defenderKey,
+			TargetName: strike.TargetName,
+			TargetID:   defender.ID,
+		}
+		return event.Send(c, []*event.Event{e}, event.Func)
+	}, options)
+	if err != nil {
+		return Strike{}, err
+	}
+	return strike, nil
+}
+
+//clan members commit programs, a new commitment replaces the previous one
+func Commit(c appengine.Context, playerStr string, order StrikeOrder) error {
+	if len(order.ActivePrograms) == 0 {
+		return errors.New("Invalid input")
+	}
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return err
+	}
+	key, err := datastore.DecodeKey(order.StrikeKey)
+	if err != nil {
+		return err
+	}
+	member := new(player.Player)
+	if err := datastore.Get(c, playerKey, member); err != nil {
+		return err
+	}
+	if member.ClanKey == nil || !member.ClanKey.Equal(key.Parent()) {
+		return clan.ClanMemberError
+	}
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		strike := new(Strike)
+		if err := datastore.Get(c, key, strike); err != nil {
+			return err
+		}
+		if strike.Resolved || !strike.Closes.After(time.Now()) {
+			return StrikeClosedError
+		}
+		commitment := Commitment{member.ID, member.Nick, order.ActivePrograms, time.Now()}
+		replaced := false
+		for i := range strike.Commitments {
+			if strike.Commitments[i].PlayerID == member.ID {
+				strike.Commitments[i] = commitment
+				replaced = true
+			}
+		}
+		if !replaced {
+			if len(strike.Commitments) >= MAXSTRIKERS {
+				return StrikeFullError
+			}
+			strike.Commitments = append(strike.Commitments, commitment)
+		}
+		_, err := datastore.Put(c, key, strike)
+		return err
+	}, nil)
+}
+
+//latest strikes of the player's clan
+func Strikes(c appengine.Context, playerStr string) ([]Strike, error) {
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return nil, err
+	}
+	member := new(player.Player)
+	if err := datastore.Get(c, playerKey, member); err != nil {
+		return nil, err
+	}
+	if member.ClanKey == nil {
+		return nil, clan.ClanMemberError
+	}
+	strikes := make([]Strike, 0)
+	keys, err := datastore.NewQuery("Strike").Ancestor(member.ClanKey).Order("-Opened").Limit(20).
+		GetAll(c, &strikes)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		strikes[i].EncodedKey = key.Encode()
+	}
+	return strikes, nil
+}
+
+//task when the window closes, claims the strike so a retry can't resolve it twice
+func resolveStrike(c appengine.Context, strikeStr string) error {
+	key, err := datastore.DecodeKey(strikeStr)
+	if err != nil {
+		return err
+	}
+	strike := new(Strike)
+	claimed := false
+	if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Get(c, key, strike); err != nil {
+			return err
+		}
+		if strike.Resolved {
+			return nil
+		}
+		strike.Resolved = true
+		claimed = true
+		_, err := datastore.Put(c, key, strike)
+		return err
+	}, nil); err != nil || !claimed {
+		return err
+	}
+	results, won, err := strikeBattle(c, key.Parent(), strike)
+	if err != nil {
+		c.Errorf("strike %s failed: %s", strikeStr, err)
+		results = make([]StrikeResult, 0, len(strike.Commitments))
+		for _, cm := range strike.Commitments {
+			results = append(results, StrikeResult{PlayerID: cm.PlayerID, Nick: cm.Nick, Error: err.Error()})
+		}
+	}
+	strike.Results, strike.Result = results, won
+	_, err = datastore.Put(c, key, strike)
+	return err
+}
+
+//participants that can't attack (anymore) are left out with the reason in their result
+func (s *striker) validate(clanKey *datastore.Key, defender *player.Player) error {
+	if s.player.ClanKey == nil || !s.player.ClanKey.Equal(clanKey) {
+		return clan.ClanMemberError
+	}
+	if err := isValidAttack(s.player, defender); err != nil {
+		return err
+	}
+	s.memory = 3
+	if s.player.BandwidthUsage < defender.BandwidthUsage {
+		s.memory = 2
+	}
+	if s.player.ActiveMemory < s.memory {
+		return errors.New("Not enough active memory")
+	}
+	//dry run, a bad commitment must not leave programs in the shared battle
+	cfg := AttackCfg{0, defender.ID, s.commitment.ActivePrograms}
+	scratch := &AttackWindow{BattleMap: make(map[int64]*AttackFrame)}
+	return engage(cfg, s.player, defender, scratch, &AttackWindow{BattleMap: make(map[int64]*AttackFrame)})
+}
+
+func ownedBy(key *datastore.Key, eprog *AttackEventProgram) bool {
+	return eprog.PlayerProgram.DbKey.Parent().Equal(key)
+}
+
+//all committed forces in one battle, damage is shared and gains split by damage dealt
+func strikeBattle(c appengine.Context, clanKey *datastore.Key, strike *Strike) ([]StrikeResult, bool, error) {
+	if len(strike.Commitments) == 0 {
+		return make([]StrikeResult, 0), false, nil
+	}
+	defenderKey, err := player.KeyByID(c, strike.Target)
+	if err != nil {
+		return nil, false, err
+	}
+	strikers := make([]*striker, 0, len(strike.Commitments))
+	for _, cm := range strike.Commitments {
+		key, err := player.KeyByID(c, cm.PlayerID)
+		if err != nil {
+			return nil, false, err
+		}
+		strikers = append(strikers, &striker{key: key, commitment: cm})
+	}
+	target := new(player.Player)
+	if err := datastore.Get(c, defenderKey, target); err != nil {
+		return nil, false, err
+	}
+	var war int
+	if target.ClanKey != nil {
+		if target.ClanKey.Equal(clanKey) {
+			return nil, false, errors.New("Can't attack your own team members")
+		}
+		bound, err := clan.Bound(c, clanKey, target.ClanKey)
+		if err != nil {
+			return nil, false, err
+		}
+		if bound {
+			return nil, false, clan.PactError
+		}
+		warCh := make(chan int, 1)
+		loadWar(c, warCh, &AttackEvent{Event: &event.Event{Clan: clanKey}},
+			&AttackEvent{Event: &event.Event{Clan: target.ClanKey}})
+		war = <-warCh
+	}
+	var results []StrikeResult
+	var won bool
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		results = make([]StrikeResult, 0, len(strikers))
+		defender := new(player.Player)
+		if err := player.Status(c, defenderKey.Encode(), defender); err != nil {
+			return err
+		}
+		active := make([]*striker, 0, len(strikers))
+		for _, s := range strikers {
+			s.player = new(player.Player)
+			s.damage = 0
+			if err := player.Status(c, s.key.Encode(), s.player); err != nil {
+				return err
+			}
+			if err := s.validate(clanKey, defender); err != nil {
+				results = append(results, StrikeResult{PlayerID: s.player.ID, Nick: s.player.Nick, Error: err.Error()})
+				continue
+			}
+			active = append(active, s)
+		}
+		if len(active) == 0 {
+			return nil
+		}
+		//pact and war were checked for this clan
+		if (defender.ClanKey == nil) != (target.ClanKey == nil) ||
+			(defender.ClanKey != nil && !defender.ClanKey.Equal(target.ClanKey)) {
+			return errors.New("Target changed clan during the strike")
+		}
+		attackEvent := NewAttackEvent(strike.AttackType, event.OUT, active[0].player, defender)
+		defenseEvent := NewAttackEvent(strike.AttackType, event.IN, defender, active[0].player)
+		defenseEvent.Action = "Strike"
+		attack := &AttackWindow{
+			AttackEvent:  attackEvent,
+			DefenseEvent: defenseEvent,
+			BattleMap:    make(map[int64]*AttackFrame),
+			Shared:       true,
+		}
+		defense := &AttackWindow{
+			AttackEvent:  defenseEvent,
+			DefenseEvent: attackEvent,
+			BattleMap:    make(map[int64]*AttackFrame),
+			Shared:       true,
+		}
+		for _, s := range active {
+			cfg := AttackCfg{strike.AttackType, defender.ID, s.commitment.ActivePrograms}
+			if err := engage(cfg, s.player, defender, attack, defense); err != nil {
+				return err
+			}
+		}
+		var totalDamage float64
+		for _, dealer := range attack.Dealers {
+			damage := dealer.AttackDamage()
+			totalDamage += damage
+			for _, s := range active {
+				if ownedBy(s.key, dealer) {
+					s.damage += damage
+				}
+			}
+		}
+		defense.Render()
+		attack.Render()
+		result := battleOutcome(attackEvent, defenseEvent, defender, war)
+		won = result.won
+		defenseEvent.Result = !won
+		cycles, cps, aps := result.cycles, result.cps, result.aps
+		if won {
+			defenseEvent.Cycles = cycles
+			defender.Cycles -= cycles
+			defender.LastAttacked = time.Now()
+		} else {
+			defenseEvent.ApsGained = 1
+			defender.Aps += 1
+		}
+		defenseEvent.NewBandwidthUsage = defender.BandwidthUsage - defenseEvent.BwLost
+		keys := []*datastore.Key{defenderKey}
+		models := []interface{}{defender}
+		evs := []*event.Event{defenseEvent.Event}
+		var top *striker
+		for _, s := range active {
+			share := 1.0 / float64(len(active))
+			if totalDamage > 0 {
+				share = s.damage / totalDamage
+			}
+			if top == nil || s.damage > top.damage {
+				top = s
+			}
+			ev := NewAttackEvent(strike.AttackType, event.OUT, s.player, defender)
+			ev.Action = "Strike"
+			ev.Result = won
+			ev.Memory = s.memory
+			for _, eprog := range defense.Updated {
+				if ownedBy(s.key, eprog) && eprog.Amount > 0 {
+					ev.BwLost += eprog.BwLost
+					ev.ProgramsLost += eprog.Amount
+					ev.EventPrograms = append(ev.EventPrograms, *eprog.EventProgram)
+				}
+			}
+			//the defender's losses, the combined event also holds the other strikers' losses
+			for _, ep := range attackEvent.EventPrograms {
+				if !ep.Owned {
+					ev.EventPrograms = append(ev.EventPrograms, ep)
+				}
+			}
+			ev.BwKilled = attackEvent.BwKilled * share
+			ev.ProgramsKilled = int64(float64(attackEvent.ProgramsKilled) * share)
+			if won {
+				ev.CyclesGained = int64(float64(cycles) * share)
+				ev.CpsGained = int64(float64(cps) * share)
+				ev.ApsGained = aps
+			}
+			s.player.Cycles += ev.CyclesGained
+			s.player.Cps += ev.CpsGained
+			s.player.Aps += ev.ApsGained
+			s.player.Memory -= s.memory
+			s.player.ActiveMemory -= s.memory
+			ev.NewBandwidthUsage = s.player.BandwidthUsage - ev.BwLost
+			keys = append(keys, s.key)
+			models = append(models, s.player)
+			evs = append(evs, ev.Event)
+			results = append(results, StrikeResult{s.player.ID, s.player.Nick, share, won, ev.BwLost, ev.BwKilled,
+				ev.CyclesGained, ev.CpsGained, ev.ApsGained, ""})
+		}
+		if won && defender.Killed(defenseEvent.BwLost) {
+			evs = append(evs, defender.Kill(top.player))
+		}
+		keys, models = updates(keys, models, attack, defense)
+		if _, err := datastore.PutMulti(c, keys, models); err != nil {
+			return err
+		}
+		return event.Send(c, evs, event.Func)
+	}, options)
+	if err != nil {
+		return nil, false, err
+	}
+	return results, won, nil
+}
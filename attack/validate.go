@@ -0,0 +1,169 @@
+package attack
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+	"mj0lk.be/netwars/clan"
+	"mj0lk.be/netwars/config"
+	"mj0lk.be/netwars/event"
+	"mj0lk.be/netwars/player"
+	"time"
+)
+
+//rule violations, code is returned to the client
+type AttackError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e AttackError) Error() string {
+	return e.Message
+}
+
+var (
+	AttackerInactiveError = AttackError{"attacker_inactive", "Your account can't attack in its current status"}
+	TargetDeadError       = AttackError{"target_dead", "Target is dead"}
+	TargetSuspendedError  = AttackError{"target_suspended", "Target is suspended"}
+	NewbieProtectedError  = AttackError{"newbie_protected", "Target is under new account protection"}
+	HitProtectedError     = AttackError{"hit_protected", "Target was attacked recently and is protected"}
+	OutOfRangeError       = AttackError{"out_of_range", "Target is out of your bandwidth range"}
+	CooldownError         = AttackError{"cooldown", "You attacked this target too recently"}
+)
+
+//status, protection and range rules, called with both players loaded
+func isValidAttack(attacker, defender *player.Player) error {
+	balance := config.Get().Attack
+	if attacker.Status == player.DEAD || attacker.Status == player.SUSPENDED {
+		return AttackerInactiveError
+	}
+	switch defender.Status {
+	case player.DEAD:
+		return TargetDeadError
+	case player.SUSPENDED:
+		return TargetSuspendedError
+	}
+	now := time.Now()
+	if now.Before(defender.Created.Add(time.Duration(balance.NewbieProtection) * time.Hour)) {
+		return NewbieProtectedError
+	}
+	if now.Before(defender.LastAttacked.Add(time.Duration(balance.HitProtection) * time.Minute)) {
+		return HitProtectedError
+	}
+	lo, hi := attacker.Range()
+	if defender.BandwidthUsage < lo || defender.BandwidthUsage > hi {
+		return OutOfRangeError
+	}
+	return nil
+}
+
+//active memory the attack takes, a balanced attack on a bigger defender takes less
+func attackMemory(attackType int64, attacker, defender *player.Player) int64 {
+	switch attackType {
+	case ICE:
+		return 4
+	case INT:
+		return 2
+	}
+	if attacker.BandwidthUsage < defender.BandwidthUsage {
+		return 2
+	}
+	return 3
+}
+
+//clanmates and clans with a pact can't attack each other
+func checkClans(c appengine.Context, attacker, defender *player.Player) error {
+	if attacker.ClanKey == nil || defender.ClanKey == nil {
+		return nil
+	}
+	if attacker.ClanKey.Equal(defender.ClanKey) {
+		return errors.New("Can't attack your own team members")
+	}
+	bound, err := clan.Bound(c, attacker.ClanKey, defender.ClanKey)
+	if err != nil {
+		return err
+	}
+	if bound {
+		return clan.PactError
+	}
+	return nil
+}
+
+//the attack programs are owned, powered and there are enough of them
+func checkPrograms(cfg AttackCfg, attacker *player.Player) error {
+	types := OffensiveTypes
+	if cfg.AttackType == ICE || cfg.AttackType == INT {
+		types = []int64{cfg.AttackType}
+	}
+	for _, activeProg := range cfg.ActivePrograms {
+		programKey, err := datastore.DecodeKey(activeProg.Key)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, tpe := range types {
+			group, ok := attacker.Programs[tpe]
+			if !ok {
+				continue
+			}
+			for _, pp := range group.Programs {
+				//borrowed programs only defend
+				if !pp.ProgramKey.Equal(programKey) || pp.Lender != nil {
+					continue
+				}
+				if !group.Power {
+					return errors.New("Can't use attack program without power")
+				}
+				if activeProg.Amount > pp.Amount {
+					return errors.New("Not enough programs for attack")
+				}
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("Not enough programs for attack")
+		}
+	}
+	return nil
+}
+
+//the rules the attack checks before its battle, both players loaded with player.Status
+func checkAttack(c appengine.Context, cfg AttackCfg, attacker, defender *player.Player) error {
+	if err := isValidAttack(attacker, defender); err != nil {
+		return err
+	}
+	if attacker.ActiveMemory < attackMemory(cfg.AttackType, attacker, defender) {
+		return errors.New("Not enough active memory")
+	}
+	//spying doesn't care about clans
+	if cfg.AttackType != INT {
+		if err := checkClans(c, attacker, defender); err != nil {
+			return err
+		}
+	}
+	return checkPrograms(cfg, attacker)
+}
+
+//queries can't run in the attack transaction, checked before it
+func cooldown(c appengine.Context, attackerKey *datastore.Key, targetID, attackType int64) error {
+	minutes := config.Get().Attack.Cooldown
+	if minutes == 0 {
+		return nil
+	}
+	since := time.Now().Add(-time.Duration(minutes) * time.Minute)
+	count, err := datastore.NewQuery("Event").
+		Filter("Player =", attackerKey).
+		Filter("TargetID =", targetID).
+		Filter("Direction =", event.OUT).
+		Filter("EventType =", "Attack").
+		Filter("Action =", AttackName[attackType]).
+		Filter("Created >", since).
+		Count(c)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return CooldownError
+	}
+	return nil
+}
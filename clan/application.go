@@ -0,0 +1,241 @@
+package clan
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+	"fmt"
+	"mj0lk.be/netwars/config"
+	"mj0lk.be/netwars/event"
+	"mj0lk.be/netwars/player"
+	"strconv"
+	"time"
+)
+
+const MAXAPPLICATIONS = 3
+
+var AlreadyAppliedError = errors.New("Already applied to this clan")
+
+//player asking to join a clan, same key scheme as invites
+type Application struct {
+	Player     *datastore.Key `json:"-"`
+	PlayerName string         `json:"player_name"`
+	PlayerID   int64          `json:"player_id"`
+	Clan       *datastore.Key `json:"-"`
+	ClanName   string         `json:"clan_name"`
+	Message    string         `datastore:",noindex" json:"message"`
+	Applied    time.Time      `json:"applied_on"`
+	Expires    time.Time      `json:"expires"`
+	DbKey      *datastore.Key `datastore:"-" json:"-"`
+	EncodedKey string         `datastore:"-" json:"key"`
+}
+
+type ApplicationMessage struct {
+	Content string `json:"content"`
+}
+
+func applyBarrier(c appengine.Context, playerKey *datastore.Key) error {
+	q := datastore.NewQuery("Application").Filter("Expires >", time.Now()).
+		Filter("Player =", playerKey)
+	count, err := q.Count(c)
+	if err != nil {
+		return err
+	}
+	if count >= MAXAPPLICATIONS {
+		return errors.New("Too many applications")
+	}
+	return nil
+}
+
+func Apply(c appengine.Context, playerStr, clanIdStr, message string) error {
+	clanId, err := strconv.ParseInt(clanIdStr, 10, 64)
+	if err != nil {
+		return err
+	}
+	iplayer := new(player.Player)
+	playerKey, err := player.Get(c, playerStr, iplayer)
+	if err != nil {
+		return err
+	}
+	if iplayer.ClanKey != nil {
+		return errors.New("Already member of a clan")
+	}
+	interv, wait, err := leaveInterval(c, playerKey)
+	if err != nil {
+		return err
+	}
+	if interv {
+		return errors.New(fmt.Sprintf("Wait %s before joining a new clan", wait))
+	}
+	if err := applyBarrier(c, playerKey); err != nil {
+		return err
+	}
+	clanKey, err := KeyByID(c, clanId)
+	if err != nil {
+		return err
+	}
+	team := new(Clan)
+	if err := Get(c, clanKey, team); err != nil {
+		return err
+	}
+	if team.AmountPlayers >= config.Get().Clan.MaxMember {
+		return errors.New("Already full clan")
+	}
+	applicationKey := datastore.NewKey(c, "Application", fmt.Sprintf("%d%d", team.ID, iplayer.ID), 0, nil)
+	application := new(Application)
+	if err := datastore.Get(c, applicationKey, application); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	} else if err == nil && application.Expires.After(time.Now()) {
+		return AlreadyAppliedError
+	}
+	now := time.Now()
+	application = &Application{
+		Player:     playerKey,
+		PlayerName: iplayer.Nick,
+		PlayerID:   iplayer.ID,
+		Clan:       clanKey,
+		ClanName:   team.Name,
+		Message:    message,
+		Applied:    now,
+		Expires:    now.AddDate(0, 0, 2),
+	}
+	if _, err := datastore.Put(c, applicationKey, application); err != nil {
+		return err
+	}
+	e := &event.Event{
+		Created:    now,
+		Player:     playerKey,
+		Direction:  event.OUT,
+		EventType:  "Clan",
+		Expires:    application.Expires,
+		Target:     clanKey,
+		TargetName: team.Name,
+		TargetID:   team.ID,
+		Action:     "Apply",
+		PlayerName: iplayer.Nick,
+		PlayerID:   iplayer.ID,
+		ClanName:   team.Name,
+		ClanID:     team.ID,
+	}
+	//notifies clan trackers
+	e1 := &event.Event{
+		Created:    now,
+		Direction:  event.IN,
+		EventType:  "Clan",
+		Clan:       clanKey,
+		ClanName:   team.Name,
+		ClanID:     team.ID,
+		Expires:    application.Expires,
+		Target:     playerKey,
+		TargetName: iplayer.Nick,
+		TargetID:   iplayer.ID,
+		Action:     "Apply",
+	}
+	if err := event.Send(c, []*event.Event{e, e1}, event.Func); err != nil {
+		return err
+	}
+	return nil
+}
+
+func ApplicationsForClan(c appengine.Context, playerStr string) ([]Application, error) {
+	iplayer := new(player.Player)
+	if _, err := player.Get(c, playerStr, iplayer); err != nil {
+		return nil, err
+	}
+	if iplayer.ClanKey == nil {
+		return nil, ClanMemberError
+	}
+	if iplayer.MemberType < player.LIEUTENANT {
+		return nil, ClanMemberTypeError
+	}
+	applications := make([]Application, 0)
+	q := datastore.NewQuery("Application").Filter("Clan =", iplayer.ClanKey).Filter("Expires >", time.Now())
+	for it := q.Run(c); ; {
+		var application Application
+		key, err := it.Next(&application)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		application.DbKey = key
+		application.EncodedKey = key.Encode()
+		applications = append(applications, application)
+	}
+	return applications, nil
+}
+
+//loads application and checks the player is allowed to handle it
+func clanApplication(c appengine.Context, playerStr, applicationStr string) (*player.Player, *datastore.Key,
+	*Application, error) {
+	applicationKey, err := datastore.DecodeKey(applicationStr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	iplayer := new(player.Player)
+	playerKey, err := player.Get(c, playerStr, iplayer)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	iplayer.DbKey = playerKey
+	if iplayer.ClanKey == nil {
+		return nil, nil, nil, ClanMemberError
+	}
+	if iplayer.MemberType < player.LIEUTENANT {
+		return nil, nil, nil, ClanMemberTypeError
+	}
+	application := new(Application)
+	if err := datastore.Get(c, applicationKey, application); err != nil {
+		return nil, nil, nil, err
+	}
+	if !iplayer.ClanKey.Equal(application.Clan) {
+		return nil, nil, nil, errors.New("Illegal operation")
+	}
+	return iplayer, applicationKey, application, nil
+}
+
+func Approve(c appengine.Context, playerStr, applicationStr string) error {
+	_, applicationKey, application, err := clanApplication(c, playerStr, applicationStr)
+	if err != nil {
+		return err
+	}
+	if application.Expires.Before(time.Now()) {
+		return errors.New("Application expired")
+	}
+	interv, wait, err := leaveInterval(c, application.Player)
+	if err != nil {
+		return err
+	}
+	if interv {
+		return errors.New(fmt.Sprintf("Player has to wait %s before joining a new clan", wait))
+	}
+	return join(c, application.Player, application.Clan, applicationKey)
+}
+
+func Reject(c appengine.Context, playerStr, applicationStr string) error {
+	iplayer, applicationKey, application, err := clanApplication(c, playerStr, applicationStr)
+	if err != nil {
+		return err
+	}
+	if err := datastore.Delete(c, applicationKey); err != nil {
+		return err
+	}
+	e := &event.Event{
+		Created:    time.Now(),
+		Player:     application.Player,
+		PlayerName: application.PlayerName,
+		PlayerID:   application.PlayerID,
+		Direction:  event.IN,
+		EventType:  "Clan",
+		Target:     iplayer.DbKey,
+		TargetName: iplayer.Nick,
+		TargetID:   iplayer.ID,
+		ClanName:   application.ClanName,
+		Action:     "Reject",
+	}
+	if err := event.Send(c, []*event.Event{e}, event.Func); err != nil {
+		return err
+	}
+	return nil
+}
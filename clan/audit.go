@@ -0,0 +1,109 @@
+package clan
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"mj0lk.be/netwars/player"
+	"time"
+)
+
+const AUDITLIMIT = 40
+
+var rankName = map[int64]string{
+	0:                 "None",
+	player.MEMBER:     "Member",
+	player.LIEUTENANT: "Lieutenant",
+	player.LEADER:     "Leader",
+}
+
+//parent clan, never updated or deleted
+type AuditEntry struct {
+	Action     string    `json:"action"`
+	PlayerID   int64     `json:"player_id"`
+	PlayerName string    `datastore:",noindex" json:"player_name"`
+	TargetID   int64     `json:"target_id"`
+	TargetName string    `datastore:",noindex" json:"target_name"`
+	Before     string    `datastore:",noindex" json:"before"`
+	After      string    `datastore:",noindex" json:"after"`
+	Created    time.Time `json:"created"`
+}
+
+type AuditList struct {
+	Cursor  string       `json:"cursor"`
+	Entries []AuditEntry `json:"entries"`
+}
+
+//target can be nil (clan wide changes)
+func newAuditEntry(action string, actor, target *player.Player) *AuditEntry {
+	entry := &AuditEntry{
+		Action:     action,
+		PlayerID:   actor.ID,
+		PlayerName: actor.Nick,
+		Created:    time.Now(),
+	}
+	if target != nil {
+		entry.TargetID = target.ID
+		entry.TargetName = target.Nick
+	}
+	return entry
+}
+
+//clan as target (wars, diplomacy)
+func (entry *AuditEntry) target(cl *Clan) *AuditEntry {
+	entry.TargetID = cl.ID
+	entry.TargetName = cl.Name
+	return entry
+}
+
+func (entry *AuditEntry) save(c appengine.Context, clanKey *datastore.Key) error {
+	if _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "AuditEntry", clanKey), entry); err != nil {
+		return err
+	}
+	return nil
+}
+
+//action and playerID are optional filters
+func Audit(c appengine.Context, playerStr, action string, playerID int64, cursor string) (AuditList, error) {
+	iplayer := new(player.Player)
+	if _, err := player.Get(c, playerStr, iplayer); err != nil {
+		return AuditList{}, err
+	}
+	if iplayer.ClanKey == nil {
+		return AuditList{}, ClanMemberError
+	}
+	if iplayer.MemberType < player.LIEUTENANT {
+		return AuditList{}, ClanMemberTypeError
+	}
+	q := datastore.NewQuery("AuditEntry").Ancestor(iplayer.ClanKey).Order("-Created").Limit(AUDITLIMIT)
+	if len(action) > 0 {
+		q = q.Filter("Action =", action)
+	}
+	if playerID > 0 {
+		q = q.Filter("PlayerID =", playerID)
+	}
+	if len(cursor) > 0 {
+		cur, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return AuditList{}, err
+		}
+		q = q.Start(cur)
+	}
+	entries := make([]AuditEntry, 0, AUDITLIMIT)
+	t := q.Run(c)
+	for {
+		var entry AuditEntry
+		_, err := t.Next(&entry)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return AuditList{}, err
+		}
+		entries = append(entries, entry)
+	}
+	newCur, err := t.Cursor()
+	if err != nil {
+		return AuditList{}, err
+	}
+	return AuditList{newCur.String(), entries}, nil
+}
@@ -4,6 +4,7 @@ import (
 	"appengine"
 	"appengine/blobstore"
 	"appengine/datastore"
+	"appengine/delay"
 	"appengine/image"
 	"bytes"
 	"encoding/gob"
@@ -11,35 +12,41 @@ import (
 	"fmt"
 	"math"
 	"mj0lk.be/netwars/cache"
+	"mj0lk.be/netwars/config"
 	"mj0lk.be/netwars/counter"
 	"mj0lk.be/netwars/event"
 	"mj0lk.be/netwars/guid"
 	"mj0lk.be/netwars/player"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
-//TODO implement delete clan
-
 const (
-	RANGEUP       = 0.3
-	RANGEDOWN     = 0.2
-	MAXMEMBER     = 6
-	MAXLEADERSHIP = 3
-	MAXINVITES    = 3
 	THUMBSIZE     = 32
 	CLANNAMEREGEX = `^([a-zA-Z0-9 ]){3,18}$`
 	CLANTAGREGEX  = `^([a-zA-Z0-9]){3,4}$`
 	LIMIT         = 100
 )
 
+//leaders inactive for longer hand over leadership
+const INACTIVELEADER = 14 * 24 * time.Hour
+
 var PlayerAlreadyInvitedError = errors.New("Player already invited \n")
 var ClanMemberTypeError = errors.New("Need to be Lieutenant or Leader to perform this action")
 var ClanMemberError = errors.New("Player not in a clan")
 
+var reviewLeadershipFunc = delay.Func("reviewLeadership", reviewLeadership)
+
 var clanNameRegex, _ = regexp.Compile(CLANNAMEREGEX)
 var clanTagRegex, _ = regexp.Compile(CLANTAGREGEX)
+var emailRegex, _ = regexp.Compile(player.EMAILREGEX)
+
+func init() {
+	player.RegisterInviteFunc(claimEmailInvite)
+	event.Handle(forwardWarAttack)
+}
 
 type SendKey struct {
 	Key string `json:"key"` //connection key
@@ -60,24 +67,29 @@ type Promotion struct {
 }
 
 type Clan struct {
-	Tag            string            `json:"clan_tag"`
-	Name           string            `json:"clan_name"`
-	ID             int64             `json:"clan_id"`
-	BandwidthUsage float64           `json:"bandwidth_usage"`
-	Cps            int64             `json: "clan_cps"`
-	AmountPlayers  int64             `datastore:",noindex" json:"amount_players"`
-	Created        time.Time         `datastore:",noindex" json:"created_on"`
-	Creator        *datastore.Key    `datastore:",noindex" json:"-"`
-	AvatarKey      appengine.BlobKey `datastore:",noindex" json:"-"`
-	Avatar         string            `datastore:",noindex" json:"avatar"`
-	AvatarThumb    string            `datastore:"-" json:"avatar_thumb"`
-	Members        []player.Player   `datastore:"-" json:"clan_members"`
-	Message        string            `datastore:",noindex" json:"message"`
-	Profile        string            `datastore:",noindex" json:"profile"`
-	Site           string            `datastore:",noindex" json:"clan_site"`
-	Description    string            `datastore:",noindex" json:"description"`
-	Wars           []ClanConnection  `datastore:"-" json:"wars"`
-	Connections    []byte            `json:"-"`
+	Tag            string                `json:"clan_tag"`
+	Name           string                `json:"clan_name"`
+	ID             int64                 `json:"clan_id"`
+	BandwidthUsage float64               `json:"bandwidth_usage"`
+	Cps            int64                 `json: "clan_cps"`
+	AmountPlayers  int64                 `datastore:",noindex" json:"amount_players"`
+	Created        time.Time             `datastore:",noindex" json:"created_on"`
+	Creator        *datastore.Key        `datastore:",noindex" json:"-"`
+	AvatarKey      appengine.BlobKey     `datastore:",noindex" json:"-"`
+	Avatar         string                `datastore:",noindex" json:"avatar"`
+	AvatarThumb    string                `datastore:"-" json:"avatar_thumb"`
+	Members        []player.Player       `datastore:"-" json:"clan_members"`
+	Message        string                `datastore:",noindex" json:"message"`
+	Profile        string                `datastore:",noindex" json:"profile"`
+	Site           string                `datastore:",noindex" json:"clan_site"`
+	Description    string                `datastore:",noindex" json:"description"`
+	Wars           []ClanConnection      `datastore:"-" json:"wars"`
+	Connections    []byte                `json:"-"`
+	Treasury       int64                 `datastore:",noindex" json:"treasury"`
+	Transactions   []TreasuryTransaction `datastore:"-" json:"treasury_log"`
+	Ledger         []byte                `json:"-"`
+	Pacts          []Pact                `datastore:"-" json:"pacts"`
+	Diplomacy      []byte                `json:"-"`
 }
 
 type ClanList struct {
@@ -127,6 +139,16 @@ func (cl *Clan) Load(c <-chan datastore.Property) error {
 			return err
 		}
 	}
+	if len(cl.Ledger) > 0 {
+		if err := gob.NewDecoder(bytes.NewBuffer(cl.Ledger)).Decode(&cl.Transactions); err != nil {
+			return err
+		}
+	}
+	if len(cl.Diplomacy) > 0 {
+		if err := gob.NewDecoder(bytes.NewBuffer(cl.Diplomacy)).Decode(&cl.Pacts); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -137,13 +159,32 @@ func (cl *Clan) Save(c chan<- datastore.Property) error {
 			return err
 		}
 		cl.Connections = wBytes.Bytes()
+	} else {
+		cl.Connections = nil
+	}
+	if len(cl.Transactions) > 0 {
+		var tBytes bytes.Buffer
+		if err := gob.NewEncoder(&tBytes).Encode(&cl.Transactions); err != nil {
+			return err
+		}
+		cl.Ledger = tBytes.Bytes()
+	}
+	if len(cl.Pacts) > 0 {
+		var pBytes bytes.Buffer
+		if err := gob.NewEncoder(&pBytes).Encode(&cl.Pacts); err != nil {
+			return err
+		}
+		cl.Diplomacy = pBytes.Bytes()
+	} else {
+		cl.Diplomacy = nil
 	}
 	return datastore.SaveStruct(cl, c)
 }
 
 func (c *Clan) Range() (float64, float64) {
-	lo := c.BandwidthUsage - (c.BandwidthUsage * RANGEDOWN)
-	hi := c.BandwidthUsage + (c.BandwidthUsage * RANGEUP)
+	balance := config.Get().Clan
+	lo := c.BandwidthUsage - (c.BandwidthUsage * balance.RangeDown)
+	hi := c.BandwidthUsage + (c.BandwidthUsage * balance.RangeUp)
 	return lo, hi
 }
 
@@ -165,6 +206,17 @@ func (c *Clan) RemoveConnection(target int64) {
 	}
 }
 
+//removes every connection with clan id, attacking or defending
+func (c *Clan) RemoveConnectionWith(id int64) {
+	wars := c.Wars[:0]
+	for _, conn := range c.Wars {
+		if conn.Source != id && conn.Target != id {
+			wars = append(wars, conn)
+		}
+	}
+	c.Wars = wars
+}
+
 func isNotInRange(a, d *Clan) bool {
 	lo, hi := a.Range()
 	if d.BandwidthUsage > hi || d.BandwidthUsage < lo {
@@ -258,6 +310,9 @@ func PublicStatus(c appengine.Context, pkeyStr, clanIdStr string, team *Clan) er
 	if err := Get(c, clanKey, team); err != nil {
 		return err
 	}
+	//treasury is for members only
+	team.Treasury = 0
+	team.Transactions = nil
 	return loadClanMembers(c, clanKey, team)
 }
 
@@ -362,11 +417,29 @@ func CancelInvite(c appengine.Context, playerStr, inviteStr string) error {
 	if err != nil {
 		return err
 	}
+	iplayer := new(player.Player)
+	playerKey, err := player.Get(c, playerStr, iplayer)
+	if err != nil {
+		return err
+	}
+	invite := new(Invite)
+	options := new(datastore.TransactionOptions)
+	options.XG = true
 	return datastore.RunInTransaction(c, func(c appengine.Context) error {
-		invite := new(Invite)
 		if err := datastore.Get(c, inviteKey, invite); err != nil {
 			return err
 		}
+		//the invitee declines, clan officers cancel
+		action := "DeclineInvite"
+		if !playerKey.Equal(invite.Player) {
+			if iplayer.ClanKey == nil || !iplayer.ClanKey.Equal(invite.Clan) {
+				return ClanMemberError
+			}
+			if iplayer.MemberType < player.LIEUTENANT {
+				return ClanMemberTypeError
+			}
+			action = "CancelInvite"
+		}
 		created := time.Now()
 		e1 := &event.Event{
 			Player:     invite.Player,
@@ -393,11 +466,16 @@ func CancelInvite(c appengine.Context, playerStr, inviteStr string) error {
 		if err := datastore.Delete(c, inviteKey); err != nil {
 			return err
 		}
+		entry := newAuditEntry(action, iplayer, nil)
+		entry.TargetName = invite.PlayerName
+		if err := entry.save(c, invite.Clan); err != nil {
+			return err
+		}
 		if err := event.Send(c, []*event.Event{e1, e2}, event.Func); err != nil {
 			return err
 		}
 		return nil
-	}, nil)
+	}, options)
 }
 
 func DisConnect(c appengine.Context, playerStr string, target int64) error {
@@ -416,6 +494,16 @@ func DisConnect(c appengine.Context, playerStr string, target int64) error {
 	if err != nil {
 		return err
 	}
+	aTeam := new(Clan)
+	dTeam := new(Clan)
+	if err := datastore.GetMulti(c, []*datastore.Key{iplayer.ClanKey, DclanKey},
+		[]interface{}{aTeam, dTeam}); err != nil {
+		return err
+	}
+	allies, err := allyKeys(c, aTeam, dTeam)
+	if err != nil {
+		return err
+	}
 	options := new(datastore.TransactionOptions)
 	options.XG = true
 	return datastore.RunInTransaction(c, func(c appengine.Context) error {
@@ -446,6 +534,9 @@ func DisConnect(c appengine.Context, playerStr string, target int64) error {
 				[]interface{}{Aclan, Dclan}); err != nil {
 				return err
 			}
+			if err := newAuditEntry("DisConnect", iplayer, nil).target(Dclan).save(c, iplayer.ClanKey); err != nil {
+				return err
+			}
 		}
 
 		e := &event.Event{
@@ -467,7 +558,10 @@ func DisConnect(c appengine.Context, playerStr string, target int64) error {
 			Target:    iplayer.ClanKey,
 			Action:    "DisConnect",
 		}
-		if err := event.Send(c, []*event.Event{e, e1}, event.Func); err != nil {
+		evs := []*event.Event{e, e1}
+		evs = append(evs, allyEvents(allies, Aclan, e)...)
+		evs = append(evs, allyEvents(allies, Dclan, e1)...)
+		if err := event.Send(c, evs, event.Func); err != nil {
 			return err
 		}
 		return nil
@@ -528,6 +622,13 @@ func Connect(c appengine.Context, playerStr string, target int64) error {
 	if isNotInRange(at, dt) {
 		return errors.New("Target Clan is not in range")
 	}
+	if pact, ok := at.PactWith(dt.ID); ok && pact.Binding() {
+		return PactError
+	}
+	allies, err := allyKeys(c, at, dt)
+	if err != nil {
+		return err
+	}
 	expires := time.Now().AddDate(0, 0, 1)
 	newConnection := ClanConnection{
 		Player:     iplayer.ID,
@@ -542,6 +643,9 @@ func Connect(c appengine.Context, playerStr string, target int64) error {
 	dt.Wars = append(dt.Wars, newConnection)
 	if _, err := datastore.PutMulti(c, []*datastore.Key{iplayer.ClanKey, defendingClanKey},
 		[]interface{}{at, dt}); err == nil {
+		if err := newAuditEntry("Connect", iplayer, nil).target(dt).save(c, iplayer.ClanKey); err != nil {
+			return err
+		}
 		created := time.Now()
 		e := &event.Event{
 			Created:    created,
@@ -572,7 +676,10 @@ func Connect(c appengine.Context, playerStr string, target int64) error {
 			Expires:    newConnection.Expires,
 			Action:     "Connect",
 		}
-		if err := event.Send(c, []*event.Event{e, e1}, event.Func); err != nil {
+		evs := []*event.Event{e, e1}
+		evs = append(evs, allyEvents(allies, at, e)...)
+		evs = append(evs, allyEvents(allies, dt, e1)...)
+		if err := event.Send(c, evs, event.Func); err != nil {
 			return err
 		}
 	}
@@ -627,12 +734,17 @@ func Join(c appengine.Context, playerStr, inviteStr string) error {
 	if invite.Expires.Before(time.Now()) {
 		return errors.New("Invite expired")
 	}
+	return join(c, playerKey, invite.Clan, nil)
+}
+
+//adds player to clan, remove: invite or application to clean up in the same transaction (can be nil)
+func join(c appengine.Context, playerKey, clanKey, remove *datastore.Key) error {
 	options := new(datastore.TransactionOptions)
 	options.XG = true
 	return datastore.RunInTransaction(c, func(c appengine.Context) error {
 		iplayer := new(player.Player)
 		team := new(Clan)
-		keys := []*datastore.Key{playerKey, invite.Clan}
+		keys := []*datastore.Key{playerKey, clanKey}
 		models := []interface{}{iplayer, team}
 		if err := datastore.GetMulti(c, keys, models); err != nil {
 			return err
@@ -640,26 +752,32 @@ func Join(c appengine.Context, playerStr, inviteStr string) error {
 		if iplayer.ClanKey != nil {
 			return errors.New("Already member of a clan")
 		}
-		if team.AmountPlayers > MAXMEMBER-1 {
+		if team.AmountPlayers > config.Get().Clan.MaxMember-1 {
 			return errors.New("Full Clan")
 		}
 		tracker := new(event.Tracker)
-		trackerKey := datastore.NewKey(c, "Tracker", playerKey.StringID(), 0, invite.Clan)
+		trackerKey := datastore.NewKey(c, "Tracker", playerKey.StringID(), 0, clanKey)
 		keys = append(keys, trackerKey)
 		models = append(models, tracker)
-		iplayer.ClanKey = invite.Clan
+		iplayer.ClanKey = clanKey
 		iplayer.ClanTag = team.Tag
 		iplayer.Clan = team.Name
 		iplayer.MemberType = player.MEMBER
+		iplayer.ClanJoined = time.Now()
 		team.AmountPlayers++
 		if _, err := datastore.PutMulti(c, keys, models); err != nil {
 			return err
 		}
+		if remove != nil {
+			if err := datastore.Delete(c, remove); err != nil {
+				return err
+			}
+		}
 		e := &event.Event{
 			Created:    time.Now(),
 			Player:     playerKey,
 			EventType:  "Clan",
-			Clan:       invite.Clan,
+			Clan:       clanKey,
 			Direction:  event.IN,
 			Action:     "Join",
 			PlayerName: iplayer.Nick,
@@ -676,11 +794,173 @@ func Join(c appengine.Context, playerStr, inviteStr string) error {
 	}, options)
 }
 
-//TODO add email invite logic
-func EmailInvite(c appengine.Context, clanStr, playerStr, email string) error {
+//email invite for someone who is not a player yet, keyname: token
+type PendingInvite struct {
+	Email         string         `json:"email"`
+	Clan          *datastore.Key `json:"-"`
+	ClanName      string         `json:"clan_name"`
+	InvitedBy     *datastore.Key `json:"-"`
+	InvitedByName string         `json:"invited_name"`
+	Invited       time.Time      `json:"invited_on"`
+	Expires       time.Time      `json:"expires"`
+	Token         string         `datastore:"-" json:"-"`
+}
+
+type SendEmail struct {
+	Email string `json:"email"`
+}
+
+func EmailInvite(c appengine.Context, playerStr, email string) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !emailRegex.MatchString(email) {
+		return errors.New("Malformed email")
+	}
+	iplayer := new(player.Player)
+	playerKey, err := player.Get(c, playerStr, iplayer)
+	if err != nil {
+		return err
+	}
+	if iplayer.ClanKey == nil {
+		return ClanMemberError
+	}
+	if iplayer.MemberType < player.LIEUTENANT {
+		return ClanMemberTypeError
+	}
+	registered, err := datastore.NewQuery("Player").Filter("Email =", email).Count(c)
+	if err != nil {
+		return err
+	}
+	if registered > 0 {
+		return errors.New("Already a player, invite by player id")
+	}
+	if err := inviteBarrier(c, iplayer.ClanKey); err != nil {
+		return err
+	}
+	pending, err := datastore.NewQuery("PendingInvite").Filter("Email =", email).
+		Filter("Clan =", iplayer.ClanKey).Filter("Expires >", time.Now()).Count(c)
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		return PlayerAlreadyInvitedError
+	}
+	team := new(Clan)
+	if err := Get(c, iplayer.ClanKey, team); err != nil {
+		return err
+	}
+	if team.AmountPlayers >= config.Get().Clan.MaxMember {
+		return errors.New("Already full clan")
+	}
+	token, err := guid.GenUUID()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	invite := &PendingInvite{
+		Email:         email,
+		Clan:          iplayer.ClanKey,
+		ClanName:      team.Name,
+		InvitedBy:     playerKey,
+		InvitedByName: iplayer.Nick,
+		Invited:       now,
+		Expires:       now.AddDate(0, 0, 2),
+		Token:         token,
+	}
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if _, err := datastore.Put(c, datastore.NewKey(c, "PendingInvite", token, 0, nil), invite); err != nil {
+			return err
+		}
+		entry := newAuditEntry("EmailInvite", iplayer, nil)
+		entry.TargetName = email
+		return entry.save(c, iplayer.ClanKey)
+	}, options); err != nil {
+		return err
+	}
+	if err := event.SendEmail(c, email, iplayer.Nick, "EmailInvite", invite); err != nil {
+		return err
+	}
+	e := &event.Event{
+		Created:    now,
+		Player:     playerKey,
+		Direction:  event.OUT,
+		EventType:  "Clan",
+		Clan:       iplayer.ClanKey,
+		Expires:    invite.Expires,
+		Action:     "EmailInvite",
+		PlayerName: iplayer.Nick,
+		PlayerID:   iplayer.ID,
+		ClanName:   team.Name,
+		ClanID:     team.ID,
+	}
+	if err := event.Send(c, []*event.Event{e}, event.Func); err != nil {
+		return err
+	}
 	return nil
 }
 
+//new player signed up with an invite token: turn the pending invite into a regular invite
+func claimEmailInvite(c appengine.Context, playerKey *datastore.Key, email, token string) error {
+	pendingKey := datastore.NewKey(c, "PendingInvite", token, 0, nil)
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		pending := new(PendingInvite)
+		iplayer := new(player.Player)
+		team := new(Clan)
+		if err := datastore.Get(c, pendingKey, pending); err != nil {
+			return err
+		}
+		if pending.Email != strings.ToLower(email) {
+			return errors.New("Invite token for another email")
+		}
+		if pending.Expires.Before(time.Now()) {
+			return errors.New("Invite expired")
+		}
+		if err := datastore.GetMulti(c, []*datastore.Key{playerKey, pending.Clan},
+			[]interface{}{iplayer, team}); err != nil {
+			return err
+		}
+		inviteKey := datastore.NewKey(c, "Invite", fmt.Sprintf("%d%d", team.ID, iplayer.ID), 0, nil)
+		invite := &Invite{
+			Player:        playerKey,
+			PlayerName:    iplayer.Nick,
+			Expires:       pending.Expires,
+			Clan:          pending.Clan,
+			ClanName:      pending.ClanName,
+			InvitedBy:     pending.InvitedBy,
+			InvitedByName: pending.InvitedByName,
+			Invited:       pending.Invited,
+		}
+		if _, err := datastore.Put(c, inviteKey, invite); err != nil {
+			return err
+		}
+		if err := datastore.Delete(c, pendingKey); err != nil {
+			return err
+		}
+		e := &event.Event{
+			Created:    time.Now(),
+			Direction:  event.IN,
+			Player:     playerKey,
+			EventType:  "Clan",
+			Expires:    invite.Expires,
+			Target:     invite.InvitedBy,
+			Action:     "Invite",
+			PlayerName: iplayer.Nick,
+			PlayerID:   iplayer.ID,
+			TargetName: invite.InvitedByName,
+			ClanName:   team.Name,
+			ClanID:     team.ID,
+		}
+		if err := event.Send(c, []*event.Event{e}, event.Func); err != nil {
+			return err
+		}
+		return nil
+	}, options)
+}
+
+//player and email invites both count
 func inviteBarrier(c appengine.Context, clanKey *datastore.Key) error {
 	q := datastore.NewQuery("Invite").Filter("Expires >", time.Now()).
 		Filter("Clan =", clanKey)
@@ -688,7 +968,12 @@ func inviteBarrier(c appengine.Context, clanKey *datastore.Key) error {
 	if err != nil {
 		return err
 	}
-	if count >= MAXINVITES {
+	pending, err := datastore.NewQuery("PendingInvite").Filter("Expires >", time.Now()).
+		Filter("Clan =", clanKey).Count(c)
+	if err != nil {
+		return err
+	}
+	if int64(count+pending) >= config.Get().Clan.MaxInvites {
 		//already enough invites sent
 		//wait till some expire
 		return errors.New("Too many invites")
@@ -726,7 +1011,7 @@ func InvitePlayer(c appengine.Context, playerStr string, inviteeID int64) error
 	if err := datastore.Get(c, iplayer.ClanKey, team); err != nil {
 		return err
 	}
-	if team.AmountPlayers >= MAXMEMBER {
+	if team.AmountPlayers >= config.Get().Clan.MaxMember {
 		return errors.New("Already full clan")
 	}
 	inviteStr := fmt.Sprintf("%d%d", team.ID, invitedPlayer.ID)
@@ -750,7 +1035,14 @@ func InvitePlayer(c appengine.Context, playerStr string, inviteeID int64) error
 		invite.InvitedByName = iplayer.Nick
 		invite.PlayerName = invitedPlayer.Nick
 	}
-	if _, err := datastore.Put(c, inviteKey, invite); err != nil {
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if _, err := datastore.Put(c, inviteKey, invite); err != nil {
+			return err
+		}
+		return newAuditEntry("Invite", iplayer, invitedPlayer).save(c, iplayer.ClanKey)
+	}, options); err != nil {
 		return err
 	}
 	now := time.Now()
@@ -907,6 +1199,7 @@ func Create(c appengine.Context, playerStr, clanName, tag string) (string, map[s
 		iplayer.ClanTag = tag
 		iplayer.Clan = clanName
 		iplayer.MemberType = player.LEADER
+		iplayer.ClanJoined = time.Now()
 		clan := &Clan{
 			Name:           clanName,
 			Tag:            tag,
@@ -953,6 +1246,21 @@ func Leave(c appengine.Context, playerStr string) error {
 	if err != nil {
 		return err
 	}
+	leaving := new(player.Player)
+	if err := datastore.Get(c, playerKey, leaving); err != nil {
+		return err
+	}
+	var successorKey *datastore.Key
+	if leaving.ClanKey != nil && leaving.MemberType == player.LEADER {
+		successorKey, _, err = successor(c, leaving.ClanKey, playerKey, time.Time{})
+		if err != nil {
+			return err
+		}
+		if successorKey == nil {
+			//last one to leave
+			return Delete(c, playerStr)
+		}
+	}
 	options := new(datastore.TransactionOptions)
 	options.XG = true
 	return datastore.RunInTransaction(c, func(c appengine.Context) error {
@@ -963,24 +1271,37 @@ func Leave(c appengine.Context, playerStr string) error {
 		if iplayer.ClanKey == nil {
 			return ClanMemberError
 		}
-		if iplayer.MemberType == player.LEADER {
-			return ClanMemberTypeError
-		}
 		clan := new(Clan)
 		if err := datastore.Get(c, iplayer.ClanKey, clan); err != nil {
 			return err
 		}
+		clanKey := iplayer.ClanKey
+		keys := []*datastore.Key{playerKey, clanKey}
+		models := []interface{}{iplayer, clan}
+		var successorPlayer *player.Player
+		if iplayer.MemberType == player.LEADER {
+			if successorKey == nil {
+				return errors.New("Leadership changed, try again")
+			}
+			successorPlayer = new(player.Player)
+			if err := datastore.Get(c, successorKey, successorPlayer); err != nil {
+				return err
+			}
+			if !clanKey.Equal(successorPlayer.ClanKey) {
+				return errors.New("Leadership changed, try again")
+			}
+			successorPlayer.MemberType = player.LEADER
+			keys = append(keys, successorKey)
+			models = append(models, successorPlayer)
+		}
 		clan.AmountPlayers--
 		if iplayer.Cps > 0 {
 			clan.Cps -= int64(math.Ceil(float64(iplayer.Cps) / 3))
 		}
-		clanKey := iplayer.ClanKey
 		iplayer.ClanKey = nil
 		iplayer.Clan = ""
 		iplayer.ClanTag = ""
 		iplayer.MemberType = 0
-		keys := []*datastore.Key{playerKey, clanKey}
-		models := []interface{}{iplayer, clan}
 		if _, err := datastore.PutMulti(c, keys, models); err != nil {
 			return err
 		}
@@ -996,7 +1317,12 @@ func Leave(c appengine.Context, playerStr string) error {
 			ClanName:   clan.Name,
 			ClanID:     clan.ID,
 		}
-		if err := event.Send(c, []*event.Event{e}, func(c appengine.Context, evs []*event.Event) error {
+		evs := []*event.Event{e}
+		if successorPlayer != nil {
+			evs = append(evs, leadershipEvent(clanKey, clan, playerKey, iplayer,
+				successorKey, successorPlayer, "Succession"))
+		}
+		if err := event.Send(c, evs, func(c appengine.Context, evs []*event.Event) error {
 			if err := event.Func(c, evs); err != nil {
 				return err
 			}
@@ -1046,19 +1372,17 @@ func PromoteOrDemote(c appengine.Context, playerStr string, promoteID, rk int64)
 		return ClanMemberTypeError
 	}
 	if rk == player.LEADER {
-		if iplayer.MemberType != player.LEADER {
-			return errors.New("Need to be Clan leader to change leadership")
-		}
 		if promotePlayer.MemberType != player.LIEUTENANT {
 			return errors.New("Can only promote Lieutenant to Leader")
 		}
+		return TransferLeadership(c, playerStr, promoteID)
 	}
 	if promotePlayer.MemberType < player.LIEUTENANT {
 		count, err := checkLeaderShip(c, iplayer.ClanKey)
 		if err != nil {
 			return err
 		}
-		if count == MAXLEADERSHIP {
+		if int64(count) == config.Get().Clan.MaxLeadership {
 			return errors.New("Need to demote someone first")
 		}
 	}
@@ -1071,17 +1395,18 @@ func PromoteOrDemote(c appengine.Context, playerStr string, promoteID, rk int64)
 	} else if rk > promotePlayer.MemberType {
 		action = "Promote"
 	}
-	paction := action
+	entry := newAuditEntry(action, iplayer, promotePlayer)
+	entry.Before = rankName[promotePlayer.MemberType]
+	entry.After = rankName[rk]
 	promotePlayer.MemberType = rk
-	keys := []*datastore.Key{promoteKey}
-	models := []interface{}{promotePlayer}
-	if rk == 4 {
-		iplayer.MemberType = player.LIEUTENANT
-		keys = append(keys, playerKey)
-		models = append(models, iplayer)
-		paction = "Demote"
-	}
-	if _, err := datastore.PutMulti(c, keys, models); err != nil {
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if _, err := datastore.Put(c, promoteKey, promotePlayer); err != nil {
+			return err
+		}
+		return entry.save(c, iplayer.ClanKey)
+	}, options); err != nil {
 		return err
 	}
 	e := &event.Event{
@@ -1094,7 +1419,7 @@ func PromoteOrDemote(c appengine.Context, playerStr string, promoteID, rk int64)
 		TargetID:   promotePlayer.ID,
 		PlayerName: iplayer.Nick,
 		PlayerID:   iplayer.ID,
-		Action:     paction,
+		Action:     action,
 		Direction:  event.OUT,
 	}
 	//no need to provide clan -> same clan and otherwise double global event
@@ -1128,6 +1453,191 @@ func PromoteOrDemote(c appengine.Context, playerStr string, promoteID, rk int64)
 	return nil
 }
 
+//highest rank first, longest serving member on equal rank,
+//with activeSince set only members active since then qualify
+func pickSuccessor(keys []*datastore.Key, members []player.Player, leaderKey *datastore.Key,
+	activeSince time.Time) (*datastore.Key, *player.Player) {
+	var successorKey *datastore.Key
+	var successor *player.Player
+	for i := range members {
+		member := &members[i]
+		if keys[i].Equal(leaderKey) || member.Status == player.DEAD || member.LastActive.Before(activeSince) {
+			continue
+		}
+		if successor == nil || member.MemberType > successor.MemberType ||
+			(member.MemberType == successor.MemberType && member.ClanJoined.Before(successor.ClanJoined)) {
+			successorKey = keys[i]
+			successor = member
+		}
+	}
+	return successorKey, successor
+}
+
+func successor(c appengine.Context, clanKey, leaderKey *datastore.Key,
+	activeSince time.Time) (*datastore.Key, *player.Player, error) {
+	var members []player.Player
+	keys, err := datastore.NewQuery("Player").Filter("ClanKey =", clanKey).GetAll(c, &members)
+	if err != nil {
+		return nil, nil, err
+	}
+	successorKey, successor := pickSuccessor(keys, members, leaderKey, activeSince)
+	return successorKey, successor, nil
+}
+
+//clan wide event, the former leader can be gone already (nil)
+func leadershipEvent(clanKey *datastore.Key, team *Clan, leaderKey *datastore.Key, leader *player.Player,
+	successorKey *datastore.Key, successor *player.Player, action string) *event.Event {
+	e := &event.Event{
+		Created:    time.Now(),
+		Player:     successorKey,
+		PlayerName: successor.Nick,
+		PlayerID:   successor.ID,
+		EventType:  "Clan",
+		Clan:       clanKey,
+		ClanName:   team.Name,
+		ClanID:     team.ID,
+		Action:     action,
+		Direction:  event.IN,
+	}
+	if leader != nil {
+		e.Target = leaderKey
+		e.TargetName = leader.Nick
+		e.TargetID = leader.ID
+	}
+	return e
+}
+
+//leader hands over to a clan member, the former leader takes the rank of the successor
+func TransferLeadership(c appengine.Context, playerStr string, successorID int64) error {
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return err
+	}
+	successorKey, err := player.KeyByID(c, successorID)
+	if err != nil {
+		return err
+	}
+	if playerKey.Equal(successorKey) {
+		return errors.New("Illegal operation")
+	}
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		leader := new(player.Player)
+		successor := new(player.Player)
+		if err := datastore.GetMulti(c, []*datastore.Key{playerKey, successorKey},
+			[]interface{}{leader, successor}); err != nil {
+			return err
+		}
+		if leader.ClanKey == nil || successor.ClanKey == nil {
+			return ClanMemberError
+		}
+		if !successor.ClanKey.Equal(leader.ClanKey) {
+			return errors.New("Illegal operation")
+		}
+		if leader.MemberType != player.LEADER {
+			return errors.New("Need to be Clan leader to change leadership")
+		}
+		team := new(Clan)
+		if err := datastore.Get(c, leader.ClanKey, team); err != nil {
+			return err
+		}
+		leader.MemberType = successor.MemberType
+		successor.MemberType = player.LEADER
+		if _, err := datastore.PutMulti(c, []*datastore.Key{playerKey, successorKey},
+			[]interface{}{leader, successor}); err != nil {
+			return err
+		}
+		entry := newAuditEntry("Transfer", leader, successor)
+		entry.Before = rankName[leader.MemberType]
+		entry.After = rankName[player.LEADER]
+		if err := entry.save(c, leader.ClanKey); err != nil {
+			return err
+		}
+		e := leadershipEvent(leader.ClanKey, team, playerKey, leader, successorKey, successor, "Transfer")
+		if err := event.Send(c, []*event.Event{e}, event.Func); err != nil {
+			return err
+		}
+		return nil
+	}, options)
+}
+
+//cron: queues a leadership review for every clan
+func ReviewLeadership(c appengine.Context) error {
+	keys, err := datastore.NewQuery("Clan").KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	for _, clanKey := range keys {
+		reviewLeadershipFunc.Call(c, clanKey)
+	}
+	return nil
+}
+
+//hands over leadership when the leader is inactive or gone
+func reviewLeadership(c appengine.Context, clanKey *datastore.Key) error {
+	var members []player.Player
+	keys, err := datastore.NewQuery("Player").Filter("ClanKey =", clanKey).GetAll(c, &members)
+	if err != nil {
+		return err
+	}
+	var leaderKey *datastore.Key
+	var leader *player.Player
+	for i := range members {
+		if members[i].MemberType == player.LEADER {
+			leaderKey = keys[i]
+			leader = &members[i]
+			break
+		}
+	}
+	activeSince := time.Now().Add(-INACTIVELEADER)
+	//no recorded activity yet (older accounts): leave it alone, dead leaders are replaced
+	if leader != nil && leader.Status != player.DEAD &&
+		(leader.LastActive.IsZero() || leader.LastActive.After(activeSince)) {
+		return nil
+	}
+	successorKey, _ := pickSuccessor(keys, members, leaderKey, activeSince)
+	if successorKey == nil {
+		//nobody active to take over
+		return nil
+	}
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		team := new(Clan)
+		successor := new(player.Player)
+		keys := []*datastore.Key{clanKey, successorKey}
+		models := []interface{}{team, successor}
+		if leaderKey != nil {
+			leader = new(player.Player)
+			keys = append(keys, leaderKey)
+			models = append(models, leader)
+		}
+		if err := datastore.GetMulti(c, keys, models); err != nil {
+			return err
+		}
+		if !clanKey.Equal(successor.ClanKey) {
+			return nil
+		}
+		if leader != nil {
+			if !clanKey.Equal(leader.ClanKey) || leader.MemberType != player.LEADER ||
+				(leader.Status != player.DEAD && leader.LastActive.After(activeSince)) {
+				return nil
+			}
+			leader.MemberType = successor.MemberType
+		}
+		successor.MemberType = player.LEADER
+		if _, err := datastore.PutMulti(c, keys[1:], models[1:]); err != nil {
+			return err
+		}
+		e := leadershipEvent(clanKey, team, leaderKey, leader, successorKey, successor, "Succession")
+		if err := event.Send(c, []*event.Event{e}, event.Func); err != nil {
+			return err
+		}
+		return nil
+	}, options)
+}
+
 func UpdateMessage(c appengine.Context, playerKeyStr string, update *MessageUpdate) error {
 	playerKey, err := datastore.DecodeKey(playerKeyStr)
 	if err != nil {
@@ -1147,8 +1657,16 @@ func UpdateMessage(c appengine.Context, playerKeyStr string, update *MessageUpda
 	if err := datastore.Get(c, iplayer.ClanKey, team); err != nil {
 		return err
 	}
+	entry := newAuditEntry("Message", iplayer, nil)
+	entry.Before = team.Message
+	entry.After = update.Content
 	team.Message = update.Content
-	if _, err := datastore.Put(c, iplayer.ClanKey, team); err != nil {
+	if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if _, err := datastore.Put(c, iplayer.ClanKey, team); err != nil {
+			return err
+		}
+		return entry.save(c, iplayer.ClanKey)
+	}, nil); err != nil {
 		return err
 	}
 	e := &event.Event{
@@ -1169,7 +1687,276 @@ func UpdateMessage(c appengine.Context, playerKeyStr string, update *MessageUpda
 	return nil
 }
 
-func Delete(c appengine.Context, pkey string) error {
+const DISBANDBATCH = 100
+
+//set in init, the disband tasks queue their own next batch
+var (
+	disbandMembersFunc     *delay.Function
+	disbandInvitesFunc     *delay.Function
+	disbandConnectionsFunc *delay.Function
+)
+
+func init() {
+	disbandMembersFunc = delay.Func("disbandMembers", disbandMembers)
+	disbandInvitesFunc = delay.Func("disbandInvites", disbandInvites)
+	disbandConnectionsFunc = delay.Func("disbandConnections", disbandConnections)
+}
+
+//parent the (deleted) clan, keyname: disbanded. what the disband tasks need of the clan
+type Disbanded struct {
+	ID         int64          `json:"id"`
+	Name       string         `datastore:",noindex" json:"name"`
+	Tag        string         `datastore:",noindex" json:"tag"`
+	Leader     *datastore.Key `json:"-"`
+	LeaderName string         `datastore:",noindex" json:"leader_name"`
+	LeaderID   int64          `datastore:",noindex" json:"leader_id"`
+	Connected  []int64        `datastore:",noindex" json:"connected"`
+	Disbanded  time.Time      `json:"disbanded"`
+}
+
+func disbandedKey(c appengine.Context, clanKey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, "Disbanded", "disbanded", 0, clanKey)
+}
+
+//clans @ war or bound by a pact
+func connectedIDs(team *Clan) []int64 {
+	ids := make([]int64, 0, len(team.Wars)+len(team.Pacts))
+	seen := make(map[int64]bool)
+	for _, conn := range team.Wars {
+		id := conn.Target
+		if id == team.ID {
+			id = conn.Source
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, pact := range team.Pacts {
+		id := pact.Other(team.ID)
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+//cleared members drop out of the query, no cursor needed
+func disbandMembers(c appengine.Context, clanKey *datastore.Key) error {
+	record := new(Disbanded)
+	if err := datastore.Get(c, disbandedKey(c, clanKey), record); err != nil {
+		return err
+	}
+	memberKeys, err := datastore.NewQuery("Player").Filter("ClanKey =", clanKey).KeysOnly().
+		Limit(DISBANDBATCH).GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	for _, memberKey := range memberKeys {
+		if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+			member := new(player.Player)
+			if err := datastore.Get(c, memberKey, member); err != nil {
+				return err
+			}
+			if member.ClanKey == nil || !member.ClanKey.Equal(clanKey) {
+				return nil
+			}
+			member.ClanKey = nil
+			member.Clan = ""
+			member.ClanTag = ""
+			member.MemberType = 0
+			if _, err := datastore.Put(c, memberKey, member); err != nil {
+				return err
+			}
+			e := &event.Event{
+				Created:    record.Disbanded,
+				Player:     memberKey,
+				PlayerName: member.Nick,
+				PlayerID:   member.ID,
+				EventType:  "Clan",
+				Direction:  event.IN,
+				Target:     record.Leader,
+				TargetName: record.LeaderName,
+				TargetID:   record.LeaderID,
+				ClanName:   record.Name,
+				ClanID:     record.ID,
+				Action:     "Disband",
+			}
+			return event.Send(c, []*event.Event{e}, event.Func)
+		}, nil); err != nil {
+			return err
+		}
+		cache.Delete(c, memberKey.StringID()+"Player")
+	}
+	if len(memberKeys) == DISBANDBATCH {
+		disbandMembersFunc.Call(c, clanKey)
+	}
+	return nil
+}
+
+//deleted invites drop out of the query, no cursor needed
+func disbandInvites(c appengine.Context, clanKey *datastore.Key) error {
+	inviteKeys, err := datastore.NewQuery("Invite").Filter("Clan =", clanKey).KeysOnly().
+		Limit(DISBANDBATCH).GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	if err := datastore.DeleteMulti(c, inviteKeys); err != nil {
+		return err
+	}
+	if len(inviteKeys) == DISBANDBATCH {
+		disbandInvitesFunc.Call(c, clanKey)
+	}
+	return nil
+}
+
+//closes the wars and pacts of the disbanded clan, one connected clan per transaction
+func disbandConnections(c appengine.Context, clanKey *datastore.Key) error {
+	record := new(Disbanded)
+	if err := datastore.Get(c, disbandedKey(c, clanKey), record); err != nil {
+		return err
+	}
+	for _, id := range record.Connected {
+		connectedKey, err := KeyByID(c, id)
+		if err != nil {
+			return err
+		}
+		//disbanded in the meantime
+		if connectedKey.Incomplete() {
+			continue
+		}
+		if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+			cl := new(Clan)
+			if err := datastore.Get(c, connectedKey, cl); err == datastore.ErrNoSuchEntity {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			cl.RemoveConnectionWith(record.ID)
+			cl.RemovePact(record.ID)
+			if _, err := datastore.Put(c, connectedKey, cl); err != nil {
+				return err
+			}
+			e := &event.Event{
+				Created:    record.Disbanded,
+				EventType:  "Clan",
+				Direction:  event.IN,
+				Clan:       connectedKey,
+				ClanName:   cl.Name,
+				ClanID:     cl.ID,
+				Target:     clanKey,
+				TargetName: record.Name,
+				TargetID:   record.ID,
+				Action:     "Disband",
+			}
+			return event.Send(c, []*event.Event{e}, event.Func)
+		}, nil); err != nil {
+			return err
+		}
+		cache.Delete(c, connectedKey.StringID()+"Clan")
+	}
+	return nil
+}
+
+//called after a clan is disbanded, the clan entity no longer exists
+type DisbandFunc func(c appengine.Context, clanKey *datastore.Key) error
+
+var disbandFuncs []DisbandFunc
+
+//register from init, packages that keep clan data (boards,...) clean up here
+func RegisterDisbandFunc(f DisbandFunc) {
+	disbandFuncs = append(disbandFuncs, f)
+}
+
+func Delete(c appengine.Context, playerStr string) error {
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return err
+	}
+	iplayer := new(player.Player)
+	if err := datastore.Get(c, playerKey, iplayer); err != nil {
+		return err
+	}
+	if iplayer.ClanKey == nil {
+		return ClanMemberError
+	}
+	if iplayer.MemberType != player.LEADER {
+		return errors.New("Need to be Clan leader to disband the clan")
+	}
+	clanKey := iplayer.ClanKey
+	team := new(Clan)
+	if err := datastore.Get(c, clanKey, team); err != nil {
+		return err
+	}
+	trackerKeys, err := datastore.NewQuery("Tracker").Ancestor(clanKey).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	accountKeys, err := datastore.NewQuery("TreasuryAccount").Ancestor(clanKey).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	//members, invites and connected clans are cleared in batches, one entity group per transaction
+	if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Get(c, clanKey, team); err != nil {
+			return err
+		}
+		record := &Disbanded{
+			ID:         team.ID,
+			Name:       team.Name,
+			Tag:        team.Tag,
+			Leader:     playerKey,
+			LeaderName: iplayer.Nick,
+			LeaderID:   iplayer.ID,
+			Connected:  connectedIDs(team),
+			Disbanded:  time.Now(),
+		}
+		if _, err := datastore.Put(c, disbandedKey(c, clanKey), record); err != nil {
+			return err
+		}
+		delKeys := append(append([]*datastore.Key{clanKey}, trackerKeys...), accountKeys...)
+		if err := datastore.DeleteMulti(c, delKeys); err != nil {
+			return err
+		}
+		disbandMembersFunc.Call(c, clanKey)
+		disbandInvitesFunc.Call(c, clanKey)
+		disbandConnectionsFunc.Call(c, clanKey)
+		return nil
+	}, nil); err != nil {
+		return err
+	}
+	if err := removeClan(c, team.Name, team.Tag); err != nil {
+		return err
+	}
+	applicationKeys, err := datastore.NewQuery("Application").Filter("Clan =", clanKey).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	if err := datastore.DeleteMulti(c, applicationKeys); err != nil {
+		return err
+	}
+	pendingKeys, err := datastore.NewQuery("PendingInvite").Filter("Clan =", clanKey).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	if err := datastore.DeleteMulti(c, pendingKeys); err != nil {
+		return err
+	}
+	snapshotKeys, err := datastore.NewQuery("ClanSnapshot").Ancestor(clanKey).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	if err := datastore.DeleteMulti(c, snapshotKeys); err != nil {
+		return err
+	}
+	for _, f := range disbandFuncs {
+		if err := f(c, clanKey); err != nil {
+			return err
+		}
+	}
+	cache.Delete(c, clanKey.StringID()+"Clan")
+	cache.Delete(c, fmt.Sprintf("%d", team.ID))
 	return nil
 }
 
@@ -1200,11 +1987,21 @@ func Kick(c appengine.Context, playerStr string, kickedPlayerID int64) error {
 	if kickedPlayer.MemberType > player.MEMBER {
 		errors.New("Need to demote player first")
 	}
+	entry := newAuditEntry("Kick", iplayer, kickedPlayer)
+	entry.Before = rankName[kickedPlayer.MemberType]
+	entry.After = rankName[0]
 	kickedPlayer.MemberType = 0
 	kickedPlayer.Clan = ""
 	kickedPlayer.ClanTag = ""
 	kickedPlayer.ClanKey = nil
-	if _, err := datastore.Put(c, kickedPlayerKey, kickedPlayer); err != nil {
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if _, err := datastore.Put(c, kickedPlayerKey, kickedPlayer); err != nil {
+			return err
+		}
+		return entry.save(c, iplayer.ClanKey)
+	}, options); err != nil {
 		return err
 	}
 
@@ -1286,9 +2083,17 @@ func UpdateAvatar(c appengine.Context, playerStr string, img *blobstore.BlobInfo
 		if err != nil {
 			return err
 		}
+		entry := newAuditEntry("Avatar", iplayer, nil)
+		entry.Before = clan.Avatar
+		entry.After = imgURL.String()
 		clan.AvatarKey = img.BlobKey
 		clan.Avatar = imgURL.String()
-		if _, err := datastore.Put(c, iplayer.ClanKey, clan); err != nil {
+		if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+			if _, err := datastore.Put(c, iplayer.ClanKey, clan); err != nil {
+				return err
+			}
+			return entry.save(c, iplayer.ClanKey)
+		}, nil); err != nil {
 			return err
 		}
 	} else {
@@ -6,6 +6,7 @@ import (
 	"appengine/datastore"
 	"errors"
 	"fmt"
+	"mj0lk.be/netwars/config"
 	"mj0lk.be/netwars/player"
 	"mj0lk.be/netwars/secure"
 	"mj0lk.be/netwars/testutils"
@@ -23,7 +24,7 @@ const (
 )
 
 func setupPlayer(c appengine.Context, nick string, email string) (string, error) {
-	cr := player.Creation{email, nick, "testpassword"}
+	cr := player.Creation{email, nick, "testpassword", ""}
 	tokenStr, usererr, err := player.Create(c, cr)
 	if err != nil {
 		return "", err
@@ -32,7 +33,7 @@ func setupPlayer(c appengine.Context, nick string, email string) (string, error)
 	if usererr != nil {
 		return "", errors.New("unexpected user error")
 	}
-	playerKeyStr, _ := secure.ValidateToken(tokenStr)
+	playerKeyStr, _ := secure.ValidateToken(tokenStr, c)
 	return playerKeyStr, nil
 }
 
@@ -611,3 +612,392 @@ func TestClanList(t *testing.T) {
 	t.Logf("list retrieved : %+v \n", list)
 
 }
+
+func TestDelete(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	leaderStr, err := setupPlayer(c, TESTNICK1, TESTEMAIL1)
+	if err != nil {
+		t.Fatalf("Error setting up leader")
+	}
+	memberStr, err := setupPlayer(c, TESTNICK2, TESTEMAIL2)
+	if err != nil {
+		t.Fatalf("Error setting up member")
+	}
+	clanGuid, _, err := Create(c, leaderStr, CLAN1, "lol")
+	if err != nil {
+		t.Fatalf("\nError creating clan %s", err)
+	}
+	clanGuid2, _, err := Create(c, memberStr, CLAN2, "lel")
+	if err != nil {
+		t.Fatalf("\nError creating clan %s", err)
+	}
+	clan2Key := datastore.NewKey(c, "Clan", clanGuid2, 0, nil)
+	time.Sleep(1 * time.Second)
+	team2 := new(Clan)
+	if err := datastore.Get(c, clan2Key, team2); err != nil {
+		t.Fatalf("\n error getting defending clan %s", err)
+	}
+	if err := Connect(c, leaderStr, team2.ID); err != nil {
+		t.Fatalf("\n error connecting to clan %s", err)
+	}
+	if err := Delete(c, memberStr); err != nil {
+		t.Fatalf("\n error disbanding clan %s", err)
+	}
+	time.Sleep(1 * time.Second)
+	//the tasks queued by Delete
+	if err := disbandMembers(c, clan2Key); err != nil {
+		t.Fatalf("\n error clearing members %s", err)
+	}
+	if err := disbandConnections(c, clan2Key); err != nil {
+		t.Fatalf("\n error closing connections %s", err)
+	}
+	if err := datastore.Get(c, clan2Key, team2); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("\n expected disbanded clan to be removed, got %s", err)
+	}
+	clanKey := datastore.NewKey(c, "Clan", clanGuid, 0, nil)
+	team := new(Clan)
+	if err := datastore.Get(c, clanKey, team); err != nil {
+		t.Fatalf("\n error getting attacking clan %s", err)
+	}
+	if len(team.Wars) > 0 {
+		t.Fatalf("\n expected connection to be closed, wars: %+v", team.Wars)
+	}
+	memberKey, _ := datastore.DecodeKey(memberStr)
+	member := new(player.Player)
+	if err := datastore.Get(c, memberKey, member); err != nil {
+		t.Fatalf("\n error getting former leader %s", err)
+	}
+	if member.ClanKey != nil || member.MemberType != 0 {
+		t.Fatalf("\n former leader still in clan %+v", member)
+	}
+	if _, errmap, err := Create(c, memberStr, CLAN2, "lel"); err == nil &&
+		errmap["clan_name"]+errmap["clan_tag"] > 0 {
+		t.Fatalf("\n clan name and tag should be free again %+v", errmap)
+	}
+}
+
+func setupClanMember(c appengine.Context, t *testing.T) (string, string, *player.Player) {
+	leaderStr, err := setupPlayer(c, TESTNICK1, TESTEMAIL1)
+	if err != nil {
+		t.Fatalf("Error setting up leader")
+	}
+	if _, _, err := Create(c, leaderStr, CLAN1, "lol"); err != nil {
+		t.Fatalf("\nError creating clan %s", err)
+	}
+	memberStr, err := setupPlayer(c, TESTNICK2, TESTEMAIL2)
+	if err != nil {
+		t.Fatalf("\nError setting up member %s", err)
+	}
+	memberKey, _ := datastore.DecodeKey(memberStr)
+	member := new(player.Player)
+	if err := datastore.Get(c, memberKey, member); err != nil {
+		t.Fatalf("\nError getting player %s", err)
+	}
+	if err := InvitePlayer(c, leaderStr, member.ID); err != nil {
+		t.Fatalf("\nError sending invite %s", err)
+	}
+	inviteKey := datastore.NewKey(c, "Invite", fmt.Sprintf("%d%d", 1, 2), 0, nil)
+	if err := Join(c, memberStr, inviteKey.Encode()); err != nil {
+		t.Fatalf("\nerror joining clan %s", err)
+	}
+	time.Sleep(1 * time.Second)
+	return leaderStr, memberStr, member
+}
+
+func TestTransferLeadership(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	leaderStr, memberStr, member := setupClanMember(c, t)
+	if err := TransferLeadership(c, memberStr, member.ID); err == nil {
+		t.Fatalf("\n expected error, member can't transfer leadership")
+	}
+	if err := TransferLeadership(c, leaderStr, member.ID); err != nil {
+		t.Fatalf("\n error transferring leadership %s", err)
+	}
+	leaderKey, _ := datastore.DecodeKey(leaderStr)
+	memberKey, _ := datastore.DecodeKey(memberStr)
+	leader := new(player.Player)
+	if err := datastore.GetMulti(c, []*datastore.Key{leaderKey, memberKey},
+		[]interface{}{leader, member}); err != nil {
+		t.Fatalf("\n error getting players %s", err)
+	}
+	if member.MemberType != player.LEADER || leader.MemberType != player.MEMBER {
+		t.Fatalf("\n ranks not swapped, new leader %d former leader %d", member.MemberType, leader.MemberType)
+	}
+}
+
+func TestLeaveSuccession(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	leaderStr, memberStr, _ := setupClanMember(c, t)
+	if err := Leave(c, leaderStr); err != nil {
+		t.Fatalf("\n error leaving clan as leader %s", err)
+	}
+	memberKey, _ := datastore.DecodeKey(memberStr)
+	member := new(player.Player)
+	if err := datastore.Get(c, memberKey, member); err != nil {
+		t.Fatalf("\n error getting member %s", err)
+	}
+	if member.MemberType != player.LEADER {
+		t.Fatalf("\n expected member to succeed leader, rank %d", member.MemberType)
+	}
+	time.Sleep(1 * time.Second)
+	if err := Leave(c, memberStr); err != nil {
+		t.Fatalf("\n error leaving clan as last member %s", err)
+	}
+	if err := datastore.Get(c, member.ClanKey, new(Clan)); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("\n expected clan to be disbanded, got %s", err)
+	}
+}
+
+func TestApplication(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	leaderStr, err := setupPlayer(c, TESTNICK1, TESTEMAIL1)
+	if err != nil {
+		t.Fatalf("Error setting up leader")
+	}
+	if _, _, err := Create(c, leaderStr, CLAN1, "lol"); err != nil {
+		t.Fatalf("\nError creating clan %s", err)
+	}
+	applicantStr, err := setupPlayer(c, TESTNICK2, TESTEMAIL2)
+	if err != nil {
+		t.Fatalf("\nError setting up applicant %s", err)
+	}
+	time.Sleep(1 * time.Second)
+	if err := Apply(c, applicantStr, "1", "let me in"); err != nil {
+		t.Fatalf("\n error applying to clan %s", err)
+	}
+	if err := Apply(c, applicantStr, "1", "let me in"); err != AlreadyAppliedError {
+		t.Fatalf("\n expected already applied error, got %s", err)
+	}
+	time.Sleep(1 * time.Second)
+	if _, err := ApplicationsForClan(c, applicantStr); err != ClanMemberError {
+		t.Fatalf("\n expected clan member error, got %s", err)
+	}
+	applications, err := ApplicationsForClan(c, leaderStr)
+	if err != nil {
+		t.Fatalf("\n error listing applications %s", err)
+	}
+	if len(applications) != 1 {
+		t.Fatalf("\n expected 1 application, got %d", len(applications))
+	}
+	if err := Approve(c, leaderStr, applications[0].EncodedKey); err != nil {
+		t.Fatalf("\n error approving application %s", err)
+	}
+	applicantKey, _ := datastore.DecodeKey(applicantStr)
+	applicant := new(player.Player)
+	if err := datastore.Get(c, applicantKey, applicant); err != nil {
+		t.Fatalf("\n error getting applicant %s", err)
+	}
+	if applicant.ClanKey == nil || applicant.MemberType != player.MEMBER {
+		t.Fatalf("\n applicant did not join clan %+v", applicant)
+	}
+	if err := datastore.Get(c, applications[0].DbKey, new(Application)); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("\n expected approved application to be removed, got %s", err)
+	}
+}
+
+func TestEmailInvite(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	leaderStr, err := setupPlayer(c, TESTNICK1, TESTEMAIL1)
+	if err != nil {
+		t.Fatalf("Error setting up leader")
+	}
+	if _, _, err := Create(c, leaderStr, CLAN1, "lol"); err != nil {
+		t.Fatalf("\nError creating clan %s", err)
+	}
+	if err := EmailInvite(c, leaderStr, TESTEMAIL1); err == nil {
+		t.Fatalf("\n expected error inviting registered player by email")
+	}
+	if err := EmailInvite(c, leaderStr, TESTEMAIL2); err != nil {
+		t.Fatalf("\n error sending email invite %s", err)
+	}
+	time.Sleep(1 * time.Second)
+	keys, err := datastore.NewQuery("PendingInvite").KeysOnly().GetAll(c, nil)
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("\n expected 1 pending invite, got %d %s", len(keys), err)
+	}
+	cr := player.Creation{TESTEMAIL2, TESTNICK2, "testpassword", keys[0].StringID()}
+	tokenStr, _, err := player.Create(c, cr)
+	if err != nil {
+		t.Fatalf("\n error creating invited player %s", err)
+	}
+	inviteeStr, _ := secure.ValidateToken(tokenStr, c)
+	time.Sleep(1 * time.Second)
+	invites, err := InvitesForPlayer(c, inviteeStr)
+	if err != nil {
+		t.Fatalf("\n error getting invites %s", err)
+	}
+	if len(invites) != 1 {
+		t.Fatalf("\n expected invite for new player, got %d", len(invites))
+	}
+	if err := Join(c, inviteeStr, invites[0].EncodedKey); err != nil {
+		t.Fatalf("\n error joining clan %s", err)
+	}
+}
+
+func TestTreasury(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	leaderStr, memberStr, member := setupClanMember(c, t)
+	startCycles := config.Get().Player.StartCycles
+	if err := Deposit(c, memberStr, startCycles+1); err == nil {
+		t.Fatalf("\n expected error depositing more cycles than available")
+	}
+	if err := Deposit(c, memberStr, 500); err != nil {
+		t.Fatalf("\n error depositing cycles %s", err)
+	}
+	if err := Grant(c, memberStr, member.ID, 100); err != ClanMemberTypeError {
+		t.Fatalf("\n expected member type error, got %s", err)
+	}
+	if err := Grant(c, leaderStr, member.ID, 600); err == nil {
+		t.Fatalf("\n expected error granting more than treasury")
+	}
+	if err := Grant(c, leaderStr, member.ID, 200); err != nil {
+		t.Fatalf("\n error granting cycles %s", err)
+	}
+	team := new(Clan)
+	if err := Status(c, leaderStr, team); err != nil {
+		t.Fatalf("\n error status clan %s", err)
+	}
+	if team.Treasury != 300 || len(team.Transactions) != 2 {
+		t.Fatalf("\n unexpected treasury %d, log %+v", team.Treasury, team.Transactions)
+	}
+	memberKey, _ := datastore.DecodeKey(memberStr)
+	if err := datastore.Get(c, memberKey, member); err != nil {
+		t.Fatalf("\n error getting member %s", err)
+	}
+	if member.Cycles != startCycles-300 {
+		t.Fatalf("\n expected %d cycles, got %d", startCycles-300, member.Cycles)
+	}
+}
+
+func TestPact(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	leader1Str, err := setupPlayer(c, TESTNICK1, TESTEMAIL1)
+	if err != nil {
+		t.Fatalf("Error setting up player")
+	}
+	leader2Str, err := setupPlayer(c, TESTNICK2, TESTEMAIL2)
+	if err != nil {
+		t.Fatalf("Error setting up player")
+	}
+	clanGuid1, _, err := Create(c, leader1Str, CLAN1, "lol")
+	if err != nil {
+		t.Fatalf("\nError creating clan %s %s", err, clanGuid1)
+	}
+	clanGuid2, _, err := Create(c, leader2Str, CLAN2, "lel")
+	if err != nil {
+		t.Fatalf("\nError creating clan %s %s", err, clanGuid2)
+	}
+	time.Sleep(1 * time.Second)
+	team1 := new(Clan)
+	team2 := new(Clan)
+	if err := datastore.Get(c, datastore.NewKey(c, "Clan", clanGuid1, 0, nil), team1); err != nil {
+		t.Fatalf("\n error getting clan %s", err)
+	}
+	if err := datastore.Get(c, datastore.NewKey(c, "Clan", clanGuid2, 0, nil), team2); err != nil {
+		t.Fatalf("\n error getting clan %s", err)
+	}
+	if err := ProposePact(c, leader1Str, team2.ID, NAP); err != nil {
+		t.Fatalf("\n error proposing pact %s", err)
+	}
+	if err := AcceptPact(c, leader1Str, team2.ID); err == nil {
+		t.Fatalf("\n expected error accepting own proposal")
+	}
+	if err := AcceptPact(c, leader2Str, team1.ID); err != nil {
+		t.Fatalf("\n error accepting pact %s", err)
+	}
+	if err := Connect(c, leader1Str, team2.ID); err != PactError {
+		t.Fatalf("\n expected pact error connecting, got %s", err)
+	}
+	if err := CancelPact(c, leader2Str, team1.ID); err != nil {
+		t.Fatalf("\n error cancelling pact %s", err)
+	}
+	bound, err := Bound(c, datastore.NewKey(c, "Clan", clanGuid1, 0, nil), datastore.NewKey(c, "Clan", clanGuid2, 0, nil))
+	if err != nil {
+		t.Fatalf("\n error checking pact %s", err)
+	}
+	if !bound {
+		t.Fatalf("\n expected cancelled pact to stay binding during cooldown")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	leaderStr, memberStr, member := setupClanMember(c, t)
+	if err := PromoteOrDemote(c, leaderStr, member.ID, player.LIEUTENANT); err != nil {
+		t.Fatalf("\n error promoting member %s", err)
+	}
+	if err := UpdateMessage(c, leaderStr, &MessageUpdate{"new message"}); err != nil {
+		t.Fatalf("\n error updating message %s", err)
+	}
+	time.Sleep(1 * time.Second)
+	if _, err := Audit(c, memberStr, "", 0, ""); err != nil {
+		t.Fatalf("\n error loading audit as lieutenant %s", err)
+	}
+	list, err := Audit(c, leaderStr, "Promote", 0, "")
+	if err != nil {
+		t.Fatalf("\n error loading audit %s", err)
+	}
+	if len(list.Entries) != 1 || list.Entries[0].TargetID != member.ID ||
+		list.Entries[0].Before != "Member" || list.Entries[0].After != "Lieutenant" {
+		t.Fatalf("\n unexpected audit log %+v", list.Entries)
+	}
+}
+
+func TestStatistics(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	leaderStr, _, _ := setupClanMember(c, t)
+	leader := new(player.Player)
+	if _, err := player.Get(c, leaderStr, leader); err != nil {
+		t.Fatalf("\n error getting leader %s", err)
+	}
+	if err := snapshotClan(c, leader.ClanKey, HOURLY); err != nil {
+		t.Fatalf("\n error snapshotting clan %s", err)
+	}
+	if _, err := Statistics(c, leaderStr, "weekly"); err == nil {
+		t.Fatalf("\n expected error for unknown bucket")
+	}
+	time.Sleep(1 * time.Second)
+	stats, err := Statistics(c, leaderStr, HOURLY)
+	if err != nil {
+		t.Fatalf("\n error loading statistics %s", err)
+	}
+	if len(stats.Points) != 1 || len(stats.Points[0].Members) != 2 {
+		t.Fatalf("\n unexpected statistics %+v", stats)
+	}
+}
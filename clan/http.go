@@ -4,6 +4,7 @@ import (
 	"appengine/blobstore"
 	"mj0lk.be/netwars/app"
 	"net/http"
+	"strconv"
 )
 
 func Invites(w http.ResponseWriter, r *http.Request, c app.Context) {
@@ -48,6 +49,32 @@ func GetClanList(w http.ResponseWriter, r *http.Request, c app.Context) {
 	res.JSONf(w)
 }
 
+//action "all" and player id 0 disable the filter
+func AuditLog(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	action := c.Param("action")
+	if action == "all" {
+		action = ""
+	}
+	var playerID int64
+	if idStr := c.Param("player_id"); len(idStr) > 0 {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+			res.JSONf(w)
+			return
+		}
+		playerID = id
+	}
+	list, err := Audit(c, c.User, action, playerID, c.Param("cursor_key"))
+	if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: list}
+	}
+	res.JSONf(w)
+}
+
 func CancelPlayerInvite(w http.ResponseWriter, r *http.Request, c app.Context) {
 	sk := SendKey{}
 	var res app.JSONResult
@@ -76,6 +103,54 @@ func EditLeaderShip(w http.ResponseWriter, r *http.Request, c app.Context) {
 	}
 }
 
+func EditLeader(w http.ResponseWriter, r *http.Request, c app.Context) {
+	p := SendID{}
+	if err := app.DecodeJsonBody(r, &p); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
+	if err := TransferLeadership(c, c.User, p.ID); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
+func ReviewClanLeadership(w http.ResponseWriter, r *http.Request, c app.Context) {
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusForbidden, Error: "cron only"}
+		res.JSONf(w)
+		return
+	}
+	if err := ReviewLeadership(c); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
+func SnapshotClanStatistics(w http.ResponseWriter, r *http.Request, c app.Context) {
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusForbidden, Error: "cron only"}
+		res.JSONf(w)
+		return
+	}
+	if err := SnapshotClans(c); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
+func ClanStatisticsSeries(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	stats, err := Statistics(c, c.User, c.Param("bucket_name"))
+	if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: stats}
+	}
+	res.JSONf(w)
+}
+
 func KickPlayer(w http.ResponseWriter, r *http.Request, c app.Context) {
 	p := SendID{}
 	if err := app.DecodeJsonBody(r, &p); err != nil {
@@ -135,6 +210,141 @@ func LeaveClan(w http.ResponseWriter, r *http.Request, c app.Context) {
 	}
 }
 
+func DisbandClan(w http.ResponseWriter, r *http.Request, c app.Context) {
+	if err := Delete(c, c.User); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
+func ClanEmailInvite(w http.ResponseWriter, r *http.Request, c app.Context) {
+	m := SendEmail{}
+	if err := app.DecodeJsonBody(r, &m); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
+	if err := EmailInvite(c, c.User, m.Email); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
+func DepositCycles(w http.ResponseWriter, r *http.Request, c app.Context) {
+	tr := TreasuryTransfer{}
+	if err := app.DecodeJsonBody(r, &tr); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
+	if err := Deposit(c, c.User, tr.Amount); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
+func GrantCycles(w http.ResponseWriter, r *http.Request, c app.Context) {
+	tr := TreasuryTransfer{}
+	if err := app.DecodeJsonBody(r, &tr); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
+	if err := Grant(c, c.User, tr.PlayerID, tr.Amount); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
+func ProposeClanPact(w http.ResponseWriter, r *http.Request, c app.Context) {
+	p := PactProposal{}
+	if err := app.DecodeJsonBody(r, &p); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
+	if err := ProposePact(c, c.User, p.ID, p.Type); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
+func AcceptClanPact(w http.ResponseWriter, r *http.Request, c app.Context) {
+	s := SendID{}
+	if err := app.DecodeJsonBody(r, &s); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
+	if err := AcceptPact(c, c.User, s.ID); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
+func CancelClanPact(w http.ResponseWriter, r *http.Request, c app.Context) {
+	s := SendID{}
+	if err := app.DecodeJsonBody(r, &s); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
+	if err := CancelPact(c, c.User, s.ID); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
+func ApplyToClan(w http.ResponseWriter, r *http.Request, c app.Context) {
+	m := ApplicationMessage{}
+	if err := app.DecodeJsonBody(r, &m); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
+	if err := Apply(c, c.User, c.Param("clan_id"), m.Content); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
+func Applications(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	applications, err := ApplicationsForClan(c, c.User)
+	if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: applications}
+	}
+	res.JSONf(w)
+}
+
+func ApproveApplication(w http.ResponseWriter, r *http.Request, c app.Context) {
+	b := SendKey{}
+	if err := app.DecodeJsonBody(r, &b); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
+	if err := Approve(c, c.User, b.Key); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
+func RejectApplication(w http.ResponseWriter, r *http.Request, c app.Context) {
+	b := SendKey{}
+	if err := app.DecodeJsonBody(r, &b); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
+	if err := Reject(c, c.User, b.Key); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
 func JoinClan(w http.ResponseWriter, r *http.Request, c app.Context) {
 	b := SendKey{}
 	if err := app.DecodeJsonBody(r, &b); err != nil {
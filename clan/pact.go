@@ -0,0 +1,437 @@
+package clan
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+	"fmt"
+	"mj0lk.be/netwars/cache"
+	"mj0lk.be/netwars/event"
+	"mj0lk.be/netwars/player"
+	"time"
+)
+
+const (
+	ALLIANCE     int64 = 1
+	NAP          int64 = 2
+	PACTCOOLDOWN       = 48 * time.Hour //cancelled pacts stay binding
+	MAXPACTS           = 3
+)
+
+var PactName = map[int64]string{
+	ALLIANCE: "Alliance",
+	NAP:      "Non-aggression",
+}
+
+var PactError = errors.New("Clans are bound by a pact")
+
+//stored on both clans, Source proposed
+type Pact struct {
+	Type       int64     `json:"pact_type"`
+	TypeName   string    `json:"type"`
+	Player     int64     `json:"-"` //leader proposing
+	Source     int64     `json:"source"`
+	SourceName string    `json:"source_name"`
+	Target     int64     `json:"target"`
+	TargetName string    `json:"target_name"`
+	Created    time.Time `json:"created_on"`
+	Accepted   time.Time `json:"accepted_on"`
+	Active     bool      `json:"active"`
+	Expires    time.Time `json:"expires"` //set on cancel
+}
+
+type PactProposal struct {
+	ID   int64 `json:"id"` //clan id
+	Type int64 `json:"type"`
+}
+
+//called when pacts are accepted or cancelled, action: Accept or Cancel
+type PactFunc func(c appengine.Context, action string, pact Pact, source, target *datastore.Key) error
+
+var pactFuncs []PactFunc
+
+//register from init (shared alliance boards,...)
+func RegisterPactFunc(f PactFunc) {
+	pactFuncs = append(pactFuncs, f)
+}
+
+func (p Pact) Other(id int64) int64 {
+	if p.Source == id {
+		return p.Target
+	}
+	return p.Source
+}
+
+func (p Pact) Expired() bool {
+	return !p.Expires.IsZero() && p.Expires.Before(time.Now())
+}
+
+//accepted and not past the cooldown of a cancellation
+func (p Pact) Binding() bool {
+	return p.Active && !p.Expired()
+}
+
+func (cl *Clan) PactWith(id int64) (Pact, bool) {
+	for _, pact := range cl.Pacts {
+		if (pact.Source == id || pact.Target == id) && !pact.Expired() {
+			return pact, true
+		}
+	}
+	return Pact{}, false
+}
+
+//drops pacts with clan id and expired pacts
+func (cl *Clan) RemovePact(id int64) {
+	pacts := cl.Pacts[:0]
+	for _, pact := range cl.Pacts {
+		if pact.Source != id && pact.Target != id && !pact.Expired() {
+			pacts = append(pacts, pact)
+		}
+	}
+	cl.Pacts = pacts
+}
+
+func (cl *Clan) setPact(pact Pact) {
+	cl.RemovePact(pact.Other(cl.ID))
+	cl.Pacts = append(cl.Pacts, pact)
+}
+
+func (cl *Clan) Allies() []int64 {
+	allies := make([]int64, 0, len(cl.Pacts))
+	for _, pact := range cl.Pacts {
+		if pact.Type == ALLIANCE && pact.Binding() {
+			allies = append(allies, pact.Other(cl.ID))
+		}
+	}
+	return allies
+}
+
+//true when a pact between the clans forbids attacks
+func Bound(c appengine.Context, aClanKey, dClanKey *datastore.Key) (bool, error) {
+	aClan := new(Clan)
+	dClan := new(Clan)
+	if err := Get(c, aClanKey, aClan); err != nil {
+		return false, err
+	}
+	if err := Get(c, dClanKey, dClan); err != nil {
+		return false, err
+	}
+	pact, ok := aClan.PactWith(dClan.ID)
+	return ok && pact.Binding(), nil
+}
+
+//keys of the allies of teams, resolved outside transactions (query)
+func allyKeys(c appengine.Context, teams ...*Clan) (map[int64]*datastore.Key, error) {
+	keys := make(map[int64]*datastore.Key)
+	for _, team := range teams {
+		for _, ally := range team.Allies() {
+			if _, ok := keys[ally]; ok {
+				continue
+			}
+			allyKey, err := KeyByID(c, ally)
+			if err != nil {
+				return nil, err
+			}
+			keys[ally] = allyKey
+		}
+	}
+	return keys, nil
+}
+
+//copies of a war event for all allies of team, action AllyConnect,...
+func allyEvents(allies map[int64]*datastore.Key, team *Clan, e *event.Event) []*event.Event {
+	evs := make([]*event.Event, 0)
+	for _, ally := range team.Allies() {
+		allyKey, ok := allies[ally]
+		if !ok {
+			continue
+		}
+		ae := *e
+		ae.Player = nil
+		ae.Clan = allyKey
+		ae.Direction = event.IN
+		ae.Action = "Ally" + e.Action
+		evs = append(evs, &ae)
+	}
+	return evs
+}
+
+//allies follow the attacks of a war, runs in the event task (queries allowed)
+func forwardWarAttack(c appengine.Context, e *event.Event) error {
+	//ally copies have no owner
+	if e.EventType != "Attack" || e.Player == nil || e.Clan == nil || e.Target == nil {
+		return nil
+	}
+	opponent := new(player.Player)
+	if err := datastore.Get(c, e.Target, opponent); err != nil {
+		return err
+	}
+	if opponent.ClanKey == nil {
+		return nil
+	}
+	team := new(Clan)
+	other := new(Clan)
+	if err := Get(c, e.Clan, team); err != nil {
+		return err
+	}
+	if err := Get(c, opponent.ClanKey, other); err != nil {
+		return err
+	}
+	if team.ConnectionForID(other.ID).Target == 0 && other.ConnectionForID(team.ID).Target == 0 {
+		return nil
+	}
+	allies, err := allyKeys(c, team)
+	if err != nil {
+		return err
+	}
+	evs := allyEvents(allies, team, e)
+	if len(evs) == 0 {
+		return nil
+	}
+	return event.Send(c, evs, event.Func)
+}
+
+//loads leader, own clan and other clan. otherKey is resolved before the transaction
+func diplomats(c appengine.Context, playerStr string, otherKey *datastore.Key) (*datastore.Key, *player.Player,
+	*datastore.Key, *Clan, *datastore.Key, *Clan, error) {
+	iplayer := new(player.Player)
+	playerKey, err := player.Get(c, playerStr, iplayer)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, err
+	}
+	if iplayer.ClanKey == nil {
+		return nil, nil, nil, nil, nil, nil, ClanMemberError
+	}
+	if iplayer.MemberType != player.LEADER {
+		return nil, nil, nil, nil, nil, nil, errors.New("Need to be Clan leader for diplomacy")
+	}
+	if otherKey.Equal(iplayer.ClanKey) {
+		return nil, nil, nil, nil, nil, nil, errors.New("Illegal operation")
+	}
+	team := new(Clan)
+	other := new(Clan)
+	if err := datastore.GetMulti(c, []*datastore.Key{iplayer.ClanKey, otherKey},
+		[]interface{}{team, other}); err != nil {
+		return nil, nil, nil, nil, nil, nil, err
+	}
+	return playerKey, iplayer, iplayer.ClanKey, team, otherKey, other, nil
+}
+
+func pactEvents(playerKey *datastore.Key, iplayer *player.Player, clanKey *datastore.Key, team *Clan,
+	otherKey *datastore.Key, other *Clan, action string) []*event.Event {
+	created := time.Now()
+	e := &event.Event{
+		Created:    created,
+		Player:     playerKey,
+		PlayerName: iplayer.Nick,
+		PlayerID:   iplayer.ID,
+		Direction:  event.OUT,
+		EventType:  "Clan",
+		Clan:       clanKey,
+		ClanName:   team.Name,
+		ClanID:     team.ID,
+		Target:     otherKey,
+		TargetName: other.Name,
+		TargetID:   other.ID,
+		Action:     action,
+	}
+	e1 := &event.Event{
+		Created:    created,
+		EventType:  "Clan",
+		Direction:  event.IN,
+		Clan:       otherKey,
+		ClanName:   other.Name,
+		ClanID:     other.ID,
+		Target:     clanKey,
+		TargetName: team.Name,
+		TargetID:   team.ID,
+		Action:     action,
+	}
+	return []*event.Event{e, e1}
+}
+
+func ProposePact(c appengine.Context, playerStr string, targetID, pactType int64) error {
+	if _, ok := PactName[pactType]; !ok {
+		return errors.New("Unknown pact type")
+	}
+	var clanKey *datastore.Key
+	targetKey, err := KeyByID(c, targetID)
+	if err != nil {
+		return err
+	}
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var playerKey *datastore.Key
+		var iplayer *player.Player
+		var team, target *Clan
+		var err error
+		playerKey, iplayer, clanKey, team, targetKey, target, err = diplomats(c, playerStr, targetKey)
+		if err != nil {
+			return err
+		}
+		if _, ok := team.PactWith(target.ID); ok {
+			return errors.New("Already a pact or proposal with this clan")
+		}
+		if team.ConnectionForID(target.ID).Target > 0 || target.ConnectionForID(team.ID).Target > 0 {
+			return errors.New("Can't make a pact while @ war with this clan")
+		}
+		if len(team.Pacts) >= MAXPACTS || len(target.Pacts) >= MAXPACTS {
+			return errors.New("Already max pacts")
+		}
+		pact := Pact{
+			Type:       pactType,
+			TypeName:   PactName[pactType],
+			Player:     iplayer.ID,
+			Source:     team.ID,
+			SourceName: team.Name,
+			Target:     target.ID,
+			TargetName: target.Name,
+			Created:    time.Now(),
+		}
+		team.setPact(pact)
+		target.setPact(pact)
+		if _, err := datastore.PutMulti(c, []*datastore.Key{clanKey, targetKey},
+			[]interface{}{team, target}); err != nil {
+			return err
+		}
+		if err := newAuditEntry("ProposePact", iplayer, nil).target(target).save(c, clanKey); err != nil {
+			return err
+		}
+		evs := pactEvents(playerKey, iplayer, clanKey, team, targetKey, target, "ProposePact")
+		if err := event.Send(c, evs, event.Func); err != nil {
+			return err
+		}
+		return nil
+	}, options)
+	if err != nil {
+		return err
+	}
+	cache.Delete(c, clanKey.StringID()+"Clan")
+	cache.Delete(c, targetKey.StringID()+"Clan")
+	return nil
+}
+
+func AcceptPact(c appengine.Context, playerStr string, sourceID int64) error {
+	var pact Pact
+	var clanKey *datastore.Key
+	sourceKey, err := KeyByID(c, sourceID)
+	if err != nil {
+		return err
+	}
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var playerKey *datastore.Key
+		var iplayer *player.Player
+		var team, source *Clan
+		var err error
+		playerKey, iplayer, clanKey, team, sourceKey, source, err = diplomats(c, playerStr, sourceKey)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		pact, ok = team.PactWith(source.ID)
+		if !ok || pact.Active || pact.Target != team.ID {
+			return errors.New("No pact proposal found")
+		}
+		pact.Active = true
+		pact.Accepted = time.Now()
+		team.setPact(pact)
+		source.setPact(pact)
+		if _, err := datastore.PutMulti(c, []*datastore.Key{clanKey, sourceKey},
+			[]interface{}{team, source}); err != nil {
+			return err
+		}
+		if err := newAuditEntry("AcceptPact", iplayer, nil).target(source).save(c, clanKey); err != nil {
+			return err
+		}
+		evs := pactEvents(playerKey, iplayer, clanKey, team, sourceKey, source, "AcceptPact")
+		if err := event.Send(c, evs, event.Func); err != nil {
+			return err
+		}
+		return nil
+	}, options)
+	if err != nil {
+		return err
+	}
+	cache.Delete(c, clanKey.StringID()+"Clan")
+	cache.Delete(c, sourceKey.StringID()+"Clan")
+	for _, f := range pactFuncs {
+		if err := f(c, "Accept", pact, sourceKey, clanKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//withdraws or rejects a proposal, an accepted pact stays binding for PACTCOOLDOWN
+func CancelPact(c appengine.Context, playerStr string, otherID int64) error {
+	var pact Pact
+	var clanKey *datastore.Key
+	otherKey, err := KeyByID(c, otherID)
+	if err != nil {
+		return err
+	}
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var playerKey *datastore.Key
+		var iplayer *player.Player
+		var team, other *Clan
+		var err error
+		playerKey, iplayer, clanKey, team, otherKey, other, err = diplomats(c, playerStr, otherKey)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		pact, ok = team.PactWith(other.ID)
+		if !ok {
+			return errors.New("No pact found")
+		}
+		action := "CancelPact"
+		if !pact.Active {
+			team.RemovePact(other.ID)
+			other.RemovePact(team.ID)
+			action = "RejectPact"
+		} else if !pact.Expires.IsZero() {
+			return errors.New(fmt.Sprintf("Pact already cancelled, expires %s", pact.Expires))
+		} else {
+			pact.Expires = time.Now().Add(PACTCOOLDOWN)
+			team.setPact(pact)
+			other.setPact(pact)
+		}
+		if _, err := datastore.PutMulti(c, []*datastore.Key{clanKey, otherKey},
+			[]interface{}{team, other}); err != nil {
+			return err
+		}
+		if err := newAuditEntry(action, iplayer, nil).target(other).save(c, clanKey); err != nil {
+			return err
+		}
+		evs := pactEvents(playerKey, iplayer, clanKey, team, otherKey, other, action)
+		for _, e := range evs {
+			e.Expires = pact.Expires
+		}
+		if err := event.Send(c, evs, event.Func); err != nil {
+			return err
+		}
+		return nil
+	}, options)
+	if err != nil {
+		return err
+	}
+	cache.Delete(c, clanKey.StringID()+"Clan")
+	cache.Delete(c, otherKey.StringID()+"Clan")
+	if pact.Active {
+		sourceKey, targetKey := clanKey, otherKey
+		if pact.Source == otherID {
+			sourceKey, targetKey = otherKey, clanKey
+		}
+		for _, f := range pactFuncs {
+			if err := f(c, "Cancel", pact, sourceKey, targetKey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package clan
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"mj0lk.be/netwars/cache"
+	"mj0lk.be/netwars/event"
+)
+
+//new season: wars and treasury are dropped, members, pacts and profile are kept
+func Reset(c appengine.Context, clanKey *datastore.Key) error {
+	team := new(Clan)
+	if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Get(c, clanKey, team); err != nil {
+			return err
+		}
+		team.Wars = nil
+		team.Treasury = 0
+		team.Transactions = nil
+		team.Ledger = nil
+		team.Cps = 0
+		team.BandwidthUsage = 0
+		trackerKeys, err := datastore.NewQuery("Tracker").Ancestor(clanKey).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		keys := append([]*datastore.Key{clanKey}, trackerKeys...)
+		models := []interface{}{team}
+		for range trackerKeys {
+			models = append(models, new(event.Tracker))
+		}
+		if _, err := datastore.PutMulti(c, keys, models); err != nil {
+			return err
+		}
+		return nil
+	}, nil); err != nil {
+		return err
+	}
+	cache.Delete(c, clanKey.StringID()+"Clan")
+	cache.Delete(c, fmt.Sprintf("%d", team.ID))
+	return nil
+}
@@ -0,0 +1,135 @@
+package clan
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"errors"
+	"mj0lk.be/netwars/player"
+	"time"
+)
+
+const (
+	HOURLY       = "hourly"
+	DAILY        = "daily"
+	HOURLYKEEP   = 7 * 24 * time.Hour //hourly snapshots older than this are dropped
+	HOURLYPOINTS = 168
+	DAILYPOINTS  = 90
+)
+
+var bucketPoints = map[string]int{
+	HOURLY: HOURLYPOINTS,
+	DAILY:  DAILYPOINTS,
+}
+
+var snapshotClanFunc = delay.Func("snapshotClan", snapshotClan)
+
+type MemberSnapshot struct {
+	PlayerID       int64   `datastore:",noindex" json:"player_id"`
+	Nick           string  `datastore:",noindex" json:"nick"`
+	BandwidthUsage float64 `datastore:",noindex" json:"bandwidth_usage"`
+	Cps            int64   `datastore:",noindex" json:"cps"`
+}
+
+//parent clan
+type ClanSnapshot struct {
+	Bucket         string           `json:"-"`
+	Created        time.Time        `json:"created"`
+	BandwidthUsage float64          `datastore:",noindex" json:"bandwidth_usage"`
+	Cps            int64            `datastore:",noindex" json:"cps"`
+	AmountPlayers  int64            `datastore:",noindex" json:"amount_players"`
+	Wars           int64            `datastore:",noindex" json:"wars"`
+	Members        []MemberSnapshot `json:"members"`
+}
+
+type ClanStatistics struct {
+	Bucket string         `json:"bucket"`
+	Points []ClanSnapshot `json:"points"`
+}
+
+//cron, hourly snapshot of every clan, daily one on the first run of the day
+func SnapshotClans(c appengine.Context) error {
+	keys, err := datastore.NewQuery("Clan").KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	daily := time.Now().UTC().Hour() == 0
+	for _, clanKey := range keys {
+		snapshotClanFunc.Call(c, clanKey, HOURLY)
+		if daily {
+			snapshotClanFunc.Call(c, clanKey, DAILY)
+		}
+	}
+	return nil
+}
+
+func snapshotClan(c appengine.Context, clanKey *datastore.Key, bucket string) error {
+	team := new(Clan)
+	if err := datastore.Get(c, clanKey, team); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		return err
+	}
+	if err := loadClanMembers(c, clanKey, team); err != nil {
+		return err
+	}
+	now := time.Now()
+	snapshot := &ClanSnapshot{
+		Bucket:         bucket,
+		Created:        now,
+		BandwidthUsage: team.BandwidthUsage,
+		Cps:            team.Cps,
+		AmountPlayers:  team.AmountPlayers,
+		Wars:           int64(len(team.Wars)),
+		Members:        make([]MemberSnapshot, 0, len(team.Members)),
+	}
+	for _, member := range team.Members {
+		if member.DbKey == nil {
+			continue
+		}
+		snapshot.Members = append(snapshot.Members, MemberSnapshot{
+			PlayerID:       member.ID,
+			Nick:           member.Nick,
+			BandwidthUsage: member.BandwidthUsage,
+			Cps:            member.Cps,
+		})
+	}
+	if _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "ClanSnapshot", clanKey), snapshot); err != nil {
+		return err
+	}
+	if bucket != HOURLY {
+		return nil
+	}
+	oldKeys, err := datastore.NewQuery("ClanSnapshot").Ancestor(clanKey).Filter("Bucket =", HOURLY).
+		Filter("Created <", now.Add(-HOURLYKEEP)).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	return datastore.DeleteMulti(c, oldKeys)
+}
+
+//timeseries for the players clan, oldest first
+func Statistics(c appengine.Context, playerStr, bucket string) (ClanStatistics, error) {
+	points, ok := bucketPoints[bucket]
+	if !ok {
+		return ClanStatistics{}, errors.New("Unknown bucket, use hourly or daily")
+	}
+	iplayer := new(player.Player)
+	if _, err := player.Get(c, playerStr, iplayer); err != nil {
+		return ClanStatistics{}, err
+	}
+	if iplayer.ClanKey == nil {
+		return ClanStatistics{}, ClanMemberError
+	}
+	snapshots := make([]ClanSnapshot, 0, points)
+	q := datastore.NewQuery("ClanSnapshot").Ancestor(iplayer.ClanKey).Filter("Bucket =", bucket).
+		Order("-Created").Limit(points)
+	if _, err := q.GetAll(c, &snapshots); err != nil {
+		return ClanStatistics{}, err
+	}
+	for i, j := 0, len(snapshots)-1; i < j; i, j = i+1, j-1 {
+		snapshots[i], snapshots[j] = snapshots[j], snapshots[i]
+	}
+	return ClanStatistics{bucket, snapshots}, nil
+}
@@ -0,0 +1,197 @@
+package clan
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+	"fmt"
+	"mj0lk.be/netwars/config"
+	"mj0lk.be/netwars/event"
+	"mj0lk.be/netwars/player"
+	"time"
+)
+
+const TREASURYLOG = 25 //transactions kept on the clan
+
+//cycles a rank can grant per day
+var GrantLimit = map[int64]int64{
+	player.LIEUTENANT: 5000,
+	player.LEADER:     20000,
+}
+
+type TreasuryTransfer struct {
+	PlayerID int64 `json:"player_id"` //grant target, ignored for deposits
+	Amount   int64 `json:"amount"`
+}
+
+type TreasuryTransaction struct {
+	Action     string    `json:"action"`
+	PlayerID   int64     `json:"player_id"`
+	PlayerName string    `json:"player_name"`
+	TargetID   int64     `json:"target_id"`
+	TargetName string    `json:"target_name"`
+	Amount     int64     `json:"amount"`
+	Created    time.Time `json:"created"`
+}
+
+//parent clan, keyname: player
+type TreasuryAccount struct {
+	Day     time.Time `datastore:",noindex"`
+	Granted int64     `datastore:",noindex"`
+}
+
+func (cl *Clan) logTransaction(t TreasuryTransaction) {
+	cl.Transactions = append([]TreasuryTransaction{t}, cl.Transactions...)
+	if len(cl.Transactions) > TREASURYLOG {
+		cl.Transactions = cl.Transactions[:TREASURYLOG]
+	}
+}
+
+func treasuryEvent(clanKey *datastore.Key, team *Clan, playerKey *datastore.Key, iplayer *player.Player,
+	t TreasuryTransaction) *event.Event {
+	return &event.Event{
+		Created:    t.Created,
+		Player:     playerKey,
+		PlayerName: iplayer.Nick,
+		PlayerID:   iplayer.ID,
+		EventType:  "Clan",
+		Clan:       clanKey,
+		ClanName:   team.Name,
+		ClanID:     team.ID,
+		TargetName: t.TargetName,
+		TargetID:   t.TargetID,
+		Action:     t.Action,
+		Direction:  event.OUT,
+	}
+}
+
+func Deposit(c appengine.Context, playerStr string, amount int64) error {
+	if amount <= 0 {
+		return errors.New("Invalid amount")
+	}
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return err
+	}
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		iplayer := new(player.Player)
+		if err := datastore.Get(c, playerKey, iplayer); err != nil {
+			return err
+		}
+		if iplayer.ClanKey == nil {
+			return ClanMemberError
+		}
+		if iplayer.Cycles < amount {
+			return errors.New("Not enough cycles")
+		}
+		team := new(Clan)
+		if err := datastore.Get(c, iplayer.ClanKey, team); err != nil {
+			return err
+		}
+		iplayer.Cycles -= amount
+		team.Treasury += amount
+		t := TreasuryTransaction{
+			Action:     "Deposit",
+			PlayerID:   iplayer.ID,
+			PlayerName: iplayer.Nick,
+			Amount:     amount,
+			Created:    time.Now(),
+		}
+		team.logTransaction(t)
+		if _, err := datastore.PutMulti(c, []*datastore.Key{playerKey, iplayer.ClanKey},
+			[]interface{}{iplayer, team}); err != nil {
+			return err
+		}
+		e := treasuryEvent(iplayer.ClanKey, team, playerKey, iplayer, t)
+		e.Cycles = amount
+		if err := event.Send(c, []*event.Event{e}, event.Func); err != nil {
+			return err
+		}
+		return nil
+	}, options)
+}
+
+func Grant(c appengine.Context, playerStr string, targetID, amount int64) error {
+	if amount <= 0 {
+		return errors.New("Invalid amount")
+	}
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return err
+	}
+	targetKey, err := player.KeyByID(c, targetID)
+	if err != nil {
+		return err
+	}
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		iplayer := new(player.Player)
+		target := new(player.Player)
+		if err := datastore.GetMulti(c, []*datastore.Key{playerKey, targetKey},
+			[]interface{}{iplayer, target}); err != nil {
+			return err
+		}
+		if iplayer.ClanKey == nil || target.ClanKey == nil {
+			return ClanMemberError
+		}
+		if !target.ClanKey.Equal(iplayer.ClanKey) {
+			return errors.New("Illegal operation")
+		}
+		if iplayer.MemberType < player.LIEUTENANT {
+			return ClanMemberTypeError
+		}
+		team := new(Clan)
+		if err := datastore.Get(c, iplayer.ClanKey, team); err != nil {
+			return err
+		}
+		if team.Treasury < amount {
+			return errors.New("Not enough cycles in treasury")
+		}
+		maxCycles := config.Get().Player.Cycles.Max
+		if target.Cycles+amount > maxCycles {
+			return errors.New(fmt.Sprintf("Player can receive max %d cycles", maxCycles-target.Cycles))
+		}
+		now := time.Now()
+		today := now.Truncate(24 * time.Hour)
+		accountKey := datastore.NewKey(c, "TreasuryAccount", playerKey.StringID(), 0, iplayer.ClanKey)
+		account := new(TreasuryAccount)
+		if err := datastore.Get(c, accountKey, account); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if !account.Day.Equal(today) {
+			account.Day = today
+			account.Granted = 0
+		}
+		if account.Granted+amount > GrantLimit[iplayer.MemberType] {
+			return errors.New(fmt.Sprintf("Daily grant limit reached, %d left",
+				GrantLimit[iplayer.MemberType]-account.Granted))
+		}
+		account.Granted += amount
+		team.Treasury -= amount
+		target.Cycles += amount
+		t := TreasuryTransaction{
+			Action:     "Grant",
+			PlayerID:   iplayer.ID,
+			PlayerName: iplayer.Nick,
+			TargetID:   target.ID,
+			TargetName: target.Nick,
+			Amount:     amount,
+			Created:    now,
+		}
+		team.logTransaction(t)
+		if _, err := datastore.PutMulti(c, []*datastore.Key{targetKey, iplayer.ClanKey, accountKey},
+			[]interface{}{target, team, account}); err != nil {
+			return err
+		}
+		e := treasuryEvent(iplayer.ClanKey, team, playerKey, iplayer, t)
+		e.Target = targetKey
+		e.CyclesGained = amount
+		if err := event.Send(c, []*event.Event{e}, event.Func); err != nil {
+			return err
+		}
+		return nil
+	}, options)
+}
@@ -0,0 +1,214 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mj0lk.be/netwars/app"
+	"os"
+	"sync"
+)
+
+//balance.json in the application root overrides the defaults
+const BALANCEFILE = "balance"
+
+//timed resource regeneration, Amount every Interval minutes up to Max
+type Regen struct {
+	Interval int64 `json:"interval"`
+	Amount   int64 `json:"amount"`
+	Max      int64 `json:"max"`
+}
+
+//success and visual (detected) chances in pct, defense moves them towards the limits
+type Chance struct {
+	Max       float64 `json:"max"`
+	Min       float64 `json:"min"`
+	VisualMax float64 `json:"visual_max"`
+	VisualMin float64 `json:"visual_min"`
+}
+
+//applied to every infection on each cron tick
+type Infection struct {
+	CycleDrain int64   `json:"cycle_drain"` //cycles per infect unit
+	Growth     float64 `json:"growth"`      //part of the infect units added, the host loses the bandwidth
+	Spread     float64 `json:"spread"`      //pct chance to jump to a clanmate
+}
+
+type PlayerBalance struct {
+	MemYield     float64 `json:"mem_yield"`   //part of memory returned on deallocation
+	CycleYield   float64 `json:"cycle_yield"` //part of cycles returned on deallocation
+	BwLowLimit   float64 `json:"bw_low_limit"`
+	BwHiLimit    float64 `json:"bw_hi_limit"`
+	StartMem     int64   `json:"start_memory"`
+	StartCycles  int64   `json:"start_cycles"`
+	Cycles       Regen   `json:"cycles"`
+	Memory       Regen   `json:"memory"`
+	ActiveMemory Regen   `json:"active_memory"`
+	//a player attacked below both thresholds dies
+	DeathBandwidth   float64 `json:"death_bandwidth"`
+	DeathConnections int64   `json:"death_connections"`
+}
+
+type AttackBalance struct {
+	CycleTransfer    float64   `json:"cycle_transfer"` //part of defender cycles won on a successful attack
+	Intelligence     Chance    `json:"intelligence"`
+	Ice              Chance    `json:"ice"`
+	NewbieProtection int64     `json:"newbie_protection"` //hours after creation an account can't be attacked
+	HitProtection    int64     `json:"hit_protection"`    //minutes a player can't be attacked after a lost defense
+	Cooldown         int64     `json:"cooldown"`          //minutes between attacks of one type on the same target
+	Infection        Infection `json:"infection"`
+}
+
+type ClanBalance struct {
+	RangeUp       float64 `json:"range_up"`
+	RangeDown     float64 `json:"range_down"`
+	MaxMember     int64   `json:"max_member"`
+	MaxInvites    int64   `json:"max_invites"`
+	MaxLeadership int64   `json:"max_leadership"`
+}
+
+type Balance struct {
+	Player PlayerBalance `json:"player"`
+	Attack AttackBalance `json:"attack"`
+	Clan   ClanBalance   `json:"clan"`
+}
+
+var Default = Balance{
+	Player: PlayerBalance{
+		MemYield:         0.4,
+		CycleYield:       0.5,
+		BwLowLimit:       0.2,
+		BwHiLimit:        0.3,
+		StartMem:         50,
+		StartCycles:      1000,
+		Cycles:           Regen{15, 50, 50000},
+		Memory:           Regen{15, 1, 300},
+		ActiveMemory:     Regen{60, 2, 10},
+		DeathBandwidth:   1,
+		DeathConnections: 1,
+	},
+	Attack: AttackBalance{
+		CycleTransfer:    0.1,
+		Intelligence:     Chance{80, 40, 90, 50},
+		Ice:              Chance{90, 50, 90, 50},
+		NewbieProtection: 72,
+		HitProtection:    30,
+		Cooldown:         60,
+		Infection:        Infection{2, 0.1, 10},
+	},
+	Clan: ClanBalance{
+		RangeUp:       0.3,
+		RangeDown:     0.2,
+		MaxMember:     6,
+		MaxInvites:    3,
+		MaxLeadership: 3,
+	},
+}
+
+var (
+	lock    sync.RWMutex
+	current = Default
+)
+
+func init() {
+	balance, err := load(BALANCEFILE)
+	if err != nil {
+		panic(fmt.Sprintf("invalid balance file: %s", err))
+	}
+	current = balance
+}
+
+//missing file gives the defaults, fields absent from the file keep their default
+func load(name string) (Balance, error) {
+	balance := Default
+	file, err := app.LoadFile(name)
+	if os.IsNotExist(err) {
+		return balance, nil
+	} else if err != nil {
+		return balance, err
+	}
+	if err := json.Unmarshal(file, &balance); err != nil {
+		return balance, err
+	}
+	return balance, balance.Validate()
+}
+
+//read only copy of the rules in use
+func Get() Balance {
+	lock.RLock()
+	defer lock.RUnlock()
+	return current
+}
+
+//switch rule set (test worlds)
+func Use(balance Balance) error {
+	if err := balance.Validate(); err != nil {
+		return err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	current = balance
+	return nil
+}
+
+func fraction(name string, value float64) string {
+	if value < 0 || value > 1 {
+		return fmt.Sprintf("%s must be between 0 and 1\n", name)
+	}
+	return ""
+}
+
+func (r Regen) validate(name string) string {
+	if r.Interval <= 0 || r.Amount < 0 || r.Max <= 0 {
+		return fmt.Sprintf("%s needs a positive interval and max\n", name)
+	}
+	return ""
+}
+
+func (ch Chance) validate(name string) string {
+	if ch.Min < 0 || ch.Max > 100 || ch.Min > ch.Max || ch.VisualMin < 0 || ch.VisualMax > 100 ||
+		ch.VisualMin > ch.VisualMax {
+		return fmt.Sprintf("%s chances must be 0 <= min <= max <= 100\n", name)
+	}
+	return ""
+}
+
+func (b Balance) Validate() error {
+	var errString string
+	errString += fraction("player.mem_yield", b.Player.MemYield)
+	errString += fraction("player.cycle_yield", b.Player.CycleYield)
+	errString += fraction("player.bw_low_limit", b.Player.BwLowLimit)
+	if b.Player.BwHiLimit < 0 {
+		errString += "player.bw_hi_limit can't be negative\n"
+	}
+	if b.Player.StartMem < 0 || b.Player.StartCycles < 0 {
+		errString += "player start resources can't be negative\n"
+	}
+	errString += b.Player.Cycles.validate("player.cycles")
+	errString += b.Player.Memory.validate("player.memory")
+	errString += b.Player.ActiveMemory.validate("player.active_memory")
+	if b.Player.DeathBandwidth < 0 || b.Player.DeathConnections < 0 {
+		errString += "player death thresholds can't be negative\n"
+	}
+	errString += fraction("attack.cycle_transfer", b.Attack.CycleTransfer)
+	errString += b.Attack.Intelligence.validate("attack.intelligence")
+	errString += b.Attack.Ice.validate("attack.ice")
+	if b.Attack.NewbieProtection < 0 || b.Attack.HitProtection < 0 || b.Attack.Cooldown < 0 {
+		errString += "attack protection and cooldown can't be negative\n"
+	}
+	if b.Attack.Infection.CycleDrain < 0 || b.Attack.Infection.Growth < 0 || b.Attack.Infection.Spread < 0 ||
+		b.Attack.Infection.Spread > 100 {
+		errString += "attack.infection needs positive drain and growth and a spread chance of 0 to 100\n"
+	}
+	errString += fraction("clan.range_down", b.Clan.RangeDown)
+	if b.Clan.RangeUp < 0 {
+		errString += "clan.range_up can't be negative\n"
+	}
+	if b.Clan.MaxMember < 1 || b.Clan.MaxLeadership < 1 || b.Clan.MaxInvites < 0 {
+		errString += "clan needs max_member and max_leadership of at least 1\n"
+	}
+	if len(errString) > 0 {
+		return errors.New(errString)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	balance, err := load("missing balance")
+	if err != nil {
+		t.Fatalf("missing file error: %s", err)
+	}
+	if balance.Player.StartCycles != Default.Player.StartCycles {
+		t.Fatalf("expected defaults, got %+v", balance)
+	}
+}
+
+func TestUse(t *testing.T) {
+	defer Use(Default)
+	invalid := Default
+	invalid.Attack.Intelligence.Min = 90
+	if err := Use(invalid); err == nil {
+		t.Fatalf("expected min > max chance error")
+	}
+	invalid = Default
+	invalid.Player.Cycles.Interval = 0
+	if err := Use(invalid); err == nil {
+		t.Fatalf("expected regen interval error")
+	}
+	world := Default
+	world.Clan.MaxMember = 12
+	if err := Use(world); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if Get().Clan.MaxMember != 12 {
+		t.Fatalf("rule set not in use")
+	}
+}
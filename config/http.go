@@ -0,0 +1,11 @@
+package config
+
+import (
+	"mj0lk.be/netwars/app"
+	"net/http"
+)
+
+func GetBalance(w http.ResponseWriter, r *http.Request, c app.Context) {
+	res := app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: Get()}
+	res.JSONf(w)
+}
@@ -4,6 +4,7 @@ import (
 	"appengine"
 	"appengine/datastore"
 	"appengine/delay"
+	"appengine/mail"
 	"appengine/taskqueue"
 	"bytes"
 	"encoding/gob"
@@ -24,6 +25,7 @@ const (
 	HTML             = "HTML"
 	LOCAL            = "Player"
 	GLOBAL           = "Clan"
+	MAILSENDER       = "Netwars <n3twars@jainware.be>"
 )
 
 var (
@@ -37,8 +39,11 @@ var (
 		"OUT": 1,
 	}
 
-	invite_tmpl = template.Must(template.ParseFiles("email_templates/Invite_email.tmpl"))
-	//invite_tmpl = template.Must(template.ParseFiles("../event/Invite_email.tmpl")) //testing
+	invite_tmpl = template.Must(template.ParseFiles("email_templates/Invite_email.tmpl",
+		"email_templates/EmailInvite_email.tmpl"))
+	//invite_tmpl = template.Must(template.ParseFiles("../event/Invite_email.tmpl", "../event/EmailInvite_email.tmpl")) //testing
+
+	sendMailFunc = delay.Func("sendMail", sendMail)
 )
 
 //CLAN parent: clan  key: playerkey
@@ -66,6 +71,8 @@ type EventProgram struct {
 	YieldLost        int64          `json:"yield_lost" datastore:",noindex`
 	Power            bool           `datastore:",noindex" json:"power"`
 	VDamageReceived  int64          `datastore:",noindex" json:"-"`
+	Level            int64          `datastore:",noindex" json:"level"`
+	ExpGained        int64          `datastore:",noindex" json:"exp_gained"`
 }
 
 // convention:
@@ -104,6 +111,7 @@ type Event struct {
 	EventPrograms     []EventProgram `json:"active_programs" datastore:"-"`
 	Eprogs            []byte         `json:"-" datastore:",noindex"`
 	VDamageReceived   int64          `datastore:",noindex" json:"-"`
+	Reason            string         `datastore:",noindex" json:"reason"` //why an action failed
 	GUID              string         `datastore:"-" json:"-"`
 }
 
@@ -160,6 +168,31 @@ func (e Event) CreateEmail(email string) (*taskqueue.Task, error) {
 
 }
 
+func sendMail(c appengine.Context, notif Email) error {
+	msg := &mail.Message{
+		Sender:   MAILSENDER,
+		To:       []string{notif.Email},
+		Subject:  notif.Subject,
+		HTMLBody: notif.Content,
+	}
+	return mail.Send(c, msg)
+}
+
+//templated email to an address without notification settings (not a player yet)
+func SendEmail(c appengine.Context, email, subject, tmpl string, data interface{}) error {
+	buf := new(bytes.Buffer)
+	if err := invite_tmpl.ExecuteTemplate(buf, tmpl+"_email", data); err != nil {
+		return err
+	}
+	notif := Email{
+		Email:   email,
+		Subject: "Netwars :" + subject,
+		Content: buf.String(),
+	}
+	sendMailFunc.Call(c, notif)
+	return nil
+}
+
 func (e Event) CreatePush() {
 
 }
@@ -190,6 +223,16 @@ func (e *Event) Save(c chan<- datastore.Property) error {
 
 type EventFunc func(c appengine.Context, events []*Event) error
 
+//called for every persisted event, statistics, achievements,...
+type Handler func(c appengine.Context, e *Event) error
+
+var handlers []Handler
+
+//register from init
+func Handle(h Handler) {
+	handlers = append(handlers, h)
+}
+
 func (event *Event) Email() {
 
 	//load template for eventtype
@@ -238,6 +281,14 @@ func Func(c appengine.Context, events []*Event) error {
 		for n := 0; n < evCnt; n++ {
 			<-notifyCh
 		}
+		//events are stored, handler errors must not retry the task
+		for _, ev := range events {
+			for _, h := range handlers {
+				if err := h(c, ev); err != nil {
+					c.Errorf("error handling event %d %s: %s", ev.ID, ev.EventType, err)
+				}
+			}
+		}
 	}
 	return nil
 
@@ -40,6 +40,17 @@ func ListClanBoards(w http.ResponseWriter, r *http.Request, c app.Context) {
 	res.JSONf(w)
 }
 
+func ListAllianceBoards(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	boards, err := AllianceBoards(c, c.User, c.Param("cursor_key"))
+	if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: boards}
+	}
+	res.JSONf(w)
+}
+
 func ListThreads(w http.ResponseWriter, r *http.Request, c app.Context) {
 	list(w, r, "threads", c)
 }
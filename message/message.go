@@ -4,6 +4,7 @@ import (
 	"appengine"
 	"appengine/datastore"
 	"errors"
+	"mj0lk.be/netwars/clan"
 	"mj0lk.be/netwars/counter"
 	//"mj0lk.be/netwars/event"
 	"mj0lk.be/netwars/guid"
@@ -18,6 +19,9 @@ const (
 	PRIVATE int64 = 1 << iota
 )
 
+//board shared by allied clans
+const ALLIANCE int64 = 1 << 3
+
 var AccessName = map[int64]string{
 	PUBLIC:                            "Public",
 	player.ADMIN:                      "Mod",
@@ -38,30 +42,40 @@ type MessageList struct {
 }
 
 type Message struct {
-	DbKey       *datastore.Key `datastore:"-" json:"-"`
-	EncodedKey  string         `datastore:"-" json:"message_key"`
-	PID         int64          `json:"pid" datastore:"-"`  //personal message recipient
-	Bkey        string         `datastore:"-" json:"bkey"` // board id
-	Tkey        string         `datastore:"-" json:"tkey"` // thread id
-	Skey        string         `datastore:"-" json:"skey"`
-	Creator     *datastore.Key `json:"-"`
-	Clan        *datastore.Key `json:"-"`
-	Scope       int64          `json:"scope"` // message container
-	Created     time.Time      `json:"created"`
-	MessageID   int64          `datastore:",noindex" json:"message_id"`
-	Content     string         `datastore:",noindex" json:"content"`
-	Signature   string         `datastore:",noindex" json:"signature"`
-	AvatarThumb string         `datastore:",noindex" json:"avatar_thumb"`
-	PlayerName  string         `datastore:",noindex" json:"player_name"`
-	PlayerID    int64          `json:"player_id"`
-	Subject     string         `datastore:",noindex" json:"subject"`
-	IsThread    bool           `json:"-"`
-	IsBoard     bool           `json:"-"`
-	IsDeleted   bool           `json:"-"`
-	Access      int64          `json:"-"`
-	AccessName  string         `datastore:"-" json:"access"`
-	Recipient   *datastore.Key `json:"-"`
-	Board       *datastore.Key `json:"-"`
+	DbKey        *datastore.Key `datastore:"-" json:"-"`
+	EncodedKey   string         `datastore:"-" json:"message_key"`
+	PID          int64          `json:"pid" datastore:"-"`  //personal message recipient
+	Bkey         string         `datastore:"-" json:"bkey"` // board id
+	Tkey         string         `datastore:"-" json:"tkey"` // thread id
+	Skey         string         `datastore:"-" json:"skey"`
+	Creator      *datastore.Key `json:"-"`
+	Clan         *datastore.Key `json:"-"`
+	ArchivedClan *datastore.Key `json:"-"`     //clan the board belonged to before disbanding
+	Scope        int64          `json:"scope"` // message container
+	Created      time.Time      `json:"created"`
+	MessageID    int64          `datastore:",noindex" json:"message_id"`
+	Content      string         `datastore:",noindex" json:"content"`
+	Signature    string         `datastore:",noindex" json:"signature"`
+	AvatarThumb  string         `datastore:",noindex" json:"avatar_thumb"`
+	PlayerName   string         `datastore:",noindex" json:"player_name"`
+	PlayerID     int64          `json:"player_id"`
+	Subject      string         `datastore:",noindex" json:"subject"`
+	IsThread     bool           `json:"-"`
+	IsBoard      bool           `json:"-"`
+	IsDeleted    bool           `json:"-"`
+	Access       int64          `json:"-"`
+	AccessName   string         `datastore:"-" json:"access"`
+	Recipient    *datastore.Key `json:"-"`
+	Board        *datastore.Key `json:"-"`
+
+	//alliance boards
+	Clans         []*datastore.Key `json:"-"`
+	ArchivedClans []*datastore.Key `json:"-"`
+}
+
+func init() {
+	clan.RegisterDisbandFunc(ArchiveClanBoards)
+	clan.RegisterPactFunc(allianceBoard)
 }
 
 func newMessageID(c appengine.Context, cntCh chan<- int64) {
@@ -286,6 +300,128 @@ func ClanBoards(c appengine.Context, playerStr, cursorStr string) (MessageList,
 	return list, nil
 }
 
+func AllianceBoards(c appengine.Context, playerStr, cursorStr string) (MessageList, error) {
+	iplayer := new(player.Player)
+	_, err := player.Get(c, playerStr, iplayer)
+	if err != nil {
+		return MessageList{}, err
+	}
+	if iplayer.ClanKey == nil {
+		return MessageList{}, errors.New("Cannot load alliance boards")
+	}
+	list := newMessageList()
+	var cnt int
+	q := datastore.NewQuery("Message").Filter("Clans =", iplayer.ClanKey).Filter("IsBoard =", true).
+		Filter("Scope =", ALLIANCE).Filter("IsDeleted =", false).Limit(20)
+	if err := addCursor(cursorStr, q); err != nil {
+		return MessageList{}, err
+	}
+	it := q.Run(c)
+	for {
+		var msg Message
+		key, err := it.Next(&msg)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return MessageList{}, err
+		}
+		msg.EncodedKey = key.Encode()
+		list.Messages[cnt] = msg
+		cnt++
+	}
+	newCursor, err := it.Cursor()
+	if err != nil {
+		return MessageList{}, err
+	}
+	list.Messages = list.Messages[:cnt]
+	list.Cursor = newCursor.String()
+	return list, nil
+}
+
+//opens a shared board for accepted alliances, archives it when cancelled
+func allianceBoard(c appengine.Context, action string, pact clan.Pact, source, target *datastore.Key) error {
+	if pact.Type != clan.ALLIANCE {
+		return nil
+	}
+	switch action {
+	case "Accept":
+		idCnt := make(chan int64, 1)
+		go newMessageID(c, idCnt)
+		boardGuid, err := guid.GenUUID()
+		if err != nil {
+			return err
+		}
+		board := &Message{
+			Clans:     []*datastore.Key{source, target},
+			Scope:     ALLIANCE,
+			IsBoard:   true,
+			Created:   time.Now(),
+			Subject:   pact.SourceName + " & " + pact.TargetName,
+			Access:    AccessType["Clan"],
+			MessageID: <-idCnt,
+		}
+		if _, err := datastore.Put(c, datastore.NewKey(c, "Message", boardGuid, 0, nil), board); err != nil {
+			return err
+		}
+	case "Cancel":
+		return archiveAllianceBoards(c, source, target)
+	}
+	return nil
+}
+
+//archives alliance boards of clanKey, only those shared with other when given
+func archiveAllianceBoards(c appengine.Context, clanKey, other *datastore.Key) error {
+	q := datastore.NewQuery("Message").Filter("Clans =", clanKey).Filter("Scope =", ALLIANCE)
+	var boards []Message
+	keys, err := q.GetAll(c, &boards)
+	if err != nil {
+		return err
+	}
+	archive := make([]Message, 0, len(boards))
+	archiveKeys := make([]*datastore.Key, 0, len(keys))
+	for i, board := range boards {
+		shared := other == nil
+		for _, k := range board.Clans {
+			shared = shared || k.Equal(other)
+		}
+		if !shared {
+			continue
+		}
+		board.ArchivedClans = board.Clans
+		board.Clans = nil
+		archive = append(archive, board)
+		archiveKeys = append(archiveKeys, keys[i])
+	}
+	if len(archiveKeys) == 0 {
+		return nil
+	}
+	if _, err := datastore.PutMulti(c, archiveKeys, archive); err != nil {
+		return err
+	}
+	return nil
+}
+
+//boards of a disbanded clan are kept but detached from the clan
+func ArchiveClanBoards(c appengine.Context, clanKey *datastore.Key) error {
+	q := datastore.NewQuery("Message").Filter("Clan =", clanKey).Filter("IsBoard =", true)
+	var boards []Message
+	keys, err := q.GetAll(c, &boards)
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		for i := range boards {
+			boards[i].ArchivedClan = clanKey
+			boards[i].Clan = nil
+		}
+		if _, err := datastore.PutMulti(c, keys, boards); err != nil {
+			return err
+		}
+	}
+	return archiveAllianceBoards(c, clanKey, nil)
+}
+
 func threadQuery(boardKey *datastore.Key) *datastore.Query {
 	return datastore.NewQuery("Message").Filter("Board =", boardKey).Filter("IsDeleted =", false).
 		Filter("IsThread =", true).Order("-Created").Limit(40)
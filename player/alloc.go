@@ -5,6 +5,7 @@ import (
 	"appengine/datastore"
 	"errors"
 	"math"
+	"mj0lk.be/netwars/config"
 	"mj0lk.be/netwars/event"
 	"mj0lk.be/netwars/program"
 	"time"
@@ -32,7 +33,11 @@ func Allocate(c appengine.Context, playerStr string, alloc Allocation) error {
 		return err
 	}
 	iAmount := alloc.Amount
-	prog, err := program.KeyGet(c, programKey)
+	version, err := program.Version(c)
+	if err != nil {
+		return err
+	}
+	prog, err := program.KeyGet(c, programKey, version)
 	if err != nil {
 		return err
 	}
@@ -45,6 +50,9 @@ func Allocate(c appengine.Context, playerStr string, alloc Allocation) error {
 		if err := Status(c, playerStr, iplayer); err != nil {
 			return err
 		}
+		if err := iplayer.Unlocked(c, prog); err != nil {
+			return err
+		}
 		mCost := prog.Memory * float64(iAmount)
 		cCost := prog.Cycles * iAmount
 		if cCost > iplayer.Cycles {
@@ -116,7 +124,11 @@ func Deallocate(c appengine.Context, playerKeyStr string, alloc Allocation) erro
 	programKey, _ := datastore.DecodeKey(alloc.PrgKey)
 	playerKey, _ := datastore.DecodeKey(playerKeyStr)
 	iAmount := alloc.Amount
-	prog, err := program.KeyGet(c, programKey)
+	version, err := program.Version(c)
+	if err != nil {
+		return err
+	}
+	prog, err := program.KeyGet(c, programKey, version)
 	if err != nil {
 		return err
 	}
@@ -147,8 +159,9 @@ func Deallocate(c appengine.Context, playerKeyStr string, alloc Allocation) erro
 			return NoProgramToDeallocate
 		}
 		pProg.Amount -= iAmount
-		cycles := int64(math.Ceil(float64(pProg.Cycles*iAmount) * CYCLEYIELD))
-		memory := int64(math.Ceil(pProg.Memory * float64(iAmount) * MEMYIELD))
+		balance := config.Get().Player
+		cycles := int64(math.Ceil(float64(pProg.Cycles*iAmount) * balance.CycleYield))
+		memory := int64(math.Ceil(pProg.Memory * float64(iAmount) * balance.MemYield))
 		iplayer.Cycles += cycles
 		iplayer.Memory += memory
 		iplayer.BandwidthUsage -= (float64(iAmount) * pProg.BandwidthUsage)
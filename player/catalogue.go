@@ -0,0 +1,100 @@
+package player
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"mj0lk.be/netwars/cache"
+	"mj0lk.be/netwars/program"
+)
+
+const MIGRATEBATCH = 100
+
+//set in init, refreshProgram queues its own next batch
+var refreshProgramFunc *delay.Function
+
+func init() {
+	refreshProgramFunc = delay.Func("refreshProgram", refreshProgram)
+	program.RegisterPatchFunc(migratePrograms)
+	program.RegisterAdminFunc(IsAdmin)
+}
+
+func IsAdmin(c appengine.Context, playerStr string) (bool, error) {
+	iplayer := new(Player)
+	if _, err := Get(c, playerStr, iplayer); err != nil {
+		return false, err
+	}
+	return iplayer.Access&ADMIN != 0, nil
+}
+
+//only programs owned by players need a refresh
+func migratePrograms(c appengine.Context, version int64, keys []*datastore.Key) error {
+	for _, programKey := range keys {
+		owners, err := datastore.NewQuery("PlayerProgram").Filter("ProgramKey =", programKey).
+			Limit(1).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		if len(owners) > 0 {
+			refreshProgramFunc.Call(c, programKey, version, "")
+		}
+	}
+	return nil
+}
+
+//copies the catalogue program into player programs, batch per task
+func refreshProgram(c appengine.Context, programKey *datastore.Key, version int64, cursorStr string) error {
+	current, err := program.Version(c)
+	if err != nil {
+		return err
+	}
+	prog, err := program.KeyGet(c, programKey, current)
+	if err != nil {
+		return err
+	}
+	//a newer patch has its own task
+	if prog.Version > version {
+		return nil
+	}
+	q := datastore.NewQuery("PlayerProgram").Filter("ProgramKey =", programKey).KeysOnly()
+	if len(cursorStr) > 0 {
+		cursor, err := datastore.DecodeCursor(cursorStr)
+		if err != nil {
+			return err
+		}
+		q = q.Start(cursor)
+	}
+	t := q.Run(c)
+	var count int
+	for ; count < MIGRATEBATCH; count++ {
+		key, err := t.Next(nil)
+		if err == datastore.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+			pp := new(PlayerProgram)
+			if err := datastore.Get(c, key, pp); err != nil {
+				return err
+			}
+			if pp.Version >= prog.Version {
+				return nil
+			}
+			pp.Program = *prog
+			_, err := datastore.Put(c, key, pp)
+			return err
+		}, nil); err != nil {
+			return err
+		}
+		cache.Delete(c, key.Parent().StringID()+"Player")
+		cache.Delete(c, key.Parent().StringID())
+	}
+	cursor, err := t.Cursor()
+	if err != nil {
+		return err
+	}
+	refreshProgramFunc.Call(c, programKey, version, cursor.String())
+	return nil
+}
@@ -0,0 +1,128 @@
+package player
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+	"mj0lk.be/netwars/cache"
+	"mj0lk.be/netwars/config"
+	"mj0lk.be/netwars/event"
+	"mj0lk.be/netwars/program"
+	"time"
+)
+
+var NotDeadError = errors.New("Only dead players can respawn")
+
+//connections left, programs killed in an attack are already subtracted
+func (p *Player) Connections() int64 {
+	var amount int64
+	for tpe, group := range p.Programs {
+		if program.CONN&tpe == 0 {
+			continue
+		}
+		for _, pp := range group.Programs {
+			amount += pp.Amount
+		}
+	}
+	return amount
+}
+
+//bandwidth and connections left after losing bwLost below the death thresholds
+func (p *Player) Killed(bwLost float64) bool {
+	balance := config.Get().Player
+	return p.BandwidthUsage-bwLost < balance.DeathBandwidth && p.Connections() < balance.DeathConnections
+}
+
+//marks the player dead, the event goes out with the attack events
+func (p *Player) Kill(killer *Player) *event.Event {
+	p.Status = DEAD
+	return &event.Event{
+		Created:    time.Now(),
+		Player:     p.DbKey,
+		PlayerName: p.Nick,
+		PlayerID:   p.ID,
+		Clan:       p.ClanKey,
+		Direction:  event.IN,
+		EventType:  "Player",
+		Action:     "Killed",
+		Target:     killer.DbKey,
+		TargetName: killer.NickName(),
+		TargetID:   killer.ID,
+	}
+}
+
+//back to start resources without programs, clan, research and scores are kept
+func Respawn(c appengine.Context, playerStr string) error {
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return err
+	}
+	var loanKeys []*datastore.Key
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		iplayer := new(Player)
+		if err := datastore.Get(c, playerKey, iplayer); err != nil {
+			return err
+		}
+		if iplayer.Status != DEAD {
+			return NotDeadError
+		}
+		start := NewPlayer()
+		iplayer.Status = LIVE
+		iplayer.Bandwidth = 0
+		iplayer.BandwidthUsage = 0
+		iplayer.Cycles = start.Cycles
+		iplayer.Memory = start.Memory
+		iplayer.ActiveMemory = start.ActiveMemory
+		iplayer.CyclesUpdated = start.CyclesUpdated
+		iplayer.MemUpdated = start.MemUpdated
+		iplayer.ActiveMemUpdated = start.ActiveMemUpdated
+		//hit protection for the fresh start
+		iplayer.LastAttacked = start.CyclesUpdated
+		keys, err := datastore.NewQuery("PlayerProgram").Ancestor(playerKey).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		if err := datastore.DeleteMulti(c, keys); err != nil {
+			return err
+		}
+		//the lent programs have no program to return to, the loans end now
+		loans := make([]Loan, 0)
+		loanKeys, err = datastore.NewQuery("Loan").Ancestor(playerKey).Filter("Returned =", false).GetAll(c, &loans)
+		if err != nil {
+			return err
+		}
+		keys = append([]*datastore.Key{playerKey}, loanKeys...)
+		models := []interface{}{iplayer}
+		for i := range loans {
+			loans[i].Lost = loans[i].Amount
+			loans[i].Returned = true
+			models = append(models, &loans[i])
+		}
+		if _, err := datastore.PutMulti(c, keys, models); err != nil {
+			return err
+		}
+		e := &event.Event{
+			Created:    time.Now(),
+			Player:     playerKey,
+			PlayerName: iplayer.Nick,
+			PlayerID:   iplayer.ID,
+			Clan:       iplayer.ClanKey,
+			Direction:  event.IN,
+			EventType:  "Player",
+			Action:     "Respawn",
+			Cycles:     iplayer.Cycles,
+			Memory:     iplayer.Memory,
+		}
+		return event.Send(c, []*event.Event{e}, event.Func)
+	}, options); err != nil {
+		return err
+	}
+	for _, loanKey := range loanKeys {
+		recallLoanFunc.Call(c, loanKey.Encode())
+	}
+	cache.Delete(c, playerKey.StringID()+"Player")
+	cache.Delete(c, playerKey.StringID())
+	return nil
+}
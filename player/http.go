@@ -78,6 +78,30 @@ func PublicStatusPlayer(w http.ResponseWriter, r *http.Request, c app.Context) {
 	res.JSONf(w)
 }
 
+func ResearchProgram(w http.ResponseWriter, r *http.Request, c app.Context) {
+	ro := ResearchOrder{}
+	if err := app.DecodeJsonBody(r, &ro); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
+	if err := StartResearch(c, c.User, ro.PrgKey); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
+func ResearchList(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	researches, err := Researches(c, c.User)
+	if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: researches}
+	}
+	res.JSONf(w)
+}
+
 func AllocatePrograms(w http.ResponseWriter, r *http.Request, c app.Context) {
 	al := Allocation{}
 	var res app.JSONResult
@@ -93,6 +117,54 @@ func AllocatePrograms(w http.ResponseWriter, r *http.Request, c app.Context) {
 	}
 }
 
+func UpgradePrograms(w http.ResponseWriter, r *http.Request, c app.Context) {
+	order := UpgradeOrder{}
+	if err := app.DecodeJsonBody(r, &order); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
+	if err := Upgrade(c, c.User, order); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
+func LendPrograms(w http.ResponseWriter, r *http.Request, c app.Context) {
+	order := LoanOrder{}
+	var res app.JSONResult
+	if err := app.DecodeJsonBody(r, &order); err != nil {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+	} else if loan, err := Lend(c, c.User, order); err == LoanDurationError || err == NotLendableError {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+	} else if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: loan}
+	}
+	res.JSONf(w)
+}
+
+func PlayerLoans(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	if loans, err := Loans(c, c.User); err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: loans}
+	}
+	res.JSONf(w)
+}
+
+func RespawnPlayer(w http.ResponseWriter, r *http.Request, c app.Context) {
+	if err := Respawn(c, c.User); err == NotDeadError {
+		res := app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+		res.JSONf(w)
+	} else if err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
 func AuthenticatePlayer(w http.ResponseWriter, r *http.Request, c app.Context) {
 	al := Authentication{}
 	var res app.JSONResult
@@ -0,0 +1,327 @@
+package player
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/taskqueue"
+	"errors"
+	"mj0lk.be/netwars/event"
+	"mj0lk.be/netwars/guid"
+	"mj0lk.be/netwars/program"
+	"time"
+)
+
+const (
+	MINLOAN = 10 * time.Minute
+	MAXLOAN = 24 * time.Hour
+	//programs that fight in the defender's battle map
+	LENDABLE = program.SW | program.MUT | program.HUK | program.D0S
+)
+
+var (
+	LoanDurationError = errors.New("Loan duration must be between 10 minutes and 24 hours")
+	NotLendableError  = errors.New("Only Swarm, Mutator, Hunter/Killer and d0s programs can be lent")
+)
+
+var (
+	returnLoanFunc = delay.Func("returnLoan", returnLoan)
+	recallLoanFunc = delay.Func("recallLoan", recallLoan)
+)
+
+//Duration in seconds
+type LoanOrder struct {
+	PrgKey     string `json:"prgkey"`
+	Amount     int64  `json:"amount"`
+	BorrowerID int64  `json:"borrower_id"`
+	Duration   int64  `json:"duration"`
+}
+
+//parent lender, keyname: guid. the lent programs live under the borrower until returned
+type Loan struct {
+	EncodedKey   string         `datastore:"-" json:"loan_key"`
+	Borrower     *datastore.Key `json:"-"`
+	BorrowerID   int64          `json:"borrower_id"`
+	BorrowerName string         `datastore:",noindex" json:"borrower_name"`
+	LenderID     int64          `json:"lender_id"`
+	LenderName   string         `datastore:",noindex" json:"lender_name"`
+	Borrowed     *datastore.Key `datastore:",noindex" json:"-"`
+	ProgramKey   *datastore.Key `datastore:",noindex" json:"-"`
+	ProgramName  string         `datastore:",noindex" json:"program_name"`
+	Type         int64          `datastore:",noindex" json:"-"`
+	Amount       int64          `datastore:",noindex" json:"amount"`
+	Lost         int64          `datastore:",noindex" json:"lost"`
+	Exp          int64          `datastore:",noindex" json:"-"`        //lender experience the borrowed copy started with
+	Reserved     float64        `datastore:",noindex" json:"reserved"` //lender bandwidth kept for the programs
+	Created      time.Time      `datastore:",noindex" json:"created"`
+	Expires      time.Time      `json:"expires"`
+	Returned     bool           `json:"returned"`
+}
+
+type LoanList struct {
+	Lent     []Loan `json:"lent"`
+	Borrowed []Loan `json:"borrowed"`
+}
+
+func loanEvent(loan *Loan, playerKey *datastore.Key, iplayer *Player, targetKey *datastore.Key, target *Player,
+	dir int64, action string) *event.Event {
+	return &event.Event{
+		Created:       time.Now(),
+		Expires:       loan.Expires,
+		Player:        playerKey,
+		PlayerName:    iplayer.Nick,
+		PlayerID:      iplayer.ID,
+		Clan:          iplayer.ClanKey,
+		Target:        targetKey,
+		TargetName:    target.NickName(),
+		TargetID:      target.ID,
+		EventType:     "Loan",
+		Action:        action,
+		Direction:     dir,
+		ProgramsLost:  loan.Lost,
+		EventPrograms: []event.EventProgram{event.EventProgram{Name: loan.ProgramName, Amount: loan.Amount}},
+	}
+}
+
+//lends programs to a clanmate, they defend the borrower and come back when the loan expires
+func Lend(c appengine.Context, playerStr string, order LoanOrder) (Loan, error) {
+	duration := time.Duration(order.Duration) * time.Second
+	if duration < MINLOAN || duration > MAXLOAN {
+		return Loan{}, LoanDurationError
+	}
+	if order.Amount <= 0 {
+		return Loan{}, errors.New("Invalid input")
+	}
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return Loan{}, err
+	}
+	programKey, err := datastore.DecodeKey(order.PrgKey)
+	if err != nil {
+		return Loan{}, err
+	}
+	borrowerKey, err := KeyByID(c, order.BorrowerID)
+	if err != nil {
+		return Loan{}, err
+	}
+	if borrowerKey.Equal(playerKey) {
+		return Loan{}, errors.New("Illegal operation")
+	}
+	borrowedName, err := guid.GenUUID()
+	if err != nil {
+		return Loan{}, err
+	}
+	loanName, err := guid.GenUUID()
+	if err != nil {
+		return Loan{}, err
+	}
+	loanKey := datastore.NewKey(c, "Loan", loanName, 0, playerKey)
+	borrowedKey := datastore.NewKey(c, "PlayerProgram", borrowedName, 0, borrowerKey)
+	var loan Loan
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		lender := new(Player)
+		if err := Status(c, playerStr, lender); err != nil {
+			return err
+		}
+		borrower := new(Player)
+		if err := datastore.Get(c, borrowerKey, borrower); err != nil {
+			return err
+		}
+		if lender.ClanKey == nil || !lender.ClanKey.Equal(borrower.ClanKey) {
+			return errors.New("Programs can only be lent to clanmates")
+		}
+		pp := lender.playerProgram(PlayerProgramKey(c, playerKey, programKey))
+		if pp == nil || pp.Amount < order.Amount {
+			return errors.New("Not enough programs to lend")
+		}
+		if pp.Type&LENDABLE == 0 {
+			return NotLendableError
+		}
+		if !pp.Active {
+			return errors.New("Can't lend inactive programs")
+		}
+		now := time.Now()
+		loan = Loan{
+			EncodedKey:   loanKey.Encode(),
+			Borrower:     borrowerKey,
+			BorrowerID:   borrower.ID,
+			BorrowerName: borrower.Nick,
+			LenderID:     lender.ID,
+			LenderName:   lender.Nick,
+			Borrowed:     borrowedKey,
+			ProgramKey:   programKey,
+			ProgramName:  pp.Name,
+			Type:         pp.Type,
+			Amount:       order.Amount,
+			Exp:          pp.Exp,
+			Reserved:     pp.BandwidthUsage * float64(order.Amount),
+			Created:      now,
+			Expires:      now.Add(duration),
+		}
+		borrowed := &PlayerProgram{
+			Program:    pp.Program,
+			ProgramKey: programKey,
+			Source:     lender.Nick,
+			Lender:     playerKey,
+			Amount:     order.Amount,
+			Exp:        pp.Exp,
+			Active:     true,
+		}
+		pp.Amount -= order.Amount
+		keys := []*datastore.Key{pp.DbKey, borrowedKey, loanKey}
+		models := []interface{}{pp, borrowed, &loan}
+		if _, err := datastore.PutMulti(c, keys, models); err != nil {
+			return err
+		}
+		t, err := returnLoanFunc.Task(loanKey.Encode())
+		if err != nil {
+			return err
+		}
+		t.ETA = loan.Expires
+		if _, err := taskqueue.Add(c, t, ""); err != nil {
+			return err
+		}
+		evs := []*event.Event{
+			loanEvent(&loan, playerKey, lender, borrowerKey, borrower, event.OUT, "Lend"),
+			loanEvent(&loan, borrowerKey, borrower, playerKey, lender, event.IN, "Lend"),
+		}
+		return event.Send(c, evs, event.Func)
+	}, options)
+	if err != nil {
+		return Loan{}, err
+	}
+	return loan, nil
+}
+
+//task at expiry, the programs that survived go back to the lender
+func returnLoan(c appengine.Context, loanStr string) error {
+	loanKey, err := datastore.DecodeKey(loanStr)
+	if err != nil {
+		return err
+	}
+	lenderKey := loanKey.Parent()
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		loan := new(Loan)
+		if err := datastore.Get(c, loanKey, loan); err == datastore.ErrNoSuchEntity {
+			//season reset
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if loan.Returned {
+			return nil
+		}
+		lender := new(Player)
+		borrower := new(Player)
+		if err := datastore.GetMulti(c, []*datastore.Key{lenderKey, loan.Borrower},
+			[]interface{}{lender, borrower}); err != nil {
+			return err
+		}
+		//gone when the borrower respawned
+		var remaining, gained int64
+		borrowed := new(PlayerProgram)
+		if err := datastore.Get(c, loan.Borrowed, borrowed); err == nil {
+			remaining = borrowed.Amount
+			//experience the programs earned defending the borrower
+			if borrowed.Exp > loan.Exp {
+				gained = borrowed.Exp - loan.Exp
+			}
+			if err := datastore.Delete(c, loan.Borrowed); err != nil {
+				return err
+			}
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		keys := []*datastore.Key{loanKey}
+		models := []interface{}{loan}
+		ppKey := PlayerProgramKey(c, lenderKey, loan.ProgramKey)
+		pp := new(PlayerProgram)
+		if err := datastore.Get(c, ppKey, pp); err == nil {
+			pp.Amount += remaining
+			pp.Exp += gained
+			keys = append(keys, ppKey)
+			models = append(models, pp)
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		loan.Lost = loan.Amount - remaining
+		loan.Returned = true
+		if _, err := datastore.PutMulti(c, keys, models); err != nil {
+			return err
+		}
+		evs := []*event.Event{
+			loanEvent(loan, lenderKey, lender, loan.Borrower, borrower, event.IN, "Return"),
+			loanEvent(loan, loan.Borrower, borrower, lenderKey, lender, event.OUT, "Return"),
+		}
+		return event.Send(c, evs, event.Func)
+	}, options)
+}
+
+//task after the lender respawned, the loan is settled and the borrowed programs are taken back
+func recallLoan(c appengine.Context, loanStr string) error {
+	loanKey, err := datastore.DecodeKey(loanStr)
+	if err != nil {
+		return err
+	}
+	lenderKey := loanKey.Parent()
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		loan := new(Loan)
+		if err := datastore.Get(c, loanKey, loan); err == datastore.ErrNoSuchEntity {
+			//season reset
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := datastore.Get(c, loan.Borrowed, new(PlayerProgram)); err == datastore.ErrNoSuchEntity {
+			//recalled before or gone when the borrower respawned
+			return nil
+		} else if err != nil {
+			return err
+		}
+		lender := new(Player)
+		borrower := new(Player)
+		if err := datastore.GetMulti(c, []*datastore.Key{lenderKey, loan.Borrower},
+			[]interface{}{lender, borrower}); err != nil {
+			return err
+		}
+		if err := datastore.Delete(c, loan.Borrowed); err != nil {
+			return err
+		}
+		evs := []*event.Event{
+			loanEvent(loan, lenderKey, lender, loan.Borrower, borrower, event.IN, "Recall"),
+			loanEvent(loan, loan.Borrower, borrower, lenderKey, lender, event.OUT, "Recall"),
+		}
+		return event.Send(c, evs, event.Func)
+	}, options)
+}
+
+//loans given and running loans received
+func Loans(c appengine.Context, playerStr string) (LoanList, error) {
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return LoanList{}, err
+	}
+	list := LoanList{make([]Loan, 0), make([]Loan, 0)}
+	keys, err := datastore.NewQuery("Loan").Ancestor(playerKey).Order("-Expires").Limit(20).GetAll(c, &list.Lent)
+	if err != nil {
+		return LoanList{}, err
+	}
+	for i, key := range keys {
+		list.Lent[i].EncodedKey = key.Encode()
+	}
+	keys, err = datastore.NewQuery("Loan").Filter("Borrower =", playerKey).Filter("Returned =", false).
+		GetAll(c, &list.Borrowed)
+	if err != nil {
+		return LoanList{}, err
+	}
+	for i, key := range keys {
+		list.Borrowed[i].EncodedKey = key.Encode()
+	}
+	return list, nil
+}
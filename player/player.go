@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
 	"mj0lk.be/netwars/cache"
+	"mj0lk.be/netwars/config"
 	"mj0lk.be/netwars/counter"
 	"mj0lk.be/netwars/event"
 	"mj0lk.be/netwars/guid"
@@ -19,24 +20,19 @@ import (
 )
 
 const (
-	MEMYIELD           = 0.4
-	CYCLEYIELD         = 0.5
-	BWLOWLIMIT         = 0.2
-	BWHILIMIT          = 0.3
-	TIMEDELIM          = "@"
-	TIMETPL            = "%d@%d"
-	STARTMEM           = 50
-	STARTCYC           = 1000
-	ACTIVEMEMMAX       = 10
-	LIMIT              = 100
-	THUMBSIZE          = 32
-	EMAILREGEX         = `(\w[-._\w]*\w@\w[-._\w]*\w\.\w{2,3})`
-	NICKREGEX          = `^[a-zA-Z0-9_.-]*$`
-	MEMBER       int64 = 1 << iota
-	LIEUTENANT   int64 = 1 << iota
-	LEADER       int64 = 1 << iota
+	TIMEDELIM        = "@"
+	TIMETPL          = "%d@%d"
+	LIMIT            = 100
+	THUMBSIZE        = 32
+	EMAILREGEX       = `(\w[-._\w]*\w@\w[-._\w]*\w\.\w{2,3})`
+	NICKREGEX        = `^[a-zA-Z0-9_.-]*$`
+	MEMBER     int64 = 1 << 13 //stored member types, values of their original iota positions
+	LIEUTENANT int64 = 1 << 14
+	LEADER     int64 = 1 << 15
 )
 
+const ACTIVITYINTERVAL = time.Hour //status refreshes older than this record new activity
+
 var (
 	emailMatcher, _ = regexp.Compile(EMAILREGEX)
 	nickMatcher, _  = regexp.Compile(NICKREGEX)
@@ -57,6 +53,17 @@ type Creation struct {
 	Email    string `json:"email"`
 	Nick     string `json:"nick"`
 	Password string `json:"pwd"`
+	Token    string `json:"token"` //optional, email invite token
+}
+
+//claims an email invite for a new player
+type InviteFunc func(c appengine.Context, playerKey *datastore.Key, email, token string) error
+
+var inviteFuncs []InviteFunc
+
+//register from init (clan)
+func RegisterInviteFunc(f InviteFunc) {
+	inviteFuncs = append(inviteFuncs, f)
 }
 
 type Authentication struct {
@@ -88,9 +95,62 @@ type PlayerProgram struct {
 	Expires    time.Time      `datastore:",noindex" json:"expires"`
 	Active     bool           `json:"active"`
 	Exp        int64          `json:"experience"`
+	Level      int64          `json:"level" datastore:"-"`
+	Lender     *datastore.Key `json:"-" datastore:",noindex"` //borrowed programs, the lender reserves their bandwidth
 	program.Program
 }
 
+//experience needed per veteran level, 1 exp per EXPDAMAGE damage dealt or survived
+var VeteranLevels = []int64{0, 100, 300, 700, 1500, 3000}
+
+const (
+	EXPDAMAGE  = 100.0
+	LEVELBONUS = 0.05 //attack and life bonus per level
+)
+
+func VeteranLevel(exp int64) int64 {
+	var level int64
+	for i, threshold := range VeteranLevels {
+		if exp >= threshold {
+			level = int64(i)
+		}
+	}
+	return level
+}
+
+//level as recorded when the program entered the battle, a level up applies to the next battle
+func (pp *PlayerProgram) AttackBonus(level int64) float64 {
+	return 1.0 + float64(level)*LEVELBONUS
+}
+
+func (pp *PlayerProgram) EffectiveLife(level int64) int64 {
+	return int64(float64(pp.Life) * pp.AttackBonus(level))
+}
+
+//returns true on level up
+func (pp *PlayerProgram) GainExperience(exp int64) bool {
+	level := VeteranLevel(pp.Exp)
+	pp.Exp += exp
+	pp.Level = VeteranLevel(pp.Exp)
+	return pp.Level > level
+}
+
+//achievement earned by the player
+type Badge struct {
+	Name   string    `datastore:",noindex" json:"name"`
+	Title  string    `datastore:",noindex" json:"title"`
+	Earned time.Time `datastore:",noindex" json:"earned_on"`
+}
+
+func (p *Player) HasBadge(name string) bool {
+	for _, b := range p.Badges {
+		if b.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 type Player struct {
 	DbKey            *datastore.Key                `datastore:"-" json:"-"`
 	Cps              int64                         `json:"cps"`
@@ -126,6 +186,9 @@ type Player struct {
 	Clan             string                        `json:"clan" datastore:"-"`
 	ClanTag          string                        `json:"clan_tag"`
 	MemberType       int64                         `json:"-"`
+	ClanJoined       time.Time                     `json:"-" datastore:",noindex"`
+	LastActive       time.Time                     `json:"-"`
+	LastAttacked     time.Time                     `json:"-" datastore:",noindex"`
 	Member           string                        `json:"member_type" datastore:"-"`
 	Country          string                        `json:"country"`
 	Language         string                        `json:"language"`
@@ -135,24 +198,28 @@ type Player struct {
 	Programs         map[int64]*PlayerProgramGroup `json:"-" datastore:"-"`
 	PlayerPrograms   []*PlayerProgramGroup         `json:"programs, omitempty" datastore:"-"`
 	Tracker          event.Tracker                 `json:"tracker" datastore:"-"`
+	Badges           []Badge                       `json:"badges"`
 	Pass             []byte                        `json:"-"`
 }
 
 func (p Player) Range() (float64, float64) {
-	lo := p.BandwidthUsage - (p.BandwidthUsage * BWLOWLIMIT)
-	hi := p.BandwidthUsage + (p.BandwidthUsage * BWHILIMIT)
+	balance := config.Get().Player
+	lo := p.BandwidthUsage - (p.BandwidthUsage * balance.BwLowLimit)
+	hi := p.BandwidthUsage + (p.BandwidthUsage * balance.BwHiLimit)
 	return lo, hi
 }
 
 func NewPlayer() *Player {
 	now := time.Now()
+	balance := config.Get().Player
 	p := &Player{
-		Cycles:           STARTCYC,
-		Memory:           STARTMEM,
-		ActiveMemory:     ACTIVEMEMMAX,
+		Cycles:           balance.StartCycles,
+		Memory:           balance.StartMem,
+		ActiveMemory:     balance.ActiveMemory.Max,
 		CyclesUpdated:    now,
 		MemUpdated:       now,
 		ActiveMemUpdated: now,
+		LastActive:       now,
 	}
 	return p
 }
@@ -195,9 +262,10 @@ func (p *Player) Load(c <-chan datastore.Property) error {
 	if err := datastore.LoadStruct(p, c); err != nil {
 		return err
 	}
-	p.Cycles, p.CyclesUpdated = timedResource(p.Scycles, 15, 50, 5e4)
-	p.Memory, p.MemUpdated = timedResource(p.Smem, 15, 1, 300)
-	p.ActiveMemory, p.ActiveMemUpdated = timedResource(p.SactiveMem, 60, 2, ACTIVEMEMMAX)
+	balance := config.Get().Player
+	p.Cycles, p.CyclesUpdated = timedResource(p.Scycles, balance.Cycles)
+	p.Memory, p.MemUpdated = timedResource(p.Smem, balance.Memory)
+	p.ActiveMemory, p.ActiveMemUpdated = timedResource(p.SactiveMem, balance.ActiveMemory)
 	if len(p.Avatar) > 0 {
 		p.AvatarThumb = fmt.Sprintf("%s=s%d", p.Avatar, THUMBSIZE)
 	}
@@ -221,7 +289,8 @@ func (p *Player) Save(c chan<- datastore.Property) error {
 	return datastore.SaveStruct(p, c)
 }
 
-func timedResource(src string, interval, amount, max int64) (int64, time.Time) {
+func timedResource(src string, regen config.Regen) (int64, time.Time) {
+	interval, amount, max := regen.Interval, regen.Amount, regen.Max
 	content := strings.Split(src, TIMEDELIM)
 	value, err := strconv.ParseInt(content[0], 10, 64)
 	if err != nil {
@@ -266,9 +335,27 @@ func Login(c appengine.Context, cr Authentication) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if err := touch(c, playerKey); err != nil {
+		c.Errorf("error updating last activity %s", err)
+	}
 	return tokenString, nil
 }
 
+//record player activity, used for clan succession
+func touch(c appengine.Context, playerKey *datastore.Key) error {
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		iplayer := new(Player)
+		if err := datastore.Get(c, playerKey, iplayer); err != nil {
+			return err
+		}
+		iplayer.LastActive = time.Now()
+		if _, err := datastore.Put(c, playerKey, iplayer); err != nil {
+			return err
+		}
+		return nil
+	}, nil)
+}
+
 func KeyByID(c appengine.Context, id int64) (*datastore.Key, error) {
 	k := fmt.Sprintf("%d", id)
 	rk := new(datastore.Key)
@@ -319,6 +406,11 @@ func Tstatus(c appengine.Context, playerStr string, iplayer *Player) error {
 	if err := Status(c, playerStr, iplayer); err != nil {
 		return err
 	}
+	if time.Since(iplayer.LastActive) > ACTIVITYINTERVAL {
+		if err := touch(c, iplayer.DbKey); err != nil {
+			c.Errorf("error updating last activity %s", err)
+		}
+	}
 	iplayer.Tracker = <-trackerCh
 	return nil
 }
@@ -350,6 +442,7 @@ func Status(c appengine.Context, playerStr string, iplayer *Player) error {
 			continue
 		}
 		pp.DbKey = key
+		pp.Level = VeteranLevel(pp.Exp)
 		pp.Usage = pp.BandwidthUsage * float64(pp.Amount)
 		pp.Yield = pp.Bandwidth * pp.Amount
 		var group *PlayerProgramGroup
@@ -363,7 +456,7 @@ func Status(c appengine.Context, playerStr string, iplayer *Player) error {
 			iplayer.Programs[pp.Type] = group
 			cnt++
 		}
-		if pp.Active && program.CONN&pp.Type == 0 {
+		if pp.Active && program.CONN&pp.Type == 0 && pp.Lender == nil {
 			group.Usage += pp.Usage
 			iplayer.BandwidthUsage += pp.Usage
 		}
@@ -386,6 +479,17 @@ func Status(c appengine.Context, playerStr string, iplayer *Player) error {
 		group.Power = true
 		group.Programs = append(group.Programs, &pp)
 	}
+	var loans []Loan
+	if _, err := datastore.NewQuery("Loan").Ancestor(playerKey).Filter("Returned =", false).
+		GetAll(c, &loans); err != nil {
+		return err
+	}
+	for _, loan := range loans {
+		iplayer.BandwidthUsage += loan.Reserved
+		if group, ok := iplayer.Programs[loan.Type]; ok {
+			group.Usage += loan.Reserved
+		}
+	}
 	iplayer.PlayerPrograms = make([]*PlayerProgramGroup, cnt)
 	for cType, cGroup := range iplayer.Programs {
 		cnt--
@@ -493,6 +597,14 @@ func Create(c appengine.Context, cr Creation) (string, map[string]int, error) {
 	if err != nil {
 		return "", nil, err
 	}
+	if len(cr.Token) > 0 {
+		//player is created, a bad invite should not fail signup
+		for _, f := range inviteFuncs {
+			if err := f(c, playerKey, cr.Email, cr.Token); err != nil {
+				c.Errorf("error claiming invite %s", err)
+			}
+		}
+	}
 	return tokenString, nil, nil
 }
 
@@ -5,6 +5,7 @@ import (
 	"appengine/aetest"
 	"appengine/datastore"
 	"errors"
+	"mj0lk.be/netwars/event"
 	"mj0lk.be/netwars/program"
 	"mj0lk.be/netwars/secure"
 	"mj0lk.be/netwars/testutils"
@@ -50,7 +51,7 @@ func TestCreate(t *testing.T) {
 		t.Fatalf("NewContext: %v", err)
 	}
 	defer c.Close()
-	cr := Creation{TESTEMAIL, TESTNICK, "testpassword"}
+	cr := Creation{TESTEMAIL, TESTNICK, "testpassword", ""}
 	tokenStr, usererr, err := Create(c, cr)
 	if err != nil {
 		t.Fatalf("error creating player : %s", err)
@@ -69,7 +70,7 @@ func TestUpdateProfile(t *testing.T) {
 		t.Fatalf("NewContext: %v", err)
 	}
 	defer c.Close()
-	cr := Creation{TESTEMAIL, TESTNICK, "testpassword"}
+	cr := Creation{TESTEMAIL, TESTNICK, "testpassword", ""}
 	tokenStr, usererr, err := Create(c, cr)
 	if err != nil {
 		t.Fatalf("error creating player : %s", err)
@@ -88,7 +89,7 @@ func TestUpdateProfile(t *testing.T) {
 		Address:   "PLantin & Moretuslei 2018 Antwerpen",
 		Signature: "Carpe Diem",
 	}
-	playerKeyStr, _ := secure.ValidateToken(tokenStr)
+	playerKeyStr, _ := secure.ValidateToken(tokenStr, c)
 	if err := UpdateProfile(c, playerKeyStr, profileUpdate); err != nil {
 		t.Fatalf("Error updating profile")
 	}
@@ -105,7 +106,7 @@ func TestUpdateProfile(t *testing.T) {
 }
 
 func setupPlayer(c appengine.Context) (string, error) {
-	cr := Creation{TESTEMAIL, TESTNICK, "testpassword"}
+	cr := Creation{TESTEMAIL, TESTNICK, "testpassword", ""}
 	tokenStr, usererr, err := Create(c, cr)
 	if err != nil {
 		return "", err
@@ -114,7 +115,7 @@ func setupPlayer(c appengine.Context) (string, error) {
 	if usererr != nil {
 		return "", errors.New("unexpected user error")
 	}
-	playerKeyStr, _ := secure.ValidateToken(tokenStr)
+	playerKeyStr, _ := secure.ValidateToken(tokenStr, c)
 	return playerKeyStr, nil
 }
 
@@ -280,3 +281,317 @@ func TestPublicStatus(t *testing.T) {
 	}
 	t.Logf("player retrieved: %+v \n", iplayer)
 }
+
+func TestStats(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	playerKeyStr, err := setupPlayer(c)
+	if err != nil {
+		t.Fatalf("setup player error: %s", err)
+	}
+	playerKey, _ := datastore.DecodeKey(playerKeyStr)
+	events := []*event.Event{
+		&event.Event{Player: playerKey, EventType: "Attack", Action: "Ice", Direction: event.OUT,
+			Result: true, TargetID: 2, TargetName: "rival", ProgramsKilled: 10},
+		&event.Event{Player: playerKey, EventType: "Attack", Action: SPYACTION, Direction: event.OUT,
+			Result: false, TargetID: 2, TargetName: "rival"},
+		&event.Event{Player: playerKey, EventType: "Attack", Action: "Ice", Direction: event.IN,
+			Result: false, TargetID: 3, TargetName: "other", BwLost: 50},
+		&event.Event{Player: playerKey, EventType: "Clan", Action: "Join"},
+		&event.Event{Player: playerKey, EventType: "Attack", Action: "Balanced", Direction: event.OUT,
+			Result: true, TargetID: 2, TargetName: "rival", GUID: "retried"},
+	}
+	//retried event task
+	events = append(events, events[len(events)-1])
+	for _, e := range events {
+		if err := recordStats(c, e); err != nil {
+			t.Fatalf("record stats error: %s", err)
+		}
+	}
+	stats, err := Stats(c, playerKey)
+	if err != nil {
+		t.Fatalf("stats error: %s", err)
+	}
+	if stats.AttacksMade != 3 || stats.AttacksWon != 2 || stats.AttacksReceived != 1 ||
+		stats.ProgramsKilled != 10 || stats.BwLost != 50 || stats.SpyRate != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if len(stats.Rivals) != 2 || stats.Rivals[0].PlayerID != 2 || len(stats.Types) != 3 {
+		t.Fatalf("unexpected rivals %+v types %+v", stats.Rivals, stats.Types)
+	}
+}
+
+func TestResearch(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	playerKeyStr, err := setupPlayer(c)
+	if err != nil {
+		t.Fatalf("player setup error : %s \n", err)
+	}
+	if err := setupProgram(c); err != nil {
+		t.Fatalf("setup program error %s", err)
+	}
+	lockedProgram := &program.Program{
+		Name:           "Swarm mark V",
+		Attack:         150,
+		Life:           200,
+		TypeName:       "Swarm",
+		Cycles:         90,
+		Memory:         0.50,
+		Effectors:      []string{"Swarm"},
+		Requires:       []string{PROGRAM2},
+		ResearchCycles: 100,
+	}
+	if err := program.CreateOrUpdate(c, lockedProgram); err != nil {
+		t.Fatalf("setup program error %s", err)
+	}
+	lockedKey := datastore.NewKey(c, "Program", lockedProgram.Name, 0, nil)
+	if err := StartResearch(c, playerKeyStr, lockedKey.Encode()); err == nil {
+		t.Fatalf("expected prerequisite error")
+	}
+	connectorKey := datastore.NewKey(c, "Program", PROGRAM1, 0, nil)
+	programKey := datastore.NewKey(c, "Program", PROGRAM2, 0, nil)
+	if err := Allocate(c, playerKeyStr, Allocation{connectorKey.Encode(), 1}); err != nil {
+		t.Fatalf("allocate error %s \n", err)
+	}
+	if err := Allocate(c, playerKeyStr, Allocation{programKey.Encode(), 1}); err != nil {
+		t.Fatalf("allocate error %s \n", err)
+	}
+	if err := Allocate(c, playerKeyStr, Allocation{lockedKey.Encode(), 1}); err != ProgramLockedError {
+		t.Fatalf("expected locked program, got %v", err)
+	}
+	if err := StartResearch(c, playerKeyStr, lockedKey.Encode()); err != nil {
+		t.Fatalf("research error %s", err)
+	}
+	if err := Allocate(c, playerKeyStr, Allocation{lockedKey.Encode(), 1}); err != nil {
+		t.Fatalf("allocate researched program error %s \n", err)
+	}
+}
+
+func TestVeteranLevel(t *testing.T) {
+	pp := new(PlayerProgram)
+	pp.Life = 100
+	pp.Exp = VeteranLevels[1] - 1
+	if pp.GainExperience(1) != true || pp.Level != 1 {
+		t.Fatalf("expected level up to 1, got %d \n", pp.Level)
+	}
+	if pp.EffectiveLife(pp.Level) != 105 {
+		t.Fatalf("expected life bonus, got %d \n", pp.EffectiveLife(pp.Level))
+	}
+	if pp.GainExperience(1) {
+		t.Fatalf("unexpected level up at %d exp \n", pp.Exp)
+	}
+	pp.GainExperience(VeteranLevels[len(VeteranLevels)-1] * 2)
+	if pp.Level != int64(len(VeteranLevels)-1) {
+		t.Fatalf("expected max level, got %d \n", pp.Level)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	playerKeyStr, err := setupPlayer(c)
+	if err != nil {
+		t.Fatalf("player setup error : %s \n", err)
+	}
+	if err := setupProgram(c); err != nil {
+		t.Fatalf("setup program error %s", err)
+	}
+	oldProgram := &program.Program{
+		Name:          "Swarm mark III",
+		Attack:        60,
+		Life:          90,
+		TypeName:      "Swarm",
+		Cycles:        40,
+		Memory:        0.25,
+		Effectors:     []string{"Swarm"},
+		UpgradeName:   PROGRAM2,
+		UpgradeAmount: 2,
+		UpgradeCycles: 20,
+		UpgradeMemory: 0.5,
+	}
+	if err := program.CreateOrUpdate(c, oldProgram); err != nil {
+		t.Fatalf("setup program error %s", err)
+	}
+	connectorKey := datastore.NewKey(c, "Program", PROGRAM1, 0, nil)
+	oldKey := datastore.NewKey(c, "Program", oldProgram.Name, 0, nil)
+	if err := Allocate(c, playerKeyStr, Allocation{connectorKey.Encode(), 1}); err != nil {
+		t.Fatalf("allocate error %s \n", err)
+	}
+	if err := Allocate(c, playerKeyStr, Allocation{oldKey.Encode(), 5}); err != nil {
+		t.Fatalf("allocate error %s \n", err)
+	}
+	if err := Upgrade(c, playerKeyStr, UpgradeOrder{oldKey.Encode(), 3}); err == nil {
+		t.Fatalf("expected amount error")
+	}
+	if err := Upgrade(c, playerKeyStr, UpgradeOrder{oldKey.Encode(), 4}); err != nil {
+		t.Fatalf("upgrade error %s \n", err)
+	}
+	player := new(Player)
+	if err := Status(c, playerKeyStr, player); err != nil {
+		t.Fatalf(" status err : %s", err)
+	}
+	checkProgram(t, player, oldProgram.Name, 1)
+	checkProgram(t, player, PROGRAM2, 2)
+	if err := Upgrade(c, playerKeyStr, UpgradeOrder{connectorKey.Encode(), 1}); err != NoUpgradeError {
+		t.Fatalf("expected no upgrade error, got %v", err)
+	}
+	testutils.CheckQueue(c, t, 3)
+}
+
+func TestRespawn(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	playerKeyStr, err := setupPlayer(c)
+	if err != nil {
+		t.Fatalf("player setup error : %s \n", err)
+	}
+	if err := setupProgram(c); err != nil {
+		t.Fatalf("setup program error %s", err)
+	}
+	connectorKey := datastore.NewKey(c, "Program", PROGRAM1, 0, nil)
+	if err := Allocate(c, playerKeyStr, Allocation{connectorKey.Encode(), 1}); err != nil {
+		t.Fatalf("allocate error %s \n", err)
+	}
+	if err := Respawn(c, playerKeyStr); err != NotDeadError {
+		t.Fatalf("expected not dead error, got %v", err)
+	}
+	player := new(Player)
+	if err := Status(c, playerKeyStr, player); err != nil {
+		t.Fatalf(" status err : %s", err)
+	}
+	if player.Killed(0) {
+		t.Fatalf("player with a connection killed")
+	}
+	for _, group := range player.Programs {
+		for _, pp := range group.Programs {
+			pp.Amount = 0
+		}
+	}
+	if !player.Killed(0) {
+		t.Fatalf("expected player without connections to die")
+	}
+	player.Kill(player)
+	if _, err := datastore.Put(c, player.DbKey, player); err != nil {
+		t.Fatalf("put error %s \n", err)
+	}
+	if err := Respawn(c, playerKeyStr); err != nil {
+		t.Fatalf("respawn error %s \n", err)
+	}
+	respawned := new(Player)
+	if err := Status(c, playerKeyStr, respawned); err != nil {
+		t.Fatalf(" status err : %s", err)
+	}
+	if respawned.Status != LIVE || len(respawned.PlayerPrograms) != 0 || respawned.Cycles != NewPlayer().Cycles {
+		t.Fatalf("expected fresh live player, got %+v", respawned)
+	}
+}
+
+func TestLend(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	lenderStr, err := setupPlayer(c)
+	if err != nil {
+		t.Fatalf("player setup error : %s \n", err)
+	}
+	tokenStr, _, err := Create(c, Creation{"borrower@gmail.com", "borrower", "testpassword", ""})
+	if err != nil {
+		t.Fatalf("player setup error : %s \n", err)
+	}
+	borrowerStr, _ := secure.ValidateToken(tokenStr, c)
+	if err := setupProgram(c); err != nil {
+		t.Fatalf("setup program error %s", err)
+	}
+	connectorKey := datastore.NewKey(c, "Program", PROGRAM1, 0, nil)
+	swarmKey := datastore.NewKey(c, "Program", PROGRAM2, 0, nil)
+	if err := Allocate(c, lenderStr, Allocation{connectorKey.Encode(), 1}); err != nil {
+		t.Fatalf("allocate error %s \n", err)
+	}
+	if err := Allocate(c, lenderStr, Allocation{swarmKey.Encode(), 4}); err != nil {
+		t.Fatalf("allocate error %s \n", err)
+	}
+	borrower := new(Player)
+	if _, err := Get(c, borrowerStr, borrower); err != nil {
+		t.Fatalf("get error %s \n", err)
+	}
+	order := LoanOrder{swarmKey.Encode(), 3, borrower.ID, 3600}
+	if _, err := Lend(c, lenderStr, order); err == nil {
+		t.Fatalf("expected clanmate error")
+	}
+	clanKey := datastore.NewKey(c, "Clan", "testclan", 0, nil)
+	for _, playerStr := range []string{lenderStr, borrowerStr} {
+		iplayer := new(Player)
+		playerKey, err := Get(c, playerStr, iplayer)
+		if err != nil {
+			t.Fatalf("get error %s \n", err)
+		}
+		iplayer.ClanKey = clanKey
+		if _, err := datastore.Put(c, playerKey, iplayer); err != nil {
+			t.Fatalf("put error %s \n", err)
+		}
+	}
+	if _, err := Lend(c, lenderStr, LoanOrder{swarmKey.Encode(), 3, borrower.ID, 60}); err != LoanDurationError {
+		t.Fatalf("expected duration error, got %v", err)
+	}
+	loan, err := Lend(c, lenderStr, order)
+	if err != nil {
+		t.Fatalf("lend error %s \n", err)
+	}
+	lender := new(Player)
+	if err := Status(c, lenderStr, lender); err != nil {
+		t.Fatalf(" status err : %s", err)
+	}
+	checkProgram(t, lender, PROGRAM2, 1)
+	if err := Status(c, borrowerStr, borrower); err != nil {
+		t.Fatalf(" status err : %s", err)
+	}
+	checkProgram(t, borrower, PROGRAM2, 3)
+	//two lent programs lost defending the borrower, the survivor gained experience
+	borrowed := new(PlayerProgram)
+	if err := datastore.Get(c, loan.Borrowed, borrowed); err != nil {
+		t.Fatalf("get error %s \n", err)
+	}
+	borrowed.Amount = 1
+	borrowed.Exp += 5
+	if _, err := datastore.Put(c, loan.Borrowed, borrowed); err != nil {
+		t.Fatalf("put error %s \n", err)
+	}
+	if err := returnLoan(c, loan.EncodedKey); err != nil {
+		t.Fatalf("return error %s \n", err)
+	}
+	lender = new(Player)
+	if err := Status(c, lenderStr, lender); err != nil {
+		t.Fatalf(" status err : %s", err)
+	}
+	checkProgram(t, lender, PROGRAM2, 2)
+	lenderKey, _ := datastore.DecodeKey(lenderStr)
+	pp := new(PlayerProgram)
+	if err := datastore.Get(c, PlayerProgramKey(c, lenderKey, swarmKey), pp); err != nil {
+		t.Fatalf("get error %s \n", err)
+	}
+	if pp.Exp != loan.Exp+5 {
+		t.Fatalf("expected the experience gained on loan back, got %d", pp.Exp)
+	}
+	loans, err := Loans(c, lenderStr)
+	if err != nil || len(loans.Lent) != 1 {
+		t.Fatalf("expected 1 loan, got %+v, %v", loans, err)
+	}
+	if !loans.Lent[0].Returned || loans.Lent[0].Lost != 2 {
+		t.Fatalf("expected returned loan with 2 lost, got %+v", loans.Lent[0])
+	}
+}
@@ -88,6 +88,9 @@ type PublicPlayer struct {
 	Clan             string                        `json:"clan" datastore:"-"`
 	ClanTag          string                        `json:"clan_tag"`
 	MemberType       int64                         `json:"-"`
+	ClanJoined       time.Time                     `json:"-" datastore:",noindex"`
+	LastActive       time.Time                     `json:"-"`
+	LastAttacked     time.Time                     `json:"-" datastore:",noindex"`
 	Member           string                        `json:"member_type" datastore:"-"`
 	Country          string                        `json:"-"`
 	Language         string                        `json:"-"`
@@ -97,6 +100,8 @@ type PublicPlayer struct {
 	Programs         map[int64]*PlayerProgramGroup `json:"-" datastore:"-"`
 	PlayerPrograms   []*PlayerProgramGroup         `json:"-" datastore:"-"`
 	Tracker          event.Tracker                 `json:"-" datastore:"-"`
+	Badges           []Badge                       `json:"badges"`
+	Stats            *PlayerStats                  `json:"stats" datastore:"-"`
 	Pass             []byte                        `json:"-"`
 }
 
@@ -216,6 +221,12 @@ func Public(c appengine.Context, playerStr string, playerIdStr string, iplayer *
 	if _, err := GetPublic(c, playerKey.Encode(), iplayer); err != nil {
 		return err
 	}
+	//not cached with the player, changes with every attack
+	stats, err := Stats(c, playerKey)
+	if err != nil {
+		return err
+	}
+	iplayer.Stats = stats
 	return nil
 
 }
@@ -0,0 +1,198 @@
+package player
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+	"fmt"
+	"mj0lk.be/netwars/event"
+	"mj0lk.be/netwars/program"
+	"time"
+)
+
+const MAXRESEARCH = 1 //concurrent research jobs
+
+var ProgramLockedError = errors.New("Program is locked, research it first")
+
+//parent player, keyname: program
+type Research struct {
+	Program   *datastore.Key `json:"-"`
+	Name      string         `json:"name"`
+	Cycles    int64          `datastore:",noindex" json:"cycles"`
+	Started   time.Time      `json:"started"`
+	Completes time.Time      `json:"completes"`
+	Completed bool           `datastore:"-" json:"completed"`
+}
+
+type ResearchOrder struct {
+	PrgKey string `json:"prgkey"`
+}
+
+func (r *Research) Load(c <-chan datastore.Property) error {
+	if err := datastore.LoadStruct(r, c); err != nil {
+		return err
+	}
+	r.Completed = !r.Completes.After(time.Now())
+	return nil
+}
+
+func (r *Research) Save(c chan<- datastore.Property) error {
+	return datastore.SaveStruct(r, c)
+}
+
+func ResearchKey(c appengine.Context, playerKey *datastore.Key, name string) *datastore.Key {
+	return datastore.NewKey(c, "Research", name, 0, playerKey)
+}
+
+func (p *Player) owns(name string) bool {
+	for _, group := range p.Programs {
+		for _, pp := range group.Programs {
+			if pp.Name == name && pp.Amount > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//a prerequisite is met by owning the program or by a completed research
+func (p *Player) researched(c appengine.Context, name string) (bool, error) {
+	research := new(Research)
+	if err := datastore.Get(c, ResearchKey(c, p.DbKey, name), research); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return false, nil
+		}
+		return false, err
+	}
+	return research.Completed, nil
+}
+
+//player loaded with Status
+func (p *Player) prerequisites(c appengine.Context, prog *program.Program) error {
+	if p.Aps < prog.RequiredAps {
+		return errors.New(fmt.Sprintf("Need %d aps for %s", prog.RequiredAps, prog.Name))
+	}
+	for _, name := range prog.Requires {
+		if p.owns(name) {
+			continue
+		}
+		ok, err := p.researched(c, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New(fmt.Sprintf("%s requires %s", prog.Name, name))
+		}
+	}
+	return nil
+}
+
+func (p *Player) Unlocked(c appengine.Context, prog *program.Program) error {
+	if prog.Disabled {
+		return program.DisabledError
+	}
+	if err := p.prerequisites(c, prog); err != nil {
+		return err
+	}
+	if !prog.NeedsResearch() || p.owns(prog.Name) {
+		return nil
+	}
+	ok, err := p.researched(c, prog.Name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ProgramLockedError
+	}
+	return nil
+}
+
+func StartResearch(c appengine.Context, playerStr, prgKeyStr string) error {
+	programKey, err := datastore.DecodeKey(prgKeyStr)
+	if err != nil {
+		return err
+	}
+	version, err := program.Version(c)
+	if err != nil {
+		return err
+	}
+	prog, err := program.KeyGet(c, programKey, version)
+	if err != nil {
+		return err
+	}
+	if prog.Disabled {
+		return program.DisabledError
+	}
+	if !prog.NeedsResearch() {
+		return errors.New("No research needed")
+	}
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		iplayer := new(Player)
+		if err := Status(c, playerStr, iplayer); err != nil {
+			return err
+		}
+		if err := iplayer.prerequisites(c, prog); err != nil {
+			return err
+		}
+		researchKey := ResearchKey(c, iplayer.DbKey, prog.Name)
+		research := new(Research)
+		if err := datastore.Get(c, researchKey, research); err == nil {
+			return errors.New("Already researched or researching")
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		running, err := datastore.NewQuery("Research").Ancestor(iplayer.DbKey).
+			Filter("Completes >", time.Now()).Count(c)
+		if err != nil {
+			return err
+		}
+		if running >= MAXRESEARCH {
+			return errors.New("Already researching")
+		}
+		if iplayer.Cycles < prog.ResearchCycles {
+			return errors.New("Error not enough cycles")
+		}
+		now := time.Now()
+		research = &Research{
+			Program:   programKey,
+			Name:      prog.Name,
+			Cycles:    prog.ResearchCycles,
+			Started:   now,
+			Completes: now.Add(time.Duration(prog.ResearchTime) * time.Second),
+		}
+		iplayer.Cycles -= prog.ResearchCycles
+		if _, err := datastore.PutMulti(c, []*datastore.Key{iplayer.DbKey, researchKey},
+			[]interface{}{iplayer, research}); err != nil {
+			return err
+		}
+		e := &event.Event{
+			Player:        iplayer.DbKey,
+			Created:       now,
+			Direction:     event.IN,
+			EventType:     "Research",
+			PlayerName:    iplayer.Nick,
+			PlayerID:      iplayer.ID,
+			Action:        "Research",
+			Cycles:        prog.ResearchCycles,
+			Expires:       research.Completes,
+			EventPrograms: []event.EventProgram{event.EventProgram{Name: prog.Name, Owned: true}},
+		}
+		if err := event.Send(c, []*event.Event{e}, event.Func); err != nil {
+			return err
+		}
+		return nil
+	}, nil)
+}
+
+func Researches(c appengine.Context, playerStr string) ([]Research, error) {
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return nil, err
+	}
+	researches := make([]Research, 0)
+	if _, err := datastore.NewQuery("Research").Ancestor(playerKey).Order("-Started").
+		GetAll(c, &researches); err != nil {
+		return nil, err
+	}
+	return researches, nil
+}
@@ -0,0 +1,62 @@
+package player
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"mj0lk.be/netwars/cache"
+	"mj0lk.be/netwars/event"
+)
+
+//child entities dropped at the end of a season
+var seasonKinds = []string{"PlayerProgram", "Research", "PlayerStats", "Loan"}
+
+//register from init (attack), for kinds other packages keep under the player
+func RegisterSeasonKind(kind string) {
+	seasonKinds = append(seasonKinds, kind)
+}
+
+//new season: start resources, no programs, research or stats. profile, clan and badges are kept
+func Reset(c appengine.Context, playerKey *datastore.Key) error {
+	options := new(datastore.TransactionOptions)
+	options.XG = true
+	if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		iplayer := new(Player)
+		if err := datastore.Get(c, playerKey, iplayer); err != nil {
+			return err
+		}
+		start := NewPlayer()
+		iplayer.Status = LIVE
+		iplayer.Cps = 0
+		iplayer.Aps = 0
+		iplayer.Bandwidth = 0
+		iplayer.BandwidthUsage = 0
+		iplayer.Cycles = start.Cycles
+		iplayer.Memory = start.Memory
+		iplayer.ActiveMemory = start.ActiveMemory
+		iplayer.CyclesUpdated = start.CyclesUpdated
+		iplayer.MemUpdated = start.MemUpdated
+		iplayer.ActiveMemUpdated = start.ActiveMemUpdated
+		var children []*datastore.Key
+		for _, kind := range seasonKinds {
+			keys, err := datastore.NewQuery(kind).Ancestor(playerKey).KeysOnly().GetAll(c, nil)
+			if err != nil {
+				return err
+			}
+			children = append(children, keys...)
+		}
+		if err := datastore.DeleteMulti(c, children); err != nil {
+			return err
+		}
+		trackerKey := datastore.NewKey(c, "Tracker", playerKey.StringID(), 0, nil)
+		if _, err := datastore.PutMulti(c, []*datastore.Key{playerKey, trackerKey},
+			[]interface{}{iplayer, new(event.Tracker)}); err != nil {
+			return err
+		}
+		return nil
+	}, options); err != nil {
+		return err
+	}
+	cache.Delete(c, playerKey.StringID()+"Player")
+	cache.Delete(c, playerKey.StringID())
+	return nil
+}
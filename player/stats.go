@@ -0,0 +1,215 @@
+package player
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"bytes"
+	"encoding/gob"
+	"mj0lk.be/netwars/event"
+	"sort"
+)
+
+const (
+	SPYACTION  = "Intelligence"
+	MAXRIVALS  = 50 //rivals tracked, least frequent drops out
+	TOPRIVALS  = 5
+	STATSEVENT = "Attack"
+	MAXRECENT  = 100 //event guids remembered against retried event tasks
+)
+
+//per attack type, Won/Defended are successes for the player
+type TypeStats struct {
+	Action   string  `json:"attack_type"`
+	Made     int64   `json:"made"`
+	Won      int64   `json:"won"`
+	Received int64   `json:"received"`
+	Defended int64   `json:"defended"`
+	WinRate  float64 `json:"win_rate"`
+}
+
+type Rival struct {
+	PlayerID int64  `json:"player_id"`
+	Nick     string `json:"nick"`
+	Attacks  int64  `json:"attacks"` //both directions
+	Won      int64  `json:"won"`
+}
+
+//parent player, keyname: player
+type PlayerStats struct {
+	AttacksMade     int64       `datastore:",noindex" json:"attacks_made"`
+	AttacksWon      int64       `datastore:",noindex" json:"attacks_won"`
+	AttacksReceived int64       `datastore:",noindex" json:"attacks_received"`
+	AttacksDefended int64       `datastore:",noindex" json:"attacks_defended"`
+	BwKilled        float64     `datastore:",noindex" json:"bw_killed"`
+	BwLost          float64     `datastore:",noindex" json:"bw_lost"`
+	ProgramsKilled  int64       `datastore:",noindex" json:"programs_killed"`
+	ProgramsLost    int64       `datastore:",noindex" json:"programs_lost"`
+	SpyRate         float64     `datastore:"-" json:"spy_success_rate"`
+	Types           []TypeStats `datastore:"-" json:"attack_types"`
+	Rivals          []Rival     `datastore:"-" json:"top_rivals"`
+	Breakdown       []byte      `json:"-"`
+	Recent          []string    `datastore:"-" json:"-"`
+}
+
+type statsBreakdown struct {
+	Types  []TypeStats
+	Rivals []Rival
+	Recent []string
+}
+
+func init() {
+	event.Handle(recordStats)
+}
+
+func rate(success, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(success) / float64(total) * 100
+}
+
+func (s *PlayerStats) Load(c <-chan datastore.Property) error {
+	if err := datastore.LoadStruct(s, c); err != nil {
+		return err
+	}
+	if len(s.Breakdown) > 0 {
+		var b statsBreakdown
+		if err := gob.NewDecoder(bytes.NewBuffer(s.Breakdown)).Decode(&b); err != nil {
+			return err
+		}
+		s.Types = b.Types
+		s.Rivals = b.Rivals
+		s.Recent = b.Recent
+	}
+	for i := range s.Types {
+		s.Types[i].WinRate = rate(s.Types[i].Won+s.Types[i].Defended, s.Types[i].Made+s.Types[i].Received)
+		if s.Types[i].Action == SPYACTION {
+			s.SpyRate = rate(s.Types[i].Won, s.Types[i].Made)
+		}
+	}
+	return nil
+}
+
+func (s *PlayerStats) Save(c chan<- datastore.Property) error {
+	var bBytes bytes.Buffer
+	if err := gob.NewEncoder(&bBytes).Encode(statsBreakdown{s.Types, s.Rivals, s.Recent}); err != nil {
+		return err
+	}
+	s.Breakdown = bBytes.Bytes()
+	return datastore.SaveStruct(s, c)
+}
+
+func (s *PlayerStats) typeStats(action string) *TypeStats {
+	for i := range s.Types {
+		if s.Types[i].Action == action {
+			return &s.Types[i]
+		}
+	}
+	s.Types = append(s.Types, TypeStats{Action: action})
+	return &s.Types[len(s.Types)-1]
+}
+
+func (s *PlayerStats) rival(id int64, nick string) *Rival {
+	for i := range s.Rivals {
+		if s.Rivals[i].PlayerID == id {
+			s.Rivals[i].Nick = nick
+			return &s.Rivals[i]
+		}
+	}
+	if len(s.Rivals) >= MAXRIVALS {
+		sort.Sort(byAttacks(s.Rivals))
+		s.Rivals = s.Rivals[:MAXRIVALS-1]
+	}
+	s.Rivals = append(s.Rivals, Rival{PlayerID: id, Nick: nick})
+	return &s.Rivals[len(s.Rivals)-1]
+}
+
+type byAttacks []Rival
+
+func (r byAttacks) Len() int           { return len(r) }
+func (r byAttacks) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byAttacks) Less(i, j int) bool { return r[i].Attacks > r[j].Attacks }
+
+//true when the event guid was counted before, otherwise remembers it
+func (s *PlayerStats) recorded(guid string) bool {
+	if guid == "" {
+		return false
+	}
+	for _, r := range s.Recent {
+		if r == guid {
+			return true
+		}
+	}
+	if len(s.Recent) >= MAXRECENT {
+		s.Recent = s.Recent[1:]
+	}
+	s.Recent = append(s.Recent, guid)
+	return false
+}
+
+//event owner is the player, Result is vis a vis the owner
+func (s *PlayerStats) add(e *event.Event) {
+	ts := s.typeStats(e.Action)
+	rv := s.rival(e.TargetID, e.TargetName)
+	rv.Attacks++
+	if e.Direction == event.OUT {
+		s.AttacksMade++
+		ts.Made++
+		if e.Result {
+			s.AttacksWon++
+			ts.Won++
+		}
+	} else {
+		s.AttacksReceived++
+		ts.Received++
+		if e.Result {
+			s.AttacksDefended++
+			ts.Defended++
+		}
+	}
+	if e.Result {
+		rv.Won++
+	}
+	s.BwKilled += e.BwKilled
+	s.BwLost += e.BwLost
+	s.ProgramsKilled += e.ProgramsKilled
+	s.ProgramsLost += e.ProgramsLost
+}
+
+func statsKey(c appengine.Context, playerKey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, "PlayerStats", playerKey.StringID(), 0, playerKey)
+}
+
+func recordStats(c appengine.Context, e *event.Event) error {
+	if e.EventType != STATSEVENT || e.Player == nil {
+		return nil
+	}
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		key := statsKey(c, e.Player)
+		stats := new(PlayerStats)
+		if err := datastore.Get(c, key, stats); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if stats.recorded(e.GUID) {
+			//retried event task
+			return nil
+		}
+		stats.add(e)
+		if _, err := datastore.Put(c, key, stats); err != nil {
+			return err
+		}
+		return nil
+	}, nil)
+}
+
+func Stats(c appengine.Context, playerKey *datastore.Key) (*PlayerStats, error) {
+	stats := new(PlayerStats)
+	if err := datastore.Get(c, statsKey(c, playerKey), stats); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	sort.Sort(byAttacks(stats.Rivals))
+	if len(stats.Rivals) > TOPRIVALS {
+		stats.Rivals = stats.Rivals[:TOPRIVALS]
+	}
+	return stats, nil
+}
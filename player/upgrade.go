@@ -0,0 +1,159 @@
+package player
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+	"fmt"
+	"math"
+	"mj0lk.be/netwars/event"
+	"mj0lk.be/netwars/program"
+	"time"
+)
+
+//Amount is the number of source units converted
+type UpgradeOrder struct {
+	PrgKey string `json:"prgkey"`
+	Amount int64  `json:"amount"`
+}
+
+var NoUpgradeError = errors.New("Error: program has no upgrade")
+
+func (p *Player) playerProgram(pprogramKey *datastore.Key) *PlayerProgram {
+	for _, group := range p.Programs {
+		for _, pp := range group.Programs {
+			if pp.DbKey.Equal(pprogramKey) {
+				return pp
+			}
+		}
+	}
+	return nil
+}
+
+//bandwidth check after removing amount source units and adding units upgraded ones
+func (p *Player) upgradeBandwidth(source *PlayerProgram, amount int64, target *program.Program, units int64) error {
+	if source.Bandwidth > 0 {
+		yGroup, ok := p.Programs[source.EffectorTypes]
+		if ok {
+			yield := float64(yGroup.Yield - source.Bandwidth*amount)
+			if target.EffectorTypes == source.EffectorTypes {
+				yield += float64(target.Bandwidth * units)
+			}
+			if yield < yGroup.Usage {
+				return NotEnoughBandwidthError
+			}
+		}
+	}
+	if program.CONN == program.CONN&target.Type {
+		return nil
+	}
+	group, ok := p.Programs[target.Type]
+	if !ok || !group.Power {
+		return NotEnoughBandwidthError
+	}
+	available := float64(group.Yield) - group.Usage
+	if source.Type == target.Type && source.Active {
+		available += source.BandwidthUsage * float64(amount)
+	}
+	if available < target.BandwidthUsage*float64(units) {
+		return NotEnoughBandwidthError
+	}
+	return nil
+}
+
+func Upgrade(c appengine.Context, playerStr string, order UpgradeOrder) error {
+	programKey, err := datastore.DecodeKey(order.PrgKey)
+	if err != nil {
+		return err
+	}
+	playerKey, err := datastore.DecodeKey(playerStr)
+	if err != nil {
+		return err
+	}
+	version, err := program.Version(c)
+	if err != nil {
+		return err
+	}
+	prog, err := program.KeyGet(c, programKey, version)
+	if err != nil {
+		return err
+	}
+	if prog.Upgrade == nil {
+		return NoUpgradeError
+	}
+	ratio := prog.UpgradeRatio()
+	if order.Amount <= 0 || order.Amount%ratio != 0 {
+		return errors.New(fmt.Sprintf("Amount must be a multiple of %d", ratio))
+	}
+	target, err := program.KeyGet(c, prog.Upgrade, version)
+	if err != nil {
+		return err
+	}
+	if prog.Type == program.INF || target.Type == program.INF {
+		return errors.New("Can't upgrade INFECT program")
+	}
+	units := order.Amount / ratio
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		iplayer := new(Player)
+		if err := Status(c, playerStr, iplayer); err != nil {
+			return err
+		}
+		source := iplayer.playerProgram(PlayerProgramKey(c, playerKey, programKey))
+		if source == nil || source.Amount < order.Amount {
+			return errors.New("Error: not enough programs to upgrade")
+		}
+		if err := iplayer.Unlocked(c, target); err != nil {
+			return err
+		}
+		cycles := prog.UpgradeCycles * units
+		memory := int64(math.Ceil(prog.UpgradeMemory * float64(units)))
+		if cycles > iplayer.Cycles {
+			return errors.New("Error not enough cycles")
+		} else if memory > iplayer.Memory {
+			return errors.New("Error: not enough memory")
+		}
+		if err := iplayer.upgradeBandwidth(source, order.Amount, target, units); err != nil {
+			return err
+		}
+		targetKey := PlayerProgramKey(c, playerKey, prog.Upgrade)
+		upgraded := iplayer.playerProgram(targetKey)
+		if upgraded == nil {
+			upgraded = &PlayerProgram{
+				Program:    *target,
+				ProgramKey: prog.Upgrade,
+				DbKey:      targetKey,
+				Active:     true,
+			}
+		}
+		source.Amount -= order.Amount
+		upgraded.Amount += units
+		iplayer.Cycles -= cycles
+		iplayer.Memory -= memory
+		iplayer.BandwidthUsage += float64(units)*upgraded.BandwidthUsage - float64(order.Amount)*source.BandwidthUsage
+		keys := []*datastore.Key{iplayer.DbKey, source.DbKey, upgraded.DbKey}
+		models := []interface{}{iplayer, source, upgraded}
+		if _, err := datastore.PutMulti(c, keys, models); err != nil {
+			return err
+		}
+		e := &event.Event{
+			Player:            playerKey,
+			Created:           time.Now(),
+			Direction:         event.IN,
+			EventType:         "Upgrade",
+			PlayerName:        iplayer.Nick,
+			PlayerID:          iplayer.ID,
+			NewBandwidthUsage: iplayer.BandwidthUsage,
+			Memory:            memory,
+			Action:            "Upgrade",
+			Cycles:            cycles,
+			EventPrograms: []event.EventProgram{
+				event.EventProgram{Name: source.Name, Amount: order.Amount, Owned: true},
+				event.EventProgram{Name: upgraded.Name, Amount: units, Owned: true},
+			},
+		}
+		if err := event.Send(c, []*event.Event{e}, event.Func); err != nil {
+			return err
+		}
+		return nil
+	}, nil)
+}
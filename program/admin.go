@@ -0,0 +1,275 @@
+package program
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var DisabledError = errors.New("Program is disabled")
+
+//json fields left out of a diff, the keys are diffed through their names
+var undiffed = map[string]bool{
+	"program_key": true,
+	"version":     true,
+	"infect":      true,
+	"upgrade":     true,
+}
+
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+type ProgramDiff struct {
+	Name    string        `json:"name"`
+	Created bool          `json:"created"`
+	DryRun  bool          `json:"dry_run"`
+	Version int64         `json:"version"` //catalogue version after the change
+	Changes []FieldChange `json:"changes"`
+}
+
+type Removal struct {
+	Name     string `json:"name"`
+	Disabled bool   `json:"disabled"` //still owned, disabled instead of removed
+	Version  int64  `json:"version"`
+}
+
+//derived fields as they are after a save and load
+func normalize(c appengine.Context, p *Program) {
+	if len(p.InfectName) > 0 {
+		p.Infect = datastore.NewKey(c, "Program", p.InfectName, 0, nil)
+	}
+	if len(p.UpgradeName) > 0 {
+		p.Upgrade = datastore.NewKey(c, "Program", p.UpgradeName, 0, nil)
+	}
+	Save(p)
+	p.Effectors = nil
+	Load(p)
+}
+
+//programs of the same patch take precedence over the catalogue
+func reference(c appengine.Context, name string, patched map[string]*Program) (*Program, error) {
+	if ref, ok := patched[name]; ok {
+		Save(ref)
+		return ref, nil
+	}
+	ref := new(Program)
+	if err := datastore.Get(c, datastore.NewKey(c, "Program", name, 0, nil), ref); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return ref, nil
+}
+
+func Validate(c appengine.Context, p *Program) error {
+	return validate(c, p, nil)
+}
+
+func validate(c appengine.Context, p *Program, patched map[string]*Program) error {
+	var errString string
+	if len(p.Name) == 0 && len(p.EncodedKey) == 0 {
+		errString += "Name program required\n"
+	}
+	if _, ok := ProgramType[p.TypeName]; !ok {
+		errString += fmt.Sprintf("Unknown program type %s\n", p.TypeName)
+	}
+	for _, effector := range p.Effectors {
+		if _, ok := ProgramType[strings.TrimSpace(effector)]; !ok {
+			errString += fmt.Sprintf("Unknown effector %s\n", effector)
+		}
+	}
+	if len(p.InfectName) > 0 {
+		ref, err := reference(c, p.InfectName, patched)
+		if err != nil {
+			return err
+		}
+		if ref == nil {
+			errString += fmt.Sprintf("Infect program %s does not exist\n", p.InfectName)
+		} else if ref.Type != INF {
+			errString += fmt.Sprintf("Infect program %s is not of type %s\n", p.InfectName, ProgramName[INF])
+		}
+	}
+	if len(p.UpgradeName) > 0 {
+		ref, err := reference(c, p.UpgradeName, patched)
+		if err != nil {
+			return err
+		}
+		if ref == nil || p.UpgradeName == p.Name {
+			errString += fmt.Sprintf("Upgrade program %s does not exist\n", p.UpgradeName)
+		}
+	}
+	for _, name := range p.Requires {
+		ref, err := reference(c, name, patched)
+		if err != nil {
+			return err
+		}
+		if ref == nil || name == p.Name {
+			errString += fmt.Sprintf("Required program %s does not exist\n", name)
+		}
+	}
+	if len(errString) > 0 {
+		return errors.New(errString)
+	}
+	return nil
+}
+
+//effectors are loaded from a map, sorted so their order is no change
+func jsonFields(p *Program) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	sorted := *p
+	sorted.Effectors = append([]string(nil), p.Effectors...)
+	sort.Strings(sorted.Effectors)
+	data, err := json.Marshal(&sorted)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+//changes from current to update, current nil for a new program
+func diff(current, update *Program) ([]FieldChange, error) {
+	after, err := jsonFields(update)
+	if err != nil {
+		return nil, err
+	}
+	before := make(map[string]interface{})
+	if current != nil {
+		if before, err = jsonFields(current); err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, 0, len(after))
+	for name := range after {
+		if !undiffed[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	changes := make([]FieldChange, 0)
+	for _, name := range names {
+		if !reflect.DeepEqual(before[name], after[name]) {
+			changes = append(changes, FieldChange{name, before[name], after[name]})
+		}
+	}
+	return changes, nil
+}
+
+//admin only, validates and diffs the program against the catalogue, stores it unless dryRun
+func Manage(c appengine.Context, playerStr string, update Program, dryRun bool) (ProgramDiff, error) {
+	if err := Admin(c, playerStr); err != nil {
+		return ProgramDiff{}, err
+	}
+	if err := Validate(c, &update); err != nil {
+		return ProgramDiff{}, err
+	}
+	pkey, err := programKey(c, &update)
+	if err != nil {
+		return ProgramDiff{}, err
+	}
+	update.Name = pkey.StringID()
+	normalize(c, &update)
+	current := new(Program)
+	if err := datastore.Get(c, pkey, current); err == datastore.ErrNoSuchEntity {
+		current = nil
+	} else if err != nil {
+		return ProgramDiff{}, err
+	} else {
+		current.Name = pkey.StringID()
+	}
+	changes, err := diff(current, &update)
+	if err != nil {
+		return ProgramDiff{}, err
+	}
+	result := ProgramDiff{Name: update.Name, Created: current == nil, DryRun: dryRun, Changes: changes}
+	if dryRun || len(changes) == 0 {
+		result.Version, err = Version(c)
+		return result, err
+	}
+	result.Version, err = ApplyPatch(c, Patch{Note: "admin update " + update.Name, Programs: []Program{update}})
+	return result, err
+}
+
+//any player program with programs left
+func owned(c appengine.Context, pkey *datastore.Key) (bool, error) {
+	t := datastore.NewQuery("PlayerProgram").Filter("ProgramKey =", pkey).Run(c)
+	for {
+		var props datastore.PropertyList
+		_, err := t.Next(&props)
+		if err == datastore.Done {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		for _, prop := range props {
+			if amount, ok := prop.Value.(int64); ok && prop.Name == "Amount" && amount > 0 {
+				return true, nil
+			}
+		}
+	}
+}
+
+//admin only, refuses programs referenced by other programs and disables owned ones
+func Remove(c appengine.Context, playerStr, pKeyStr string) (Removal, error) {
+	if err := Admin(c, playerStr); err != nil {
+		return Removal{}, err
+	}
+	pkey, err := datastore.DecodeKey(pKeyStr)
+	if err != nil {
+		return Removal{}, err
+	}
+	current := new(Program)
+	if err := datastore.Get(c, pkey, current); err != nil {
+		return Removal{}, err
+	}
+	name := pkey.StringID()
+	var programs []Program
+	keys, err := datastore.NewQuery("Program").GetAll(c, &programs)
+	if err != nil {
+		return Removal{}, err
+	}
+	for i, p := range programs {
+		referenced := p.InfectName == name || p.UpgradeName == name
+		for _, required := range p.Requires {
+			referenced = referenced || required == name
+		}
+		if referenced {
+			return Removal{}, errors.New(fmt.Sprintf("Program %s is referenced by %s", name, keys[i].StringID()))
+		}
+	}
+	isOwned, err := owned(c, pkey)
+	if err != nil {
+		return Removal{}, err
+	}
+	result := Removal{Name: name, Disabled: isOwned}
+	if isOwned {
+		current.Name = name
+		current.Disabled = true
+		result.Version, err = ApplyPatch(c, Patch{Note: "disable " + name, Programs: []Program{*current}})
+		return result, err
+	}
+	catalogue, err := settle(c)
+	if err != nil {
+		return Removal{}, err
+	}
+	result.Version = catalogue.Version + 1
+	if err := recordPatch(c, catalogue.Version, result.Version, "remove "+name, []string{name}, nil); err != nil {
+		return Removal{}, err
+	}
+	if _, err := applyVersion(c, result.Version); err != nil {
+		return Removal{}, err
+	}
+	return result, nil
+}
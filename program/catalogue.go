@@ -0,0 +1,252 @@
+package program
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/json"
+	"errors"
+	"mj0lk.be/netwars/cache"
+	"time"
+)
+
+const (
+	CATALOGUE    = "programs"
+	VERSIONCACHE = "CatalogueVersion"
+	PATCHLIMIT   = 20
+)
+
+var NotAdminError = errors.New("Administrator access required")
+var ConcurrentPatchError = errors.New("Catalogue changed during patch, retry")
+
+//keyname: CATALOGUE
+type Catalogue struct {
+	Version int64     `json:"version"`
+	Pending int64     `datastore:",noindex" json:"pending"` //recorded patch whose programs are being written
+	Updated time.Time `json:"updated"`
+}
+
+//parent catalogue, keyid: version
+type CataloguePatch struct {
+	Version  int64     `json:"version"`
+	Note     string    `datastore:",noindex" json:"note"`
+	Names    []string  `datastore:",noindex" json:"programs"`
+	Programs []byte    `json:"-"` //json encoded programs as applied
+	Applied  time.Time `json:"applied"`
+}
+
+type Patch struct {
+	Note     string    `json:"note"`
+	Programs []Program `json:"programs"`
+}
+
+//refreshes data derived from the patched programs (player programs)
+type PatchFunc func(c appengine.Context, version int64, keys []*datastore.Key) error
+
+var patchFuncs []PatchFunc
+
+//register from init (player)
+func RegisterPatchFunc(f PatchFunc) {
+	patchFuncs = append(patchFuncs, f)
+}
+
+type AdminFunc func(c appengine.Context, playerStr string) (bool, error)
+
+var adminFunc AdminFunc
+
+//register from init (player)
+func RegisterAdminFunc(f AdminFunc) {
+	adminFunc = f
+}
+
+func Admin(c appengine.Context, playerStr string) error {
+	if adminFunc == nil {
+		return NotAdminError
+	}
+	ok, err := adminFunc(c, playerStr)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return NotAdminError
+	}
+	return nil
+}
+
+func catalogueKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Catalogue", CATALOGUE, 0, nil)
+}
+
+func Version(c appengine.Context) (int64, error) {
+	catalogue := new(Catalogue)
+	if cache.Get(c, VERSIONCACHE, catalogue) {
+		return catalogue.Version, nil
+	}
+	if err := datastore.Get(c, catalogueKey(c), catalogue); err != nil && err != datastore.ErrNoSuchEntity {
+		return 0, err
+	}
+	cache.Set(c, VERSIONCACHE, catalogue)
+	return catalogue.Version, nil
+}
+
+//completes a patch left pending by an interrupted request, returns the settled catalogue
+func settle(c appengine.Context) (*Catalogue, error) {
+	current := new(Catalogue)
+	if err := datastore.Get(c, catalogueKey(c), current); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	if current.Pending == 0 {
+		return current, nil
+	}
+	if _, err := applyVersion(c, current.Pending); err != nil {
+		return nil, err
+	}
+	current.Version, current.Pending = current.Pending, 0
+	return current, nil
+}
+
+//stores the programs as a new catalogue version, returns the version. every program is validated,
+//one invalid program rejects the patch
+func ApplyPatch(c appengine.Context, patch Patch) (int64, error) {
+	if len(patch.Programs) == 0 {
+		return 0, errors.New("Patch without programs")
+	}
+	current, err := settle(c)
+	if err != nil {
+		return 0, err
+	}
+	programs := make([]Program, 0, len(patch.Programs))
+	names := make([]string, 0, len(patch.Programs))
+	patched := make(map[string]*Program, len(patch.Programs))
+	for i := range patch.Programs {
+		pkey, err := programKey(c, &patch.Programs[i])
+		if err != nil {
+			return 0, err
+		}
+		patch.Programs[i].Name = pkey.StringID()
+		patched[pkey.StringID()] = &patch.Programs[i]
+	}
+	var errString string
+	for i := range patch.Programs {
+		if err := validate(c, &patch.Programs[i], patched); err != nil {
+			errString += err.Error()
+		}
+	}
+	if len(errString) > 0 {
+		return 0, errors.New(errString)
+	}
+	version := current.Version + 1
+	for _, program := range patch.Programs {
+		program.Version = version
+		programs = append(programs, program)
+		names = append(names, program.Name)
+	}
+	data, err := json.Marshal(programs)
+	if err != nil {
+		return 0, err
+	}
+	if err := recordPatch(c, current.Version, version, patch.Note, names, data); err != nil {
+		return 0, err
+	}
+	keys, err := applyVersion(c, version)
+	if err != nil {
+		return version, err
+	}
+	for _, f := range patchFuncs {
+		if err := f(c, version, keys); err != nil {
+			return version, err
+		}
+	}
+	return version, nil
+}
+
+//reserves version for the patch, programs are written by applyVersion
+func recordPatch(c appengine.Context, current, version int64, note string, names []string, data []byte) error {
+	record := &CataloguePatch{
+		Version:  version,
+		Note:     note,
+		Names:    names,
+		Programs: data,
+		Applied:  time.Now(),
+	}
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		catalogue := new(Catalogue)
+		if err := datastore.Get(c, catalogueKey(c), catalogue); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if catalogue.Version != current || catalogue.Pending != 0 {
+			return ConcurrentPatchError
+		}
+		catalogue.Pending = version
+		patchKey := datastore.NewKey(c, "CataloguePatch", "", version, catalogueKey(c))
+		if _, err := datastore.PutMulti(c, []*datastore.Key{catalogueKey(c), patchKey},
+			[]interface{}{catalogue, record}); err != nil {
+			return err
+		}
+		return nil
+	}, nil)
+}
+
+//writes the programs recorded for version (deletes them for a removal) and bumps the catalogue,
+//safe to repeat. cached programs are keyed by version so the bump invalidates them
+func applyVersion(c appengine.Context, version int64) ([]*datastore.Key, error) {
+	record := new(CataloguePatch)
+	if err := datastore.Get(c, datastore.NewKey(c, "CataloguePatch", "", version, catalogueKey(c)), record); err != nil {
+		return nil, err
+	}
+	keys := make([]*datastore.Key, len(record.Names))
+	for i, name := range record.Names {
+		keys[i] = datastore.NewKey(c, "Program", name, 0, nil)
+	}
+	if len(record.Programs) == 0 {
+		if err := datastore.DeleteMulti(c, keys); err != nil {
+			return nil, err
+		}
+	} else {
+		var programs []Program
+		if err := json.Unmarshal(record.Programs, &programs); err != nil {
+			return nil, err
+		}
+		for i := range programs {
+			program := &programs[i]
+			program.Infect, program.Upgrade = nil, nil
+			if len(program.InfectName) > 0 {
+				program.Infect = datastore.NewKey(c, "Program", program.InfectName, 0, nil)
+			}
+			if len(program.UpgradeName) > 0 {
+				program.Upgrade = datastore.NewKey(c, "Program", program.UpgradeName, 0, nil)
+			}
+		}
+		if _, err := datastore.PutMulti(c, keys, programs); err != nil {
+			return nil, err
+		}
+	}
+	catalogue := new(Catalogue)
+	if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Get(c, catalogueKey(c), catalogue); err != nil {
+			return err
+		}
+		if catalogue.Pending != version {
+			return nil
+		}
+		catalogue.Version = version
+		catalogue.Pending = 0
+		catalogue.Updated = time.Now()
+		_, err := datastore.Put(c, catalogueKey(c), catalogue)
+		return err
+	}, nil); err != nil {
+		return nil, err
+	}
+	cache.Set(c, VERSIONCACHE, catalogue)
+	memprograms.Sync(catalogue.Version)
+	return keys, nil
+}
+
+//most recent first
+func Patches(c appengine.Context) ([]CataloguePatch, error) {
+	patches := make([]CataloguePatch, 0, PATCHLIMIT)
+	if _, err := datastore.NewQuery("CataloguePatch").Ancestor(catalogueKey(c)).Order("-Version").
+		Limit(PATCHLIMIT).GetAll(c, &patches); err != nil {
+		return nil, err
+	}
+	return patches, nil
+}
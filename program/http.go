@@ -1,7 +1,6 @@
 package program
 
 import (
-	"encoding/json"
 	"mj0lk.be/netwars/app"
 	"net/http"
 )
@@ -28,17 +27,53 @@ func GetProgram(w http.ResponseWriter, r *http.Request, c app.Context) {
 	res.JSONf(w)
 }
 
-func CreateOrUpdateProgram(w http.ResponseWriter, r *http.Request, c app.Context) {
-	program := new(Program)
-	json.NewDecoder(r.Body).Decode(program)
-	if err := CreateOrUpdate(c, program); err != nil {
-		res := app.JSONResult{Success: false, Error: err.Error()}
+func manageProgram(w http.ResponseWriter, r *http.Request, c app.Context, dryRun bool) {
+	var res app.JSONResult
+	program := Program{}
+	if err := app.DecodeJsonBody(r, &program); err != nil {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
 		res.JSONf(w)
+		return
+	}
+	diff, err := Manage(c, c.User, program, dryRun)
+	if err == NotAdminError {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusForbidden, Error: err.Error()}
+	} else if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: diff}
+	}
+	res.JSONf(w)
+}
+
+func CreateOrUpdateProgram(w http.ResponseWriter, r *http.Request, c app.Context) {
+	manageProgram(w, r, c, false)
+}
+
+func DiffProgram(w http.ResponseWriter, r *http.Request, c app.Context) {
+	manageProgram(w, r, c, true)
+}
+
+func RemoveProgram(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	removal, err := Remove(c, c.User, c.Param("program_key"))
+	if err == NotAdminError {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusForbidden, Error: err.Error()}
+	} else if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: removal}
 	}
+	res.JSONf(w)
 }
 
 func LoadPrograms(w http.ResponseWriter, r *http.Request, c app.Context) {
 	var res app.JSONResult
+	if err := Admin(c, c.User); err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusForbidden, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
 	if err := LoadFromFile(c); err != nil {
 		res = app.JSONResult{Success: false, Error: err.Error()}
 	} else {
@@ -46,3 +81,36 @@ func LoadPrograms(w http.ResponseWriter, r *http.Request, c app.Context) {
 	}
 	res.JSONf(w)
 }
+
+func ApplyBalancePatch(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	if err := Admin(c, c.User); err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusForbidden, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
+	patch := Patch{}
+	if err := app.DecodeJsonBody(r, &patch); err != nil {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
+	version, err := ApplyPatch(c, patch)
+	if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: version}
+	}
+	res.JSONf(w)
+}
+
+func BalancePatches(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	patches, err := Patches(c)
+	if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: patches}
+	}
+	res.JSONf(w)
+}
@@ -22,6 +22,7 @@ const (
 	INT  int64 = 1 << iota
 	ICE  int64 = 1 << iota
 	INF  int64 = 1 << iota
+	CINT int64 = 1 << iota
 )
 
 var ProgramName = map[int64]string{
@@ -34,28 +35,38 @@ var ProgramName = map[int64]string{
 	64:  "Intelligence",
 	128: "Ice",
 	256: "Infect",
+	512: "Counter-intelligence",
 }
 
 var ProgramType = map[string]int64{
-	"Swarm":         1,
-	"Mutator":       2,
-	"Hunter/Killer": 4,
-	"d0s":           8,
-	"Firewall":      16,
-	"Connection":    32,
-	"Intelligence":  64,
-	"Ice":           128,
-	"Infect":        256,
+	"Swarm":                1,
+	"Mutator":              2,
+	"Hunter/Killer":        4,
+	"d0s":                  8,
+	"Firewall":             16,
+	"Connection":           32,
+	"Intelligence":         64,
+	"Ice":                  128,
+	"Infect":               256,
+	"Counter-intelligence": 512,
 }
 
 type ProgramMap struct {
 	//lock sync.RWMutex
-	m map[string]*Program
+	m       map[string]*Program
+	version int64
 }
 
 var memprograms *ProgramMap = &ProgramMap{m: make(map[string]*Program)}
 
-//no need for synchro, data should never change
+//data only changes with a new catalogue version, the map is dropped when it is outdated
+func (s *ProgramMap) Sync(version int64) {
+	if s.version != version {
+		s.m = make(map[string]*Program)
+		s.version = version
+	}
+}
+
 func (s *ProgramMap) Get(key string) (*Program, bool) {
 	//s.lock.RLock()
 	//defer s.lock.RUnlock()
@@ -90,6 +101,30 @@ type Program struct {
 	Infect         *datastore.Key `json:"infect"`
 	InfectName     string         `json:"infect_name" datastore:"-"`
 	InfectAmount   int64          `json:"infect_amount"`
+	Requires       []string       `datastore:",noindex" json:"requires"` //program names
+	RequiredAps    int64          `datastore:",noindex" json:"required_aps"`
+	ResearchCycles int64          `datastore:",noindex" json:"research_cost"`
+	ResearchTime   int64          `datastore:",noindex" json:"research_time"` //seconds
+	Upgrade        *datastore.Key `datastore:",noindex" json:"upgrade"`
+	UpgradeName    string         `json:"upgrade_name" datastore:"-"`
+	UpgradeAmount  int64          `datastore:",noindex" json:"upgrade_amount"` //units consumed per upgraded unit
+	UpgradeCycles  int64          `datastore:",noindex" json:"upgrade_cycles"` //per upgraded unit
+	UpgradeMemory  float64        `datastore:",noindex" json:"upgrade_memory"` //per upgraded unit
+	Version        int64          `datastore:",noindex" json:"version"`        //catalogue version of last change
+	Disabled       bool           `datastore:",noindex" json:"disabled"`       //kept for owners, no new allocations
+}
+
+//units of this program needed for one unit of its upgrade
+func (p *Program) UpgradeRatio() int64 {
+	if p.UpgradeAmount < 1 {
+		return 1
+	}
+	return p.UpgradeAmount
+}
+
+//programs without research cost are unlocked once prerequisites are met
+func (p *Program) NeedsResearch() bool {
+	return p.ResearchCycles > 0 || p.ResearchTime > 0
 }
 
 func (p *Program) Load(c <-chan datastore.Property) error {
@@ -119,6 +154,9 @@ func Load(p *Program) {
 	if p.Infect != nil {
 		p.InfectName = p.Infect.StringID()
 	}
+	if p.Upgrade != nil {
+		p.UpgradeName = p.Upgrade.StringID()
+	}
 	p.TypeName = ProgramName[p.Type]
 	p.BandwidthUsage = float64(p.Cycles / 10) //(1 / p.Memory) * float64(p.Cycles)
 }
@@ -134,20 +172,23 @@ func Save(p *Program) {
 	}
 }
 
-func KeyGet(c appengine.Context, pKey *datastore.Key) (*Program, error) {
+//version of the catalogue, callers read it once per request with Version
+func KeyGet(c appengine.Context, pKey *datastore.Key, version int64) (*Program, error) {
+	memprograms.Sync(version)
 	stringId := pKey.StringID()
 	if program, ok := memprograms.Get(stringId); ok {
 		return program, nil
 	}
 	program := new(Program)
-	if !cache.Get(c, stringId, program) {
+	cacheKey := fmt.Sprintf("%s.v%d", stringId, version)
+	if !cache.Get(c, cacheKey, program) {
 		if err := datastore.Get(c, pKey, program); err != nil {
 			return nil, err
 		}
 		program.Name = stringId
 		program.DbKey = pKey
 		program.EncodedKey = pKey.Encode()
-		cache.Set(c, stringId, program)
+		cache.Set(c, cacheKey, program)
 	}
 	memprograms.Set(stringId, program)
 	return program, nil
@@ -158,7 +199,11 @@ func Get(c appengine.Context, pKeyStr string) (*Program, error) {
 	if err != nil {
 		return nil, err
 	}
-	program, err := KeyGet(c, programKey)
+	version, err := Version(c)
+	if err != nil {
+		return nil, err
+	}
+	program, err := KeyGet(c, programKey, version)
 	if err != nil {
 		return nil, err
 	}
@@ -178,6 +223,9 @@ func GetAll(c appengine.Context, programs map[string][]Program) error {
 		p.DbKey = key
 		p.EncodedKey = key.Encode()
 		p.Name = key.StringID()
+		if p.Disabled {
+			continue
+		}
 		programs[p.TypeName] = append(programs[p.TypeName], p)
 
 	}
@@ -190,49 +238,35 @@ func LoadFromFile(c appengine.Context) error {
 		return err
 	}
 	var jsontype []Program
-	json.Unmarshal(file, &jsontype)
-	var errString string
-	for _, program := range jsontype {
-		if err := CreateOrUpdate(c, &program); err != nil {
-			errString += fmt.Sprintf("%s\n", err.Error())
-		}
+	if err := json.Unmarshal(file, &jsontype); err != nil {
+		return err
 	}
-	if len(errString) > 0 {
-		return errors.New(errString)
+	_, err = ApplyPatch(c, Patch{Note: "programs file", Programs: jsontype})
+	return err
+}
+
+func programKey(c appengine.Context, program *Program) (*datastore.Key, error) {
+	if len(program.EncodedKey) > 0 {
+		return datastore.DecodeKey(program.EncodedKey)
 	}
-	return nil
+	if len(program.Name) > 0 {
+		return datastore.NewKey(c, "Program", program.Name, 0, nil), nil
+	}
+	return nil, errors.New("Name program required")
 }
 
+//single program patch
 func CreateOrUpdate(c appengine.Context, program *Program) error {
-	var pkey *datastore.Key
-	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
-		var err error
-		if len(program.EncodedKey) > 0 {
-			pkey, err = datastore.DecodeKey(program.EncodedKey)
-			if err != nil {
-				return err
-			}
-		} else {
-			if len(program.Name) > 0 {
-				pkey = datastore.NewKey(c, "Program", program.Name, 0, nil)
-			} else {
-				return errors.New("Name program required")
-			}
-		}
-		if len(program.InfectName) > 0 {
-			program.Infect = datastore.NewKey(c, "Program", program.InfectName, 0, nil)
-		}
-		if _, err := datastore.Put(c, pkey, program); err != nil {
-			return err
-		}
-
-		return nil
-	}, nil)
+	version, err := ApplyPatch(c, Patch{Note: "update " + program.Name, Programs: []Program{*program}})
+	if err != nil {
+		return err
+	}
+	pkey, err := programKey(c, program)
 	if err != nil {
 		return err
 	}
 	//get for development
-	if _, err := KeyGet(c, pkey); err != nil {
+	if _, err := KeyGet(c, pkey, version); err != nil {
 		return err
 	}
 	return nil
@@ -1,6 +1,7 @@
 package program
 
 import (
+	"appengine"
 	"appengine/aetest"
 	"appengine/datastore"
 	"testing"
@@ -114,3 +115,124 @@ func TestGetAll(t *testing.T) {
 		t.Fatalf("error: %s", err)
 	}
 }*/
+
+func TestApplyPatch(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	jprogram := Program{
+		Name:      "Swarm mark IV",
+		Attack:    65,
+		Life:      70,
+		TypeName:  "Swarm",
+		Cycles:    70,
+		Memory:    0.5,
+		Effectors: []string{"Swarm"},
+	}
+	version, err := ApplyPatch(c, Patch{"initial", []Program{jprogram}})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	programKey := datastore.NewKey(c, "Program", jprogram.Name, 0, nil)
+	program, err := KeyGet(c, programKey, version)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if program.Attack != 65 || program.Version != version {
+		t.Fatalf("unexpected program %+v", program)
+	}
+	jprogram.Attack = 50
+	patched, err := ApplyPatch(c, Patch{"nerf swarm", []Program{jprogram}})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if patched != version+1 {
+		t.Fatalf("expected version %d got %d", version+1, patched)
+	}
+	program, err = KeyGet(c, programKey, patched)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if program.Attack != 50 {
+		t.Fatalf("stale program after patch, attack %d", program.Attack)
+	}
+	ice := Program{Name: "Ice mark I", TypeName: "Ice", InfectName: "Infect mark I"}
+	if _, err := ApplyPatch(c, Patch{"missing infect", []Program{ice}}); err == nil {
+		t.Fatalf("expected missing infect program error")
+	}
+	locked := Program{Name: "Swarm mark V", TypeName: "Swarm", Requires: []string{"Swarm mark X"}}
+	if _, err := ApplyPatch(c, Patch{"missing prerequisite", []Program{locked}}); err == nil {
+		t.Fatalf("expected missing required program error")
+	}
+	infect := Program{Name: "Infect mark I", TypeName: "Infect"}
+	if _, err := ApplyPatch(c, Patch{"ice", []Program{ice, infect}}); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	patches, err := Patches(c)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	t.Logf("patches %+v", patches)
+}
+
+func TestManage(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	RegisterAdminFunc(func(c appengine.Context, playerStr string) (bool, error) {
+		return true, nil
+	})
+	defer RegisterAdminFunc(nil)
+	jprogram := Program{
+		Name:      "Swarm mark IV",
+		Attack:    65,
+		Life:      70,
+		TypeName:  "Swarm",
+		Cycles:    70,
+		Memory:    0.5,
+		Effectors: []string{"Swarm", "Hunter/Killer"},
+	}
+	invalid := jprogram
+	invalid.TypeName = "Virus"
+	if _, err := Manage(c, "", invalid, true); err == nil {
+		t.Fatalf("expected unknown type error")
+	}
+	invalid = jprogram
+	invalid.InfectName = "missing"
+	if _, err := Manage(c, "", invalid, true); err == nil {
+		t.Fatalf("expected missing infect program error")
+	}
+	diff, err := Manage(c, "", jprogram, true)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if !diff.Created || len(diff.Changes) == 0 {
+		t.Fatalf("unexpected dry run diff %+v", diff)
+	}
+	programKey := datastore.NewKey(c, "Program", jprogram.Name, 0, nil)
+	if err := datastore.Get(c, programKey, new(Program)); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("dry run stored program %v", err)
+	}
+	if _, err := Manage(c, "", jprogram, false); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	jprogram.Attack = 50
+	diff, err = Manage(c, "", jprogram, true)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if diff.Created || len(diff.Changes) != 1 || diff.Changes[0].Field != "attack" {
+		t.Fatalf("unexpected diff %+v", diff)
+	}
+	removal, err := Remove(c, "", programKey.Encode())
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if removal.Disabled {
+		t.Fatalf("unowned program disabled instead of removed")
+	}
+}
@@ -1,13 +1,16 @@
 package router
 
 import (
+	"mj0lk.be/netwars/achievement"
 	"mj0lk.be/netwars/app"
 	"mj0lk.be/netwars/attack"
 	"mj0lk.be/netwars/clan"
+	"mj0lk.be/netwars/config"
 	"mj0lk.be/netwars/event"
 	"mj0lk.be/netwars/message"
 	"mj0lk.be/netwars/player"
 	"mj0lk.be/netwars/program"
+	"mj0lk.be/netwars/season"
 	"net/http"
 )
 
@@ -26,7 +29,7 @@ var API = Routes{
 		[]string{"/players/"},
 		"PUT",
 		player.CreatePlayer,
-		player.Creation{"blabla@mail.com", "nickname", "password"},
+		player.Creation{"blabla@mail.com", "nickname", "password", "email invite token (optional)"},
 		app.JSONResult{Result: "token"},
 		false,
 	},
@@ -57,6 +60,60 @@ var API = Routes{
 		http.StatusOK,
 		true,
 	},
+	Route{
+		"convert programs into their upgraded variant, amount is the number of programs converted",
+		[]string{"/players/upgrades/"},
+		"POST",
+		player.UpgradePrograms,
+		player.UpgradeOrder{PrgKey: "program key", Amount: 2},
+		http.StatusOK,
+		true,
+	},
+	Route{
+		"lend programs to a clanmate for duration seconds (10 minutes - 24 hours), survivors return to the lender",
+		[]string{"/players/loans/"},
+		"POST",
+		player.LendPrograms,
+		player.LoanOrder{PrgKey: "program key", Amount: 5, BorrowerID: 2, Duration: 3600},
+		app.JSONResult{Result: player.Loan{}},
+		true,
+	},
+	Route{
+		"programs lent and running loans received",
+		[]string{"/players/loans/"},
+		"GET",
+		player.PlayerLoans,
+		nil,
+		app.JSONResult{Result: player.LoanList{}},
+		true,
+	},
+	Route{
+		"dead player starts over with start resources and no programs, clan, research and scores are kept",
+		[]string{"/players/respawns/"},
+		"POST",
+		player.RespawnPlayer,
+		nil,
+		http.StatusOK,
+		true,
+	},
+	Route{
+		"start research of a locked program, prerequisites (programs, aps) must be met, costs cycles and time",
+		[]string{"/players/researches/"},
+		"POST",
+		player.ResearchProgram,
+		player.ResearchOrder{PrgKey: "program key"},
+		http.StatusOK,
+		true,
+	},
+	Route{
+		"retrieve running and completed research",
+		[]string{"/players/researches/"},
+		"GET",
+		player.ResearchList,
+		nil,
+		app.JSONResult{Result: []player.Research{player.Research{}}},
+		true,
+	},
 	Route{
 		"deallocate program",
 		[]string{"/players/deallocations/"},
@@ -151,6 +208,15 @@ var API = Routes{
 		http.StatusOK,
 		true,
 	},
+	Route{
+		"disband clan (leader only), members are released, wars closed and boards archived",
+		[]string{"/clans/"},
+		"DELETE",
+		clan.DisbandClan,
+		nil,
+		http.StatusOK,
+		true,
+	},
 	Route{
 		"retrieve clan status (private)",
 		[]string{"/clans/status/"},
@@ -160,6 +226,15 @@ var API = Routes{
 		app.JSONResult{Result: clan.Clan{}},
 		true,
 	},
+	Route{
+		"retrieve all achievements, earned badges are listed on the public player profile",
+		[]string{"/achievements/"},
+		"GET",
+		achievement.ListRules,
+		nil,
+		app.JSONResult{Result: []achievement.Rule{achievement.Rule{}}},
+		true,
+	},
 	Route{
 		"retrieve public clan status",
 		[]string{"/clans/profiles/:clan_id/"},
@@ -189,6 +264,15 @@ var API = Routes{
 		http.StatusOK,
 		true,
 	},
+	Route{
+		"invite someone who is not a player yet by email, signing up with the mailed token creates the invitation",
+		[]string{"/clans/invitations/emails/"},
+		"PUT",
+		clan.ClanEmailInvite,
+		clan.SendEmail{Email: "friend@mail.com"},
+		http.StatusOK,
+		true,
+	},
 	Route{
 		"retrieve current active invitations",
 		[]string{"/clans/invitations/"},
@@ -198,6 +282,42 @@ var API = Routes{
 		app.JSONResult{Result: []clan.Invite{clan.Invite{}}},
 		true,
 	},
+	Route{
+		"apply to join clan, lieutenants and leader approve or reject",
+		[]string{"/clans/profiles/:clan_id/applications/"},
+		"PUT",
+		clan.ApplyToClan,
+		clan.ApplicationMessage{Content: "message to clan"},
+		http.StatusOK,
+		true,
+	},
+	Route{
+		"retrieve open applications to join your clan (lieutenant or leader)",
+		[]string{"/clans/applications/"},
+		"GET",
+		clan.Applications,
+		nil,
+		app.JSONResult{Result: []clan.Application{clan.Application{}}},
+		true,
+	},
+	Route{
+		"approve application, player joins clan",
+		[]string{"/clans/applications/approvals/"},
+		"POST",
+		clan.ApproveApplication,
+		clan.SendKey{Key: "application key"},
+		http.StatusOK,
+		true,
+	},
+	Route{
+		"reject application",
+		[]string{"/clans/applications/rejections/"},
+		"POST",
+		clan.RejectApplication,
+		clan.SendKey{Key: "application key"},
+		http.StatusOK,
+		true,
+	},
 	Route{
 		"join clan for invitation",
 		[]string{"/clans/links/"},
@@ -279,6 +399,98 @@ var API = Routes{
 		http.StatusOK,
 		true,
 	},
+	Route{
+		"hand over clan leadership to another member, former leader takes over the rank of the new leader",
+		[]string{"/clans/leaderships/"},
+		"POST",
+		clan.EditLeader,
+		clan.SendID{},
+		http.StatusOK,
+		true,
+	},
+	Route{
+		"cron: hand over leadership of clans with an inactive or missing leader",
+		[]string{"/cron/clans/leaderships/"},
+		"GET",
+		clan.ReviewClanLeadership,
+		nil,
+		http.StatusOK,
+		false,
+	},
+	Route{
+		"deposit cycles in the clan treasury",
+		[]string{"/clans/treasuries/deposits/"},
+		"POST",
+		clan.DepositCycles,
+		clan.TreasuryTransfer{Amount: 500},
+		http.StatusOK,
+		true,
+	},
+	Route{
+		"grant cycles from the clan treasury to a member (lieutenant or leader, daily limit per rank)",
+		[]string{"/clans/treasuries/grants/"},
+		"POST",
+		clan.GrantCycles,
+		clan.TreasuryTransfer{PlayerID: 3546, Amount: 500},
+		http.StatusOK,
+		true,
+	},
+	Route{
+		"propose an alliance (type 1) or non-aggression pact (type 2) to another clan (leader only)",
+		[]string{"/clans/pacts/"},
+		"PUT",
+		clan.ProposeClanPact,
+		clan.PactProposal{ID: 12, Type: clan.ALLIANCE},
+		http.StatusOK,
+		true,
+	},
+	Route{
+		"accept a pact proposed by the clan with id (leader only)",
+		[]string{"/clans/pacts/acceptances/"},
+		"POST",
+		clan.AcceptClanPact,
+		clan.SendID{},
+		http.StatusOK,
+		true,
+	},
+	Route{
+		"reject a proposal or cancel a pact with the clan with id, cancelled pacts stay binding for 48h",
+		[]string{"/clans/pacts/cancellations/"},
+		"POST",
+		clan.CancelClanPact,
+		clan.SendID{},
+		http.StatusOK,
+		true,
+	},
+	Route{
+		`retrieve clan audit log (lieutenant or leader), arguments(optional) /action/player/cursor
+				action -> Promote, Kick, Message,... or all; player -> id of the acting player or 0; cursor -> paging`,
+		[]string{"/clans/audits/", "/clans/audits/:action/", "/clans/audits/:action/:player_id/",
+			"/clans/audits/:action/:player_id/:cursor_key/"},
+		"GET",
+		clan.AuditLog,
+		nil,
+		app.JSONResult{Result: clan.AuditList{Cursor: "paging", Entries: []clan.AuditEntry{clan.AuditEntry{}}}},
+		true,
+	},
+	Route{
+		"cron: hourly snapshot of clan and member bandwidth/cps, daily snapshot at midnight (UTC)",
+		[]string{"/cron/clans/statistics/"},
+		"GET",
+		clan.SnapshotClanStatistics,
+		nil,
+		http.StatusOK,
+		false,
+	},
+	Route{
+		"retrieve clan bandwidth/cps timeseries, bucket_name: hourly (last 7 days) or daily (last 90 days)",
+		[]string{"/clans/statistics/:bucket_name/"},
+		"GET",
+		clan.ClanStatisticsSeries,
+		nil,
+		app.JSONResult{Result: clan.ClanStatistics{Bucket: clan.HOURLY, Points: []clan.ClanSnapshot{clan.ClanSnapshot{}}}},
+		true,
+	},
 	Route{
 		"remove player from clan",
 		[]string{"/clans/removals/"},
@@ -299,6 +511,105 @@ var API = Routes{
 			Event: &event.Event{EventPrograms: []event.EventProgram{event.EventProgram{}}}}},
 		true,
 	},
+	Route{
+		"schedule an attack at launch time or after delay seconds (max 24h), resolved against the state at launch",
+		[]string{"/attacks/schedules/"},
+		"POST",
+		attack.ScheduleAttack,
+		attack.ScheduleCfg{Delay: 3600},
+		app.JSONResult{Result: attack.ScheduledAttack{}},
+		true,
+	},
+	Route{
+		"attacks waiting for launch",
+		[]string{"/attacks/schedules/"},
+		"GET",
+		attack.ScheduledAttacks,
+		nil,
+		app.JSONResult{Result: []attack.ScheduledAttack{attack.ScheduledAttack{}}},
+		true,
+	},
+	Route{
+		"cancel a scheduled attack before launch",
+		[]string{"/attacks/schedules/:schedule_key/"},
+		"DELETE",
+		attack.CancelScheduledAttack,
+		nil,
+		http.StatusOK,
+		true,
+	},
+	Route{
+		"lieutenant or leader opens a clan strike on a target, window in seconds (5-60 minutes)",
+		[]string{"/attacks/strikes/"},
+		"POST",
+		attack.OpenClanStrike,
+		attack.StrikeCfg{AttackType: attack.BAL, Window: 900},
+		app.JSONResult{Result: attack.Strike{}},
+		true,
+	},
+	Route{
+		"commit programs to an open strike of your clan (max 4 participants), resolved as one battle when the window closes",
+		[]string{"/attacks/strikes/commitments/"},
+		"POST",
+		attack.CommitToStrike,
+		attack.StrikeOrder{StrikeKey: "strike key", ActivePrograms: []attack.ActiveProgram{attack.ActiveProgram{}}},
+		http.StatusOK,
+		true,
+	},
+	Route{
+		"latest strikes of your clan with commitments and results",
+		[]string{"/attacks/strikes/"},
+		"GET",
+		attack.ClanStrikes,
+		nil,
+		app.JSONResult{Result: []attack.Strike{attack.Strike{}}},
+		true,
+	},
+	Route{
+		"set the false report fed to spies caught by your counter-intelligence, an empty report stops the deception",
+		[]string{"/attacks/deceptions/"},
+		"POST",
+		attack.FeedDeception,
+		attack.Deception{Report: []event.EventProgram{event.EventProgram{}}},
+		app.JSONResult{Result: attack.Deception{}},
+		true,
+	},
+	Route{
+		"false report fed to spies caught by your counter-intelligence",
+		[]string{"/attacks/deceptions/"},
+		"GET",
+		attack.PlayerDeception,
+		nil,
+		app.JSONResult{Result: attack.Deception{}},
+		true,
+	},
+	Route{
+		"your spy reports on a target and the ones your clanmates shared, newest first with freshness (fresh < 1h, aging < 24h, stale)",
+		[]string{"/attacks/reports/:target_id/"},
+		"GET",
+		attack.TargetReports,
+		nil,
+		app.JSONResult{Result: []attack.SpyReport{attack.SpyReport{}}},
+		true,
+	},
+	Route{
+		"share one of your spy reports with your clan or stop sharing it",
+		[]string{"/attacks/reports/shares/"},
+		"POST",
+		attack.ShareReport,
+		attack.ShareOrder{ReportKey: "report key", Shared: true},
+		http.StatusOK,
+		true,
+	},
+	Route{
+		"cron: infections drain host cycles and bandwidth, spread to clanmates and get cured by firewalls",
+		[]string{"/cron/infections/"},
+		"GET",
+		attack.TickInfections,
+		nil,
+		http.StatusOK,
+		false,
+	},
 
 	Route{
 		"create new message or update owned message (admin can do everything)",
@@ -319,6 +630,16 @@ var API = Routes{
 			Messages: []message.Message{message.Message{}}, BoardKey: "board key"}},
 		true,
 	},
+	Route{
+		"retrieve boards shared with allied clans",
+		[]string{"/messages/boards/alliances/", "/messages/boards/alliances/:cursor_key/"},
+		"GET",
+		message.ListAllianceBoards,
+		nil,
+		app.JSONResult{Result: message.MessageList{Cursor: "paging",
+			Messages: []message.Message{message.Message{}}, BoardKey: "board key"}},
+		true,
+	},
 	Route{
 		"retrieve public boards",
 		[]string{"/messages/boards/public/", "/messages/boards/public/:cursor_key/"},
@@ -351,6 +672,15 @@ var API = Routes{
 			ThreadKey: "thread key"}},
 		true,
 	},
+	Route{
+		"game balance rules in use (read only)",
+		[]string{"/config/balance/"},
+		"GET",
+		config.GetBalance,
+		nil,
+		app.JSONResult{Result: config.Default},
+		true,
+	},
 	Route{
 		"retrieve all current active programs",
 		[]string{"/programs/"},
@@ -361,12 +691,48 @@ var API = Routes{
 		true,
 	},
 	Route{
-		"create or update program",
+		"admin only, validate and create or update program, returns the applied changes",
 		[]string{"/programs/"},
 		"POST",
 		program.CreateOrUpdateProgram,
-		app.JSONResult{Result: program.Program{}},
-		http.StatusOK,
+		program.Program{},
+		app.JSONResult{Result: program.ProgramDiff{Changes: []program.FieldChange{program.FieldChange{}}}},
+		true,
+	},
+	Route{
+		"admin only, validate program and show the changes without storing them",
+		[]string{"/programs/diffs/"},
+		"POST",
+		program.DiffProgram,
+		program.Program{},
+		app.JSONResult{Result: program.ProgramDiff{DryRun: true, Changes: []program.FieldChange{program.FieldChange{}}}},
+		true,
+	},
+	Route{
+		"admin only, remove program, programs still owned by players are disabled instead",
+		[]string{"/programs/:program_key/"},
+		"DELETE",
+		program.RemoveProgram,
+		nil,
+		app.JSONResult{Result: program.Removal{}},
+		true,
+	},
+	Route{
+		"admin only, apply a balance patch as a new catalogue version, owned programs are migrated",
+		[]string{"/catalogues/patches/"},
+		"POST",
+		program.ApplyBalancePatch,
+		program.Patch{Note: "nerf swarm", Programs: []program.Program{program.Program{}}},
+		app.JSONResult{Result: 2},
+		true,
+	},
+	Route{
+		"retrieve the last catalogue versions",
+		[]string{"/catalogues/patches/"},
+		"GET",
+		program.BalancePatches,
+		nil,
+		app.JSONResult{Result: []program.CataloguePatch{program.CataloguePatch{}}},
 		true,
 	},
 	Route{
@@ -379,12 +745,57 @@ var API = Routes{
 		true,
 	},
 	Route{
-		"internal loads all prgrams into datastore",
+		"admin only, loads all prgrams into datastore",
 		[]string{"/load/programs/"},
 		"GET",
 		program.LoadPrograms,
 		nil,
 		http.StatusOK,
+		true,
+	},
+	Route{
+		"all seasons, most recent first",
+		[]string{"/seasons/"},
+		"GET",
+		season.ListSeasons,
+		nil,
+		app.JSONResult{Result: []season.Season{season.Season{}}},
+		true,
+	},
+	Route{
+		"admin only, schedule the next season, only one season can run at a time",
+		[]string{"/seasons/"},
+		"PUT",
+		season.PlanSeason,
+		season.SeasonPlan{Name: "season name"},
+		app.JSONResult{Result: season.Season{}},
+		true,
+	},
+	Route{
+		"admin only, end the running season now: archive results and reset the world",
+		[]string{"/seasons/endings/"},
+		"POST",
+		season.EndSeason,
+		nil,
+		http.StatusOK,
+		true,
+	},
+	Route{
+		"hall of fame of a season",
+		[]string{"/seasons/halloffame/:season/"},
+		"GET",
+		season.SeasonHallOfFame,
+		nil,
+		app.JSONResult{Result: season.HallOfFame{Players: []season.Result{season.Result{}}}},
+		true,
+	},
+	Route{
+		"cron: end the running season when its end date passed",
+		[]string{"/cron/seasons/"},
+		"GET",
+		season.ReviewSeason,
+		nil,
+		http.StatusOK,
 		false,
 	},
 	/*Route{
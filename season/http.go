@@ -0,0 +1,76 @@
+package season
+
+import (
+	"mj0lk.be/netwars/app"
+	"net/http"
+	"strconv"
+)
+
+func ListSeasons(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	seasons, err := Seasons(c)
+	if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: seasons}
+	}
+	res.JSONf(w)
+}
+
+func SeasonHallOfFame(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	number, err := strconv.ParseInt(c.Param("season"), 10, 64)
+	if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
+	fame, err := Fame(c, number)
+	if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: fame}
+	}
+	res.JSONf(w)
+}
+
+func PlanSeason(w http.ResponseWriter, r *http.Request, c app.Context) {
+	var res app.JSONResult
+	plan := SeasonPlan{}
+	if err := app.DecodeJsonBody(r, &plan); err != nil {
+		res = app.JSONResult{Success: false, StatusCode: 422, Error: err.Error()}
+		res.JSONf(w)
+		return
+	}
+	season, err := Plan(c, c.User, plan)
+	if err == NotAdminError {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusForbidden, Error: err.Error()}
+	} else if err != nil {
+		res = app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	} else {
+		res = app.JSONResult{Success: true, StatusCode: http.StatusOK, Result: season}
+	}
+	res.JSONf(w)
+}
+
+func EndSeason(w http.ResponseWriter, r *http.Request, c app.Context) {
+	if err := End(c, c.User); err == NotAdminError {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusForbidden, Error: err.Error()}
+		res.JSONf(w)
+	} else if err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
+
+func ReviewSeason(w http.ResponseWriter, r *http.Request, c app.Context) {
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusForbidden, Error: "cron only"}
+		res.JSONf(w)
+		return
+	}
+	if err := Review(c); err != nil {
+		res := app.JSONResult{Success: false, StatusCode: http.StatusInternalServerError, Error: err.Error()}
+		res.JSONf(w)
+	}
+}
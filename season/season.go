@@ -0,0 +1,329 @@
+package season
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"errors"
+	"fmt"
+	"mj0lk.be/netwars/clan"
+	"mj0lk.be/netwars/player"
+	"time"
+)
+
+const (
+	HALLOFFAME = 100 //players and clans archived per season
+	RESETBATCH = 100
+	PLAYERS    = "players"
+	CLANS      = "clans"
+)
+
+var (
+	SeasonRunningError = errors.New("A season is still running")
+	NoSeasonError      = errors.New("No running season")
+	NotAdminError      = errors.New("Administrator access required")
+)
+
+//set in init, the reset funcs queue their own next batch
+var (
+	resetPlayersFunc *delay.Function
+	resetClansFunc   *delay.Function
+	purgeEventsFunc  *delay.Function
+)
+
+func init() {
+	resetPlayersFunc = delay.Func("resetPlayers", resetPlayers)
+	resetClansFunc = delay.Func("resetClans", resetClans)
+	purgeEventsFunc = delay.Func("purgeEvents", purgeEvents)
+}
+
+//keyid: number
+type Season struct {
+	Number int64     `json:"season"`
+	Name   string    `json:"name"`
+	Start  time.Time `json:"start"` //seasons start when planned
+	End    time.Time `json:"end"`
+	Ended  bool      `json:"ended"`
+}
+
+type SeasonPlan struct {
+	Name string    `json:"name"`
+	End  time.Time `json:"end"`
+}
+
+//parent season, keyname: ranking + rank
+type Result struct {
+	Ranking        string    `json:"-"`
+	Rank           int64     `json:"rank"`
+	ID             int64     `json:"id"` //player or clan id
+	Name           string    `datastore:",noindex" json:"name"`
+	Tag            string    `datastore:",noindex" json:"tag"`
+	BandwidthUsage float64   `datastore:",noindex" json:"bandwidth_usage"`
+	Cps            int64     `datastore:",noindex" json:"cps"`
+	Aps            int64     `datastore:",noindex" json:"aps"`
+	Archived       time.Time `datastore:",noindex" json:"archived"`
+}
+
+type HallOfFame struct {
+	Season  Season   `json:"season"`
+	Players []Result `json:"players"`
+	Clans   []Result `json:"clans"`
+}
+
+func seasonKey(c appengine.Context, number int64) *datastore.Key {
+	return datastore.NewKey(c, "Season", "", number, nil)
+}
+
+func admin(c appengine.Context, playerStr string) error {
+	ok, err := player.IsAdmin(c, playerStr)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return NotAdminError
+	}
+	return nil
+}
+
+//most recent first
+func Seasons(c appengine.Context) ([]Season, error) {
+	seasons := make([]Season, 0)
+	if _, err := datastore.NewQuery("Season").Order("-Number").GetAll(c, &seasons); err != nil {
+		return nil, err
+	}
+	return seasons, nil
+}
+
+//season not ended yet, nil without one
+func Current(c appengine.Context) (*Season, error) {
+	seasons := make([]Season, 0, 1)
+	if _, err := datastore.NewQuery("Season").Order("-Number").Limit(1).GetAll(c, &seasons); err != nil {
+		return nil, err
+	}
+	if len(seasons) == 0 || seasons[0].Ended {
+		return nil, nil
+	}
+	return &seasons[0], nil
+}
+
+//admin only, starts the next season, the previous one reset the world when it ended
+func Plan(c appengine.Context, playerStr string, plan SeasonPlan) (Season, error) {
+	if err := admin(c, playerStr); err != nil {
+		return Season{}, err
+	}
+	if len(plan.Name) == 0 {
+		return Season{}, errors.New("Season name required")
+	}
+	now := time.Now()
+	if !plan.End.After(now) {
+		return Season{}, errors.New("Season must end in the future")
+	}
+	seasons := make([]Season, 0, 1)
+	if _, err := datastore.NewQuery("Season").Order("-Number").Limit(1).GetAll(c, &seasons); err != nil {
+		return Season{}, err
+	}
+	season := Season{Number: 1, Name: plan.Name, Start: now, End: plan.End}
+	if len(seasons) > 0 {
+		if !seasons[0].Ended {
+			return Season{}, SeasonRunningError
+		}
+		season.Number = seasons[0].Number + 1
+	}
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		key := seasonKey(c, season.Number)
+		if err := datastore.Get(c, key, new(Season)); err == nil {
+			return SeasonRunningError
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err := datastore.Put(c, key, &season)
+		return err
+	}, nil)
+	return season, err
+}
+
+//cron, ends the running season once its end date passed
+func Review(c appengine.Context) error {
+	season, err := Current(c)
+	if err != nil || season == nil {
+		return err
+	}
+	if season.End.After(time.Now()) {
+		return nil
+	}
+	return end(c, season.Number)
+}
+
+//admin only, ends the running season now
+func End(c appengine.Context, playerStr string) error {
+	if err := admin(c, playerStr); err != nil {
+		return err
+	}
+	season, err := Current(c)
+	if err != nil {
+		return err
+	}
+	if season == nil {
+		return NoSeasonError
+	}
+	return end(c, season.Number)
+}
+
+func archive(c appengine.Context, key *datastore.Key) error {
+	now := time.Now()
+	var players []player.Player
+	if _, err := datastore.NewQuery("Player").Order("-BandwidthUsage").Limit(HALLOFFAME).
+		GetAll(c, &players); err != nil {
+		return err
+	}
+	var teams []clan.Clan
+	if _, err := datastore.NewQuery("Clan").Order("-BandwidthUsage").Limit(HALLOFFAME).
+		GetAll(c, &teams); err != nil {
+		return err
+	}
+	keys := make([]*datastore.Key, 0, len(players)+len(teams))
+	results := make([]interface{}, 0, len(players)+len(teams))
+	for i, p := range players {
+		rank := int64(i + 1)
+		keys = append(keys, datastore.NewKey(c, "Result", fmt.Sprintf("%s%d", PLAYERS, rank), 0, key))
+		results = append(results, &Result{PLAYERS, rank, p.ID, p.Nick, p.ClanTag, p.BandwidthUsage,
+			p.Cps, p.Aps, now})
+	}
+	for i, team := range teams {
+		rank := int64(i + 1)
+		keys = append(keys, datastore.NewKey(c, "Result", fmt.Sprintf("%s%d", CLANS, rank), 0, key))
+		results = append(results, &Result{CLANS, rank, team.ID, team.Name, team.Tag, team.BandwidthUsage,
+			team.Cps, 0, now})
+	}
+	_, err := datastore.PutMulti(c, keys, results)
+	return err
+}
+
+//archives the results (result keys are fixed, a retry overwrites) then resets the world
+func end(c appengine.Context, number int64) error {
+	key := seasonKey(c, number)
+	if err := archive(c, key); err != nil {
+		return err
+	}
+	ended := false
+	if err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		season := new(Season)
+		if err := datastore.Get(c, key, season); err != nil {
+			return err
+		}
+		if season.Ended {
+			return nil
+		}
+		season.Ended = true
+		if _, err := datastore.Put(c, key, season); err != nil {
+			return err
+		}
+		ended = true
+		return nil
+	}, nil); err != nil {
+		return err
+	}
+	if ended {
+		resetPlayersFunc.Call(c, "")
+		resetClansFunc.Call(c, "")
+		purgeEventsFunc.Call(c)
+	}
+	return nil
+}
+
+func Fame(c appengine.Context, number int64) (HallOfFame, error) {
+	key := seasonKey(c, number)
+	var fame HallOfFame
+	if err := datastore.Get(c, key, &fame.Season); err != nil {
+		return HallOfFame{}, err
+	}
+	fame.Players = make([]Result, 0)
+	fame.Clans = make([]Result, 0)
+	if _, err := datastore.NewQuery("Result").Ancestor(key).Filter("Ranking =", PLAYERS).Order("Rank").
+		GetAll(c, &fame.Players); err != nil {
+		return HallOfFame{}, err
+	}
+	if _, err := datastore.NewQuery("Result").Ancestor(key).Filter("Ranking =", CLANS).Order("Rank").
+		GetAll(c, &fame.Clans); err != nil {
+		return HallOfFame{}, err
+	}
+	return fame, nil
+}
+
+func batch(c appengine.Context, kind, cursorStr string) ([]*datastore.Key, string, error) {
+	q := datastore.NewQuery(kind).KeysOnly().Limit(RESETBATCH)
+	if len(cursorStr) > 0 {
+		cursor, err := datastore.DecodeCursor(cursorStr)
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Start(cursor)
+	}
+	t := q.Run(c)
+	keys := make([]*datastore.Key, 0, RESETBATCH)
+	for {
+		key, err := t.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) < RESETBATCH {
+		return keys, "", nil
+	}
+	cursor, err := t.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return keys, cursor.String(), nil
+}
+
+func resetPlayers(c appengine.Context, cursorStr string) error {
+	keys, next, err := batch(c, "Player", cursorStr)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := player.Reset(c, key); err != nil {
+			return err
+		}
+	}
+	if len(next) > 0 {
+		resetPlayersFunc.Call(c, next)
+	}
+	return nil
+}
+
+func resetClans(c appengine.Context, cursorStr string) error {
+	keys, next, err := batch(c, "Clan", cursorStr)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := clan.Reset(c, key); err != nil {
+			return err
+		}
+	}
+	if len(next) > 0 {
+		resetClansFunc.Call(c, next)
+	}
+	return nil
+}
+
+//deleted events are gone from the next query, no cursor needed
+func purgeEvents(c appengine.Context) error {
+	keys, _, err := batch(c, "Event", "")
+	if err != nil {
+		return err
+	}
+	if err := datastore.DeleteMulti(c, keys); err != nil {
+		return err
+	}
+	if len(keys) == RESETBATCH {
+		purgeEventsFunc.Call(c)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package season
+
+import (
+	"appengine"
+	"appengine/aetest"
+	"appengine/datastore"
+	"errors"
+	"mj0lk.be/netwars/config"
+	"mj0lk.be/netwars/player"
+	"mj0lk.be/netwars/secure"
+	"testing"
+	"time"
+)
+
+const (
+	TESTNICK  = "testnick"
+	TESTEMAIL = "testemail@mail.com"
+)
+
+func setupPlayer(c appengine.Context, nick string, email string) (string, error) {
+	cr := player.Creation{email, nick, "testpassword", ""}
+	tokenStr, usererr, err := player.Create(c, cr)
+	if err != nil {
+		return "", err
+	}
+	if usererr != nil {
+		return "", errors.New("unexpected user error")
+	}
+	playerKeyStr, _ := secure.ValidateToken(tokenStr, c)
+	return playerKeyStr, nil
+}
+
+func TestSeason(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	playerStr, err := setupPlayer(c, TESTNICK, TESTEMAIL)
+	if err != nil {
+		t.Fatalf("setup player error %s", err)
+	}
+	now := time.Now()
+	if _, err := Plan(c, playerStr, SeasonPlan{"round one", now.Add(-time.Hour)}); err == nil {
+		t.Fatalf("expected end before start error")
+	}
+	season, err := Plan(c, playerStr, SeasonPlan{"round one", now.Add(24 * time.Hour)})
+	if err != nil {
+		t.Fatalf("plan error %s", err)
+	}
+	if season.Number != 1 {
+		t.Fatalf("expected first season, got %d", season.Number)
+	}
+	time.Sleep(1 * time.Second)
+	if _, err := Plan(c, playerStr, SeasonPlan{"round two", now.Add(48 * time.Hour)}); err != SeasonRunningError {
+		t.Fatalf("expected running season error, got %v", err)
+	}
+	if err := End(c, playerStr); err != nil {
+		t.Fatalf("end error %s", err)
+	}
+	fame, err := Fame(c, season.Number)
+	if err != nil {
+		t.Fatalf("hall of fame error %s", err)
+	}
+	if !fame.Season.Ended {
+		t.Fatalf("season not ended")
+	}
+	t.Logf("hall of fame %+v", fame)
+	playerKey, _ := datastore.DecodeKey(playerStr)
+	if err := player.Reset(c, playerKey); err != nil {
+		t.Fatalf("reset error %s", err)
+	}
+	iplayer := new(player.Player)
+	if err := datastore.Get(c, playerKey, iplayer); err != nil {
+		t.Fatalf("error loading player %s", err)
+	}
+	if iplayer.Cycles != config.Get().Player.StartCycles || iplayer.Nick != TESTNICK {
+		t.Fatalf("unexpected player after reset %+v", iplayer)
+	}
+}
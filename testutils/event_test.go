@@ -22,7 +22,7 @@ const (
 )
 
 func setupPlayer(c appengine.Context, nick string, email string) (string, error) {
-	cr := player.Creation{email, nick, "testpassword"}
+	cr := player.Creation{email, nick, "testpassword", ""}
 	tokenStr, usererr, err := player.Create(c, cr)
 	if err != nil {
 		return "", err